@@ -0,0 +1,208 @@
+//Filename: cmd/api/batch.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the most operations a single batch may contain
+const maxBatchOperations = 100
+
+// the operations a batch can run on a photo
+var batchOps = []string{"update", "add_tags", "remove_tags", "move", "set_visibility", "delete"}
+
+// batchOperation is one item of a batch. Version, when set, must match the current version
+type batchOperation struct {
+	Op         string      `json:"op"`
+	ID         int64       `json:"id"`
+	Version    *int32      `json:"version"`
+	Fields     *photoPatch `json:"fields"`
+	Tags       []string    `json:"tags"`
+	Album      *string     `json:"album"`
+	Visibility *string     `json:"visibility"`
+}
+
+// batchResult is the outcome of one item of a batch. Status is the HTTP status the
+// operation would have had as a request of its own
+type batchResult struct {
+	Index  int         `json:"index"`
+	ID     int64       `json:"id"`
+	Op     string      `json:"op"`
+	Status int         `json:"status"`
+	Error  interface{} `json:"error,omitempty"`
+	Photo  *data.Photo `json:"photo,omitempty"`
+}
+
+// the operation is on a photo the user does not own
+var errNotOwner = errors.New("only the owner of the photo may do this")
+
+// batchValidationError carries the validation errors of a single operation
+type batchValidationError map[string]string
+
+func (e batchValidationError) Error() string {
+	return "failed validation"
+}
+
+// apply() changes the photo as the operation asks
+func (op *batchOperation) apply(photo *data.Photo) {
+	switch op.Op {
+	case "update":
+		op.Fields.apply(photo)
+	case "add_tags":
+		for _, tag := range op.Tags {
+			if !validator.In(tag, photo.Tags...) {
+				photo.Tags = append(photo.Tags, tag)
+			}
+		}
+	case "remove_tags":
+		tags := []string{}
+		for _, tag := range photo.Tags {
+			if !validator.In(tag, op.Tags...) {
+				tags = append(tags, tag)
+			}
+		}
+		photo.Tags = tags
+	case "move":
+		photo.Album = *op.Album
+	case "set_visibility":
+		photo.Visibility = *op.Visibility
+	}
+}
+
+// batchPhotoHandler for the POST /v1/photo/batch endpoint
+// runs up to maxBatchOperations operations on photos in one transaction.
+// mode=atomic (the default) applies all of them or none, mode=partial applies the ones that succeed.
+// the response lists the status of every operation in the order they were sent
+func (app *application) batchPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Mode       string           `json:"mode"`
+		Operations []batchOperation `json:"operations"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Mode == "" {
+		input.Mode = "atomic"
+	}
+
+	v := validator.New()
+	v.Check(validator.In(input.Mode, "atomic", "partial"), "mode", "must be atomic or partial")
+	v.Check(len(input.Operations) > 0, "operations", "must be provided")
+	v.Check(len(input.Operations) <= maxBatchOperations, "operations", fmt.Sprintf("must not contain more than %d operations", maxBatchOperations))
+	//malformed operations are rejected before anything runs
+	for i, op := range input.Operations {
+		key := fmt.Sprintf("operations[%d]", i)
+		v.Check(validator.In(op.Op, batchOps...), key, "op must be update, add_tags, remove_tags, move, set_visibility or delete")
+		switch op.Op {
+		case "update":
+			v.Check(op.Fields != nil, key, "fields must be provided")
+		case "add_tags", "remove_tags":
+			v.Check(len(op.Tags) > 0, key, "tags must be provided")
+		case "move":
+			v.Check(op.Album != nil, key, "album must be provided")
+		case "set_visibility":
+			v.Check(op.Visibility != nil, key, "visibility must be provided")
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	atomic := input.Mode == "atomic"
+	photos := make([]*data.Photo, len(input.Operations))
+	released := make([][]string, len(input.Operations))
+	errs, committed, err := app.models.Photo.Batch(len(input.Operations), atomic, func(t *data.PhotoTx, i int) error {
+		op := input.Operations[i]
+		photo, err := t.Get(op.ID)
+		if err != nil {
+			return err
+		}
+		//private photos are only visible to their owner
+		if !photo.VisibleTo(user) {
+			return data.ErrRecordNotFound
+		}
+		if op.Version != nil && *op.Version != photo.Version {
+			return data.ErrEditConflict
+		}
+		if !photo.EditableBy(user) {
+			return errNotOwner
+		}
+		if op.Op == "delete" {
+			released[i], err = t.Delete(photo.ID, photo.Version)
+			return err
+		}
+		op.apply(photo)
+		v := validator.New()
+		if data.ValidatePhoto(v, photo); !v.Valid() {
+			return batchValidationError(v.Errors)
+		}
+		err = t.Update(photo, user.ID)
+		if err != nil {
+			return err
+		}
+		photos[i] = photo
+		return nil
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	results := make([]batchResult, len(input.Operations))
+	for i, op := range input.Operations {
+		result := batchResult{Index: i, ID: op.ID, Op: op.Op}
+		var invalid batchValidationError
+		switch {
+		case errs[i] == nil && op.Op == "delete":
+			result.Status = http.StatusNoContent
+		case errs[i] == nil:
+			result.Status = http.StatusOK
+			result.Photo = photos[i]
+		case errors.Is(errs[i], data.ErrBatchAborted):
+			//the operation was fine, it was undone because another one failed
+			result.Status = http.StatusFailedDependency
+			result.Error = "not applied because another operation in the batch failed"
+		case errors.Is(errs[i], data.ErrRecordNotFound):
+			result.Status = http.StatusNotFound
+			result.Error = "the requested resource could not be found"
+		case errors.Is(errs[i], data.ErrEditConflict):
+			result.Status = http.StatusConflict
+			result.Error = "unable to update the record due to an edit conflict, please try again"
+		case errors.Is(errs[i], errNotOwner):
+			result.Status = http.StatusForbidden
+			result.Error = errNotOwner.Error()
+		case errors.As(errs[i], &invalid):
+			result.Status = http.StatusUnprocessableEntity
+			result.Error = map[string]string(invalid)
+		default:
+			app.logError(r, errs[i])
+			result.Status = http.StatusInternalServerError
+			result.Error = "the server encountered a problem and could not process the request"
+		}
+		results[i] = result
+	}
+	//originals of deleted photos can only be collected once the deletes are committed
+	if committed {
+		for i, hashes := range released {
+			for _, hash := range hashes {
+				if errs[i] == nil {
+					app.collectBlob(r, hash)
+				}
+			}
+		}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"mode": input.Mode, "committed": committed, "results": results}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
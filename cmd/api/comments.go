@@ -0,0 +1,307 @@
+//Filename: cmd/api/comments.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// readVisiblePhoto() reads the :id of a photo and returns it if the caller can see it
+func (app *application) readVisiblePhoto(w http.ResponseWriter, r *http.Request) (*data.Photo, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	photo, err := app.models.Photo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	//private photos are only visible to their owner
+	if !photo.VisibleTo(app.contextGetUser(r)) {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	return photo, true
+}
+
+// readComment() reads the :comment_id of a comment on the photo and returns it if the
+// caller can see it. deleted comments are gone for everyone
+func (app *application) readComment(w http.ResponseWriter, r *http.Request, photo *data.Photo) (*data.Comment, bool) {
+	id, err := app.readCommentIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	c, err := app.models.Comments.Get(id, photo.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	if c.Deleted() || !commentVisibleTo(c, photo, app.contextGetUser(r)) {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	return c, true
+}
+
+// commentVisibleTo() reports if the user may read the comment. hidden comments are
+// only seen by their author and the owner of the photo
+func commentVisibleTo(c *data.Comment, photo *data.Photo, user *data.User) bool {
+	if !c.Hidden {
+		return true
+	}
+	return photo.OwnedBy(user) || (!user.IsAnonymous() && c.UserID == user.ID)
+}
+
+// presentComments() removes what the user may not read from a thread. deleted comments
+// lose their body, and so do hidden ones the user may not read. such a top level comment
+// is kept as a placeholder while it still has replies, a reply is dropped
+func presentComments(thread []*data.Comment, photo *data.Photo, user *data.User) []*data.Comment {
+	comments := []*data.Comment{}
+	for _, c := range thread {
+		replies := []*data.Comment{}
+		for _, reply := range c.Replies {
+			if !reply.Deleted() && commentVisibleTo(reply, photo, user) {
+				replies = append(replies, reply)
+			}
+		}
+		c.Replies = replies
+		if c.Deleted() || !commentVisibleTo(c, photo, user) {
+			if len(c.Replies) == 0 {
+				continue
+			}
+			c.Body = ""
+		}
+		comments = append(comments, c)
+	}
+	return comments
+}
+
+// notifyComment() tells the owner of the photo about a new comment and, for a reply,
+// the author of the comment replied to
+func (app *application) notifyComment(r *http.Request, photo *data.Photo, c *data.Comment) {
+	if photo.UserID != nil {
+		app.notify(r, &data.Notification{UserID: *photo.UserID, ActorID: c.UserID, Type: data.NotificationComment, PhotoID: photo.ID, CommentID: &c.ID})
+	}
+	if c.ParentID == nil {
+		return
+	}
+	parent, err := app.models.Comments.Get(*c.ParentID, photo.ID)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+	//the owner already heard about it as a comment
+	if photo.UserID != nil && parent.UserID == *photo.UserID {
+		return
+	}
+	app.notify(r, &data.Notification{UserID: parent.UserID, ActorID: c.UserID, Type: data.NotificationReply, PhotoID: photo.ID, CommentID: &c.ID})
+}
+
+// listCommentsHandler for the GET /v1/photo/:id/comments endpoint
+// lists the comments on a photo oldest first, with their replies nested under them
+func (app *application) listCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	photo, ok := app.readVisiblePhoto(w, r)
+	if !ok {
+		return
+	}
+	comments, err := app.models.Comments.GetAllForPhoto(photo.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	comments = presentComments(data.Thread(comments), photo, app.contextGetUser(r))
+	err = app.writeJSON(w, http.StatusOK, envelope{"comments_disabled": photo.CommentsDisabled, "comments": comments}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createCommentHandler for the POST /v1/photo/:id/comments endpoint
+// comments on a photo, or replies to a top level comment when parent_id is sent
+func (app *application) createCommentHandler(w http.ResponseWriter, r *http.Request) {
+	photo, ok := app.readVisiblePhoto(w, r)
+	if !ok {
+		return
+	}
+	if photo.CommentsDisabled {
+		app.commentsDisabledResponse(w, r)
+		return
+	}
+	var input struct {
+		Body     string `json:"body"`
+		ParentID *int64 `json:"parent_id"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	user := app.contextGetUser(r)
+	c := &data.Comment{
+		PhotoID:  photo.ID,
+		UserID:   user.ID,
+		Author:   user.Name,
+		ParentID: input.ParentID,
+		Body:     input.Body,
+	}
+	v := validator.New()
+	if data.ValidateComment(v, c); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Comments.Insert(c)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("parent_id", "must be a comment on this photo that is not itself a reply")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.notifyComment(r, photo, c)
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/photo/%d/comments/%d", photo.ID, c.ID))
+	headers.Set("ETag", app.commentETag(c))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"comment": c}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showCommentHandler for the GET /v1/photo/:id/comments/:comment_id endpoint
+func (app *application) showCommentHandler(w http.ResponseWriter, r *http.Request) {
+	photo, ok := app.readVisiblePhoto(w, r)
+	if !ok {
+		return
+	}
+	c, ok := app.readComment(w, r, photo)
+	if !ok {
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", app.commentETag(c))
+	err := app.writeJSON(w, http.StatusOK, envelope{"comment": c}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateCommentHandler for the PATCH /v1/photo/:id/comments/:comment_id endpoint
+// the author can change the body while comments are enabled, the owner of the photo
+// can hide or show the comment. If-Match or a stale version gives an edit conflict
+func (app *application) updateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	photo, ok := app.readVisiblePhoto(w, r)
+	if !ok {
+		return
+	}
+	c, ok := app.readComment(w, r, photo)
+	if !ok {
+		return
+	}
+	//the client's copy must still be the current version
+	if app.preconditionFailed(r, app.commentETag(c)) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+	var input struct {
+		Body   *string `json:"body"`
+		Hidden *bool   `json:"hidden"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	user := app.contextGetUser(r)
+	if input.Body != nil {
+		if c.UserID != user.ID {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		if photo.CommentsDisabled {
+			app.commentsDisabledResponse(w, r)
+			return
+		}
+		c.Body = *input.Body
+	}
+	if input.Hidden != nil {
+		if !photo.OwnedBy(user) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		c.Hidden = *input.Hidden
+	}
+	v := validator.New()
+	if data.ValidateComment(v, c); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Comments.Update(c)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", app.commentETag(c))
+	err = app.writeJSON(w, http.StatusOK, envelope{"comment": c}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCommentHandler for the DELETE /v1/photo/:id/comments/:comment_id endpoint
+// the author or the owner of the photo can delete a comment. its replies stay
+func (app *application) deleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	photo, ok := app.readVisiblePhoto(w, r)
+	if !ok {
+		return
+	}
+	c, ok := app.readComment(w, r, photo)
+	if !ok {
+		return
+	}
+	user := app.contextGetUser(r)
+	if c.UserID != user.ID && !photo.OwnedBy(user) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	err := app.models.Comments.Delete(c.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "comment successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
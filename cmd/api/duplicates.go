@@ -0,0 +1,184 @@
+//Filename: cmd/api/duplicates.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// similarPhotosHandler for the GET /v1/photo/:id/similar endpoint
+// lists the photos that look like the given one, closest first.
+// threshold is the most bits the perceptual hashes may differ by
+func (app *application) similarPhotosHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	threshold := app.readInt(qs, "threshold", 6, v)
+	limit := app.readInt(qs, "limit", 20, v)
+	data.ValidateThreshold(v, threshold)
+	v.Check(limit > 0 && limit <= 100, "limit", "must be between 1 and 100")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	photo, err := app.models.Photo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !photo.VisibleTo(user) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	similar, err := app.models.Photo.Similar(photo.ID, user.ID, threshold, limit)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"photos": similar}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listDuplicatesHandler for the GET /v1/duplicates endpoint
+// reports the groups of the caller's photos that look the same, with the copy worth keeping
+func (app *application) listDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	threshold := app.readInt(r.URL.Query(), "threshold", 3, v)
+	if data.ValidateDuplicateThreshold(v, threshold); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	groups, err := app.models.Photo.Duplicates(app.contextGetUser(r).ID, threshold)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"duplicates": groups}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// resolveDuplicatesHandler for the POST /v1/duplicates/resolve endpoint
+// keeps one photo of every group and deletes the rest. a group keeps the photo
+// named by keep, or the best one (most pixels, biggest file, oldest) when keep is left out.
+// dry_run reports what would be deleted without deleting it
+func (app *application) resolveDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Groups []struct {
+			PhotoIDs []int64 `json:"photo_ids"`
+			Keep     *int64  `json:"keep"`
+		} `json:"groups"`
+		DryRun bool `json:"dry_run"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(input.Groups) > 0, "groups", "must be provided")
+	v.Check(len(input.Groups) <= 100, "groups", "must not contain more than 100 groups")
+	seen := map[int64]bool{}
+	total := 0
+	for _, group := range input.Groups {
+		v.Check(len(group.PhotoIDs) > 1, "groups", "every group must contain at least two photos")
+		total += len(group.PhotoIDs)
+		kept := group.Keep == nil
+		for _, id := range group.PhotoIDs {
+			v.Check(!seen[id], "groups", "a photo must only appear once")
+			seen[id] = true
+			kept = kept || id == *group.Keep
+		}
+		v.Check(kept, "keep", "must be one of the photos in its group")
+	}
+	v.Check(total <= 1000, "groups", "must not contain more than 1000 photos")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	ids := make([]int64, 0, total)
+	for _, group := range input.Groups {
+		ids = append(ids, group.PhotoIDs...)
+	}
+	candidates, err := app.models.Photo.DuplicateCandidates(user.ID, ids)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	byID := make(map[int64]*data.DuplicateCandidate, len(candidates))
+	for _, c := range candidates {
+		byID[c.ID] = c
+	}
+
+	type resolution struct {
+		Keep    int64   `json:"keep"`
+		Deleted []int64 `json:"deleted"`
+	}
+	resolved := []resolution{}
+	deleted := []int64{}
+	for _, group := range input.Groups {
+		photos := make([]*data.DuplicateCandidate, 0, len(group.PhotoIDs))
+		for _, id := range group.PhotoIDs {
+			c, ok := byID[id]
+			//someone else's photo (or one without a hash) is reported as missing
+			if !ok {
+				app.notFoundResponse(w, r)
+				return
+			}
+			photos = append(photos, c)
+		}
+		keep := data.BestCandidate(photos)
+		if group.Keep != nil {
+			keep = *group.Keep
+		}
+		res := resolution{Keep: keep, Deleted: []int64{}}
+		for _, c := range photos {
+			if c.ID != keep {
+				res.Deleted = append(res.Deleted, c.ID)
+			}
+		}
+		deleted = append(deleted, res.Deleted...)
+		resolved = append(resolved, res)
+	}
+
+	if !input.DryRun {
+		hashes, err := app.models.Photo.DeleteOwned(user.ID, deleted)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		for _, hash := range hashes {
+			app.collectBlob(r, hash)
+		}
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"resolved": resolved, "dry_run": input.DryRun}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
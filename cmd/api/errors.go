@@ -103,3 +103,45 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	message := "your user account does not have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+// the If-Match precondition sent by the client did not match the current version
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource has been modified since you last fetched it, please fetch it again"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+// an Idempotency-Key was sent again with a different request
+func (app *application) idempotencyKeyReusedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the Idempotency-Key has already been used for a different request"
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+// a retry waited too long for the request running with its Idempotency-Key
+func (app *application) idempotencyKeyBusyResponse(w http.ResponseWriter, r *http.Request) {
+	message := "a request with this Idempotency-Key is still running, please try again later"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// another request turned a resumable upload into a photo first
+func (app *application) uploadFinishedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the upload was finished by another request, send a HEAD request to find its photo"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// a render URL was not signed by us, was changed, or has expired
+func (app *application) invalidRenderSignatureResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the render URL is invalid or has expired"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// the owner only shares watermarked renders of the photo
+func (app *application) watermarkedOnlyResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the owner only shares watermarked copies of this photo, request a render URL instead"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// the owner of the photo has turned its comments off
+func (app *application) commentsDisabledResponse(w http.ResponseWriter, r *http.Request) {
+	message := "comments are disabled on this photo"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
@@ -0,0 +1,331 @@
+//Filename: cmd/api/events.go
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"photoalbum.joelical.net/internal/data"
+)
+
+const (
+	// the events waiting for a slow stream. past that it is closed and the client
+	// catches up with Last-Event-ID when it reconnects
+	eventBuffer = 64
+	// how often an idle stream is sent a comment so proxies keep it open
+	eventHeartbeat = 15 * time.Second
+	// the events read from the log at a time when a stream resumes
+	eventReplayPage = 500
+	// how long the LISTEN connection may go without a notification before it is checked
+	eventListenerPing = 90 * time.Second
+)
+
+// eventHub hands the events of this instance's LISTEN connection to its open streams
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[*eventSub]struct{}
+	closed bool
+}
+
+// an eventSub is an open stream. ch is closed when the stream has to end
+type eventSub struct {
+	user *data.User
+	ch   chan *data.Event
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[*eventSub]struct{})}
+}
+
+// subscribe() opens a stream of the events the user may see
+func (h *eventHub) subscribe(user *data.User) *eventSub {
+	sub := &eventSub{user: user, ch: make(chan *data.Event, eventBuffer)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(sub.ch)
+		return sub
+	}
+	h.subs[sub] = struct{}{}
+	return sub
+}
+
+// unsubscribe() forgets a stream, if it is still open
+func (h *eventHub) unsubscribe(sub *eventSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// publish() sends an event to every stream allowed to see it
+func (h *eventHub) publish(e *data.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if !e.VisibleTo(sub.user) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			//the stream is not keeping up
+			delete(h.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// close() ends every stream and refuses new ones. it is called when the server shuts
+// down, which would otherwise wait for the streams to end on their own
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// listenEvents() LISTENs for the events written by any instance and publishes them
+// to this instance's streams until ctx is cancelled. the same connection LISTENs for
+// outbox messages, which wake the relay
+func (app *application) listenEvents(ctx context.Context) {
+	app.background(func() {
+		listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"task": "listen for events"})
+			}
+		})
+		//Listen() blocks while the database is down, closing the listener releases it
+		go func() {
+			<-ctx.Done()
+			listener.Close()
+		}()
+		for _, channel := range []string{"events", "outbox"} {
+			err := listener.Listen(channel)
+			if err != nil {
+				if ctx.Err() == nil {
+					app.logger.PrintError(err, map[string]string{"task": "listen for events"})
+				}
+				return
+			}
+		}
+
+		//events written before a lost connection is noticed are replayed from here.
+		//-1 means we don't know where the log was, which is found out again on reconnecting
+		last, err := app.models.Events.Last()
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"task": "listen for events"})
+			last = -1
+		}
+		ping := time.NewTimer(eventListenerPing)
+		defer ping.Stop()
+		for {
+			select {
+			case n, ok := <-listener.Notify:
+				if !ok {
+					return
+				}
+				switch {
+				case n != nil && n.Channel == "outbox":
+					app.wakeRelay()
+				case n == nil:
+					//the connection was lost and notifications may have been missed
+					app.wakeRelay()
+					if last < 0 {
+						last, err = app.models.Events.Last()
+						if err != nil {
+							last = -1
+						}
+						break
+					}
+					last, err = app.replayEvents(last)
+				default:
+					last, err = app.publishEvent(last, n.Extra)
+				}
+				if err != nil {
+					app.logger.PrintError(err, map[string]string{"task": "listen for events"})
+				}
+			case <-ping.C:
+				//check the connection is still alive, a lost one is re-established
+				go listener.Ping()
+			case <-ctx.Done():
+				return
+			}
+			if !ping.Stop() {
+				select {
+				case <-ping.C:
+				default:
+				}
+			}
+			ping.Reset(eventListenerPing)
+		}
+	})
+}
+
+// publishEvent() publishes the event with the id in a notification's payload and returns
+// the newest event id seen
+func (app *application) publishEvent(last int64, payload string) (int64, error) {
+	id, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return last, err
+	}
+	e, err := app.models.Events.Get(id)
+	if err != nil {
+		//an event can be trimmed from the log before we read it
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return last, nil
+		}
+		return last, err
+	}
+	app.events.publish(e)
+	if e.ID > last {
+		last = e.ID
+	}
+	return last, nil
+}
+
+// replayEvents() publishes every event after last, a page at a time, and returns the
+// newest event id seen
+func (app *application) replayEvents(last int64) (int64, error) {
+	for {
+		events, err := app.models.Events.After(last, eventReplayPage)
+		if err != nil {
+			return last, err
+		}
+		for _, e := range events {
+			app.events.publish(e)
+			last = e.ID
+		}
+		if len(events) < eventReplayPage {
+			return last, nil
+		}
+	}
+}
+
+// writeEvent() writes an event in the text/event-stream format
+func writeEvent(w http.ResponseWriter, e *data.Event) error {
+	js, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, js)
+	return err
+}
+
+// eventsHandler for the GET /v1/events endpoint
+// streams the changes to photos, comments and notifications the caller may see as
+// Server-Sent Events. a client that reconnects with Last-Event-ID is first sent what
+// it missed; when the log no longer goes back that far it is sent a reset event and
+// should refetch what it shows. the stream ends when the caller's token expires
+func (app *application) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	var lastID int64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseInt(header, 10, 64)
+		if err != nil || id < 0 {
+			app.badRequestResponse(w, r, errors.New("Last-Event-ID must be the id of an event"))
+			return
+		}
+		lastID = id
+	}
+	//the stream is meant to outlive the server's write timeout
+	rc := http.NewResponseController(w)
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	//subscribe before replaying so nothing written in between is missed
+	user := app.contextGetUser(r)
+	sub := app.events.subscribe(user)
+	defer app.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	//stop proxies such as nginx from holding events back
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	//events that are replayed may come in live as well
+	replayed := make(map[int64]bool)
+	if lastID > 0 {
+		retained, err := app.models.Events.Retained(lastID)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+		if !retained {
+			if _, err := fmt.Fprint(w, "event: reset\ndata: {}\n\n"); err != nil {
+				return
+			}
+		}
+		for retained {
+			events, err := app.models.Events.After(lastID, eventReplayPage)
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+			for _, e := range events {
+				lastID = e.ID
+				if !e.VisibleTo(user) {
+					continue
+				}
+				if err := writeEvent(w, e); err != nil {
+					return
+				}
+				replayed[e.ID] = true
+			}
+			retained = len(events) == eventReplayPage
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e, ok := <-sub.ch:
+			//the server is shutting down or the client fell too far behind
+			if !ok {
+				return
+			}
+			if replayed[e.ID] {
+				continue
+			}
+			if err := writeEvent(w, e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			//the token may have expired since the stream was opened
+			_, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -3,6 +3,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +15,7 @@ import (
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"photoalbum.joelical.net/internal/data"
 	"photoalbum.joelical.net/internal/validator"
 )
 
@@ -30,6 +33,36 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// readVersionParam() gets the ":version" parameter from the URL
+func (app *application) readVersionParam(r *http.Request) (int32, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	version, err := strconv.ParseInt(params.ByName("version"), 10, 32)
+	if err != nil || version < 1 {
+		return 0, errors.New("invalid version parameter")
+	}
+	return int32(version), nil
+}
+
+// readCommentIDParam() gets the ":comment_id" parameter from the URL
+func (app *application) readCommentIDParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.ParseInt(params.ByName("comment_id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid comment_id parameter")
+	}
+	return id, nil
+}
+
+// readDeliveryIDParam() gets the ":delivery_id" parameter from the URL
+func (app *application) readDeliveryIDParam(r *http.Request) (int64, error) {
+	params := httprouter.ParamsFromContext(r.Context())
+	id, err := strconv.ParseInt(params.ByName("delivery_id"), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("invalid delivery_id parameter")
+	}
+	return id, nil
+}
+
 // we create our method write json to create responses
 func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
 	//convert our map into a JSON object
@@ -144,6 +177,140 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return intValue
 }
 
+// photoETag() builds a strong ETag for a photo. the version is bumped on every
+// update and the reactions version on every favorite and reaction, so it changes
+// whenever the representation does
+func (app *application) photoETag(photo *data.Photo) string {
+	return fmt.Sprintf(`"photo-%d-v%d.%d"`, photo.ID, photo.Version, photo.ReactionsVersion)
+}
+
+// commentETag() builds a strong ETag for a comment from its version
+func (app *application) commentETag(c *data.Comment) string {
+	return fmt.Sprintf(`"comment-%d-v%d"`, c.ID, c.Version)
+}
+
+// listETag() builds a strong ETag for a page of photos from the id and version
+// of every photo on the page plus the pagination metadata. extra is anything else
+// sent with the page, such as facet counts, and is hashed as JSON
+func (app *application) listETag(photos []*data.Photo, metadata data.Metadata, extra ...interface{}) string {
+	h := sha256.New()
+	for _, photo := range photos {
+		fmt.Fprintf(h, "%d:%d.%d;", photo.ID, photo.Version, photo.ReactionsVersion)
+	}
+	fmt.Fprintf(h, "%+v", metadata)
+	for _, e := range extra {
+		json.NewEncoder(h).Encode(e)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+}
+
+// varyBy() adds a request header to the Vary header of a response unless it is already there
+func varyBy(h http.Header, name string) {
+	for _, value := range h.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// etagMatches() checks an If-Match/If-None-Match header value against an ETag.
+// weak comparison ignores the W/ prefix, which If-None-Match requires and If-Match forbids
+func (app *application) etagMatches(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified() answers a GET with 304 when the If-None-Match header matches the ETag
+func (app *application) notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" || !app.etagMatches(header, etag, true) {
+		return false
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// preconditionFailed() checks the If-Match header of an unsafe request.
+// no header means the client did not ask for a precondition
+func (app *application) preconditionFailed(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return false
+	}
+	return !app.etagMatches(header, etag, false)
+}
+
+// the readFloat() method converts a string value from the query string to a float value.
+// if the value cannot be converted then a validation error is added to the validation errors map
+func (app *application) readFloat(qs url.Values, key string, defaultValue float64, v *validator.Validator) float64 {
+	value := qs.Get(key)
+	if value == "" {
+		return defaultValue
+	}
+	floatValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		v.AddError(key, "must be a number")
+		return defaultValue
+	}
+	return floatValue
+}
+
+// the readFloats() method reads a comma separated list of exactly n numbers.
+// nil is returned when the key is missing or the value is invalid
+func (app *application) readFloats(qs url.Values, key string, n int, v *validator.Validator) []float64 {
+	values := app.readCSV(qs, key, nil)
+	if values == nil {
+		return nil
+	}
+	if len(values) != n {
+		v.AddError(key, fmt.Sprintf("must contain %d comma separated numbers", n))
+		return nil
+	}
+	floats := make([]float64, n)
+	for i := range values {
+		f, err := strconv.ParseFloat(strings.TrimSpace(values[i]), 64)
+		if err != nil {
+			v.AddError(key, fmt.Sprintf("must contain %d comma separated numbers", n))
+			return nil
+		}
+		floats[i] = f
+	}
+	return floats
+}
+
+// the readBool() method converts a string value from the query string to a boolean value.
+// if the value cannot be converted then a validation error is added to the validation errors map
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	value := qs.Get(key)
+	if value == "" {
+		return defaultValue
+	}
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+	return boolValue
+}
+
 // create a background method. accepts a function as its parameter
 func (app *application) background(fn func()) {
 
@@ -0,0 +1,216 @@
+//Filename: cmd/api/idempotency.go
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+const (
+	// bodies up to this size are fingerprinted in memory, bigger ones are spooled to a temporary file
+	spoolMemoryBytes = 1 << 20
+	// how long a claimed key stays locked without the request that claimed it extending it
+	idempotencyLease = time.Minute
+	// how long a retry waits for the request running with its key, and how often it checks
+	idempotencyWait     = 30 * time.Second
+	idempotencyWaitPoll = 250 * time.Millisecond
+)
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap() lets http.ResponseController reach the underlying writer
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// spooledBody is a request body that has been read ahead. closing it removes any temporary file
+type spooledBody struct {
+	io.Reader
+	file *os.File
+}
+
+func (b *spooledBody) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// fingerprintRequest() hashes the method, URL and body of a request. the body is read
+// ahead and replaced so the handler can still read it. the bodies of streaming routes may
+// be as big as an upload and take as long to read, other bodies are bound by the server's
+// read timeout and the 1MB the JSON handlers accept
+func (app *application) fingerprintRequest(w http.ResponseWriter, r *http.Request, streaming bool) ([]byte, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	var limit int64 = spoolMemoryBytes
+	if streaming {
+		limit = app.config.storage.maxUploadBytes + spoolMemoryBytes
+		extendRead, _ := app.transferDeadlines(w)
+		r.Body = &streamReader{ReadCloser: r.Body, extend: extendRead}
+	}
+	body := http.MaxBytesReader(w, r.Body, limit)
+	defer body.Close()
+
+	var buf bytes.Buffer
+	n, err := io.Copy(io.MultiWriter(h, &buf), io.LimitReader(body, spoolMemoryBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	spooled := &spooledBody{Reader: &buf}
+	if n > spoolMemoryBytes {
+		file, err := os.CreateTemp("", "idempotent-body-*")
+		if err != nil {
+			return nil, err
+		}
+		spooled.file = file
+		_, err = io.Copy(io.MultiWriter(h, file), io.MultiReader(&buf, body))
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			spooled.Close()
+			return nil, err
+		}
+		spooled.Reader = file
+	}
+	r.Body = spooled
+	return h.Sum(nil), nil
+}
+
+// idempotent() makes POST, PATCH and DELETE requests sent with an Idempotency-Key header
+// safe to retry. the first response to a key is stored for the configured time and replayed
+// to retries with the same method, URL and body. retries sent while the first request is
+// still running wait for it for a while, then get a 409. keys belong to a user, anonymous
+// requests are not tracked. streams holds the streaming routes, see fingerprintRequest()
+func (app *application) idempotent(next http.Handler, streams *httprouter.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		user := app.contextGetUser(r)
+		if key == "" || user.IsAnonymous() ||
+			(r.Method != http.MethodPost && r.Method != http.MethodPatch && r.Method != http.MethodDelete) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		v := validator.New()
+		if data.ValidateIdempotencyKey(v, key); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		handle, _, _ := streams.Lookup(r.Method, r.URL.Path)
+		fingerprint, err := app.fingerprintRequest(w, r, handle != nil)
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				app.errorResponse(w, r, http.StatusRequestEntityTooLarge, "the request body is too large")
+				return
+			}
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		defer r.Body.Close()
+
+		lock, err := app.lockIdempotencyKey(r, user.ID, key, fingerprint)
+		if err != nil {
+			switch {
+			case errors.Is(err, errIdempotencyKeyBusy):
+				app.idempotencyKeyBusyResponse(w, r)
+			case errors.Is(err, r.Context().Err()):
+				//the client went away
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if !lock.Matches(fingerprint) {
+			app.idempotencyKeyReusedResponse(w, r)
+			return
+		}
+		if lock.Response != nil {
+			for name, values := range lock.Response.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(lock.Response.Status)
+			w.Write(lock.Response.Body)
+			return
+		}
+
+		//the key is released if the handler panics, so the request can be retried
+		defer func() {
+			if err := lock.Release(); err != nil {
+				app.logError(r, err)
+			}
+		}()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		//server errors are usually temporary, so those requests may run again
+		if rec.status == 0 || rec.status >= 500 {
+			return
+		}
+		err = lock.Complete(data.StoredResponse{Status: rec.status, Header: w.Header().Clone(), Body: rec.body.Bytes()})
+		if err != nil {
+			app.logError(r, err)
+		}
+	})
+}
+
+// the request running with an Idempotency-Key did not finish while a retry waited for it
+var errIdempotencyKeyBusy = errors.New("idempotency key busy")
+
+// lockIdempotencyKey() claims a key, or reads the response stored for it. while another
+// request is running with the key it waits, up to idempotencyWait, for it to finish
+func (app *application) lockIdempotencyKey(r *http.Request, userID int64, key string, fingerprint []byte) (*data.IdempotencyKey, error) {
+	deadline := time.Now().Add(idempotencyWait)
+	for {
+		lock, err := app.models.Idempotency.Lock(userID, key, fingerprint, app.config.idempotency.ttl, idempotencyLease)
+		if err != nil {
+			return nil, err
+		}
+		//a different request is refused whether or not it is running
+		if !lock.Busy || !lock.Matches(fingerprint) {
+			return lock, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errIdempotencyKeyBusy
+		}
+		select {
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		case <-time.After(idempotencyWaitPoll):
+		}
+	}
+}
@@ -0,0 +1,270 @@
+//Filename: cmd/api/jobs.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"time"
+
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/imaging"
+)
+
+const (
+	// how often an idle worker looks for jobs queued by other servers
+	jobPoll = time.Second
+	// how long a worker has to finish a job before another may take it over
+	jobLease = 5 * time.Minute
+	// a failed job waits jobBackoff before its second attempt and twice as long before
+	// each one after, never more than jobMaxBackoff
+	jobBackoff    = 10 * time.Second
+	jobMaxBackoff = time.Hour
+)
+
+// an activationJob emails a new user the token that activates their account. the token
+// is minted when the email is sent, so its plaintext is never stored
+type activationJob struct {
+	UserID int64 `json:"user_id"`
+}
+
+// an emailJob sends an email rendered from a template of the mailer
+type emailJob struct {
+	Recipient string                 `json:"recipient"`
+	Template  string                 `json:"template"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// a summarizeJob works out the summary (perceptual hash, colors and BlurHash) of a photo
+type summarizeJob struct {
+	PhotoID int64 `json:"photo_id"`
+}
+
+// enqueueActivation() queues the activation email of a new user to be sent by a worker, in
+// the transaction that creates the user. the caller wakes the workers once it is committed
+func (app *application) enqueueActivation(ctx context.Context, tx data.DBTX, userID int64) error {
+	_, err := app.models.Jobs.EnqueueTx(ctx, tx, data.JobSendActivation, activationJob{UserID: userID}, time.Now(), 10)
+	return err
+}
+
+// enqueueEmail() queues an email to be sent by a worker
+func (app *application) enqueueEmail(recipient, templateFile string, values map[string]interface{}) error {
+	job := emailJob{Recipient: recipient, Template: templateFile, Data: values}
+	_, err := app.models.Jobs.Enqueue(data.JobSendEmail, job, time.Now(), 10)
+	if err == nil {
+		app.wakeWorkers()
+	}
+	return err
+}
+
+// enqueueSummarize() queues the summary of a photo to be worked out by a worker, in the
+// transaction that stores the photo. the caller wakes the workers once it is committed
+func (app *application) enqueueSummarize(ctx context.Context, tx data.DBTX, photoID int64) error {
+	_, err := app.models.Jobs.EnqueueTx(ctx, tx, data.JobSummarizePhoto, summarizeJob{PhotoID: photoID}, time.Now(), 3)
+	return err
+}
+
+// wakeWorkers() tells an idle worker of this server that a job was queued, so it does
+// not wait for its next poll
+func (app *application) wakeWorkers() {
+	select {
+	case app.jobsQueued <- struct{}{}:
+	default:
+	}
+}
+
+// startWorkers() runs the job workers until ctx is cancelled. a worker finishes the
+// job it is running first, and the shutdown waits for it
+func (app *application) startWorkers(ctx context.Context) {
+	for i := 0; i < app.config.jobs.workers; i++ {
+		app.background(func() {
+			poll := time.NewTicker(jobPoll)
+			defer poll.Stop()
+			for {
+				//keep going while there is work, the jobs left when we stop are picked up later
+				for ctx.Err() == nil && app.claimJob() {
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-app.jobsQueued:
+				case <-poll.C:
+				}
+			}
+		})
+	}
+}
+
+// claimJob() runs the next job that is due, if there is one, and reports if it found one
+func (app *application) claimJob() bool {
+	jobs, err := app.models.Jobs.Claim(1, jobLease)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"task": "claim job"})
+		return false
+	}
+	if len(jobs) == 0 {
+		return false
+	}
+	job := jobs[0]
+	props := map[string]string{"job_id": strconv.FormatInt(job.ID, 10), "type": job.Type}
+	//the worker that had it stopped part way, possibly because of the job itself
+	if job.Attempts > job.MaxAttempts {
+		err = app.models.Jobs.Bury(job, "the worker running the last attempt stopped")
+		if err != nil {
+			app.logger.PrintError(err, props)
+		}
+		return true
+	}
+	err = app.runJob(job)
+	switch {
+	case err == nil:
+		err = app.models.Jobs.Complete(job)
+	case job.Attempts >= job.MaxAttempts:
+		app.logger.PrintError(err, props)
+		err = app.models.Jobs.Bury(job, err.Error())
+	default:
+		backoff := jobBackoff << (job.Attempts - 1)
+		if backoff > jobMaxBackoff || backoff <= 0 {
+			backoff = jobMaxBackoff
+		}
+		err = app.models.Jobs.Retry(job, err.Error(), time.Now().Add(backoff))
+	}
+	if err != nil {
+		//the job runs again once its lock runs out. with ErrLeaseLost it ran past its lease
+		//and another worker has taken it over, whose outcome is the one recorded
+		app.logger.PrintError(err, props)
+	}
+	return true
+}
+
+// runJob() runs a job by its type. a panic fails the attempt instead of the worker
+func (app *application) runJob(job *data.Job) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%s", p)
+		}
+	}()
+	switch job.Type {
+	case data.JobSendActivation:
+		var input activationJob
+		if err := json.Unmarshal(job.Payload, &input); err != nil {
+			return err
+		}
+		return app.sendActivation(input.UserID)
+	case data.JobSendEmail:
+		var input emailJob
+		//whole numbers are read back as int64, the templates compare them with ints
+		dec := json.NewDecoder(bytes.NewReader(job.Payload))
+		dec.UseNumber()
+		if err := dec.Decode(&input); err != nil {
+			return err
+		}
+		return app.mailer.Send(input.Recipient, input.Template, jsonInts(input.Data))
+	case data.JobSummarizePhoto:
+		var input summarizeJob
+		if err := json.Unmarshal(job.Payload, &input); err != nil {
+			return err
+		}
+		return app.summarizePhoto(input.PhotoID)
+	default:
+		return fmt.Errorf("unknown job type %q", job.Type)
+	}
+}
+
+// sendActivation() mints an activation token for a user and emails it to them. the
+// tokens of earlier attempts are deleted first, so only the one last sent works. users
+// that are gone or already activated are left alone
+func (app *application) sendActivation(userID int64) error {
+	user, err := app.models.Users.Get(userID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	if user.Activated {
+		return nil
+	}
+	err = app.models.Tokens.DeleteALlForUsers(data.ScopeActivation, user.ID)
+	if err != nil {
+		return err
+	}
+	token, err := app.models.Tokens.New(user.ID, 1*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		return err
+	}
+	values := map[string]interface{}{
+		"activationToken": token.Plaintext,
+		"userID":          user.ID,
+	}
+	return app.mailer.Send(user.Email, "user_welcome.tmpl", values)
+}
+
+// jsonInts() turns the json.Numbers of decoded JSON into int64s, or float64s when they
+// are not whole numbers
+func jsonInts(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonInts(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonInts(e)
+		}
+	}
+	return v
+}
+
+// summarizePhoto() decodes the image of a photo (the poster of a video) and stores its
+// summary. photos that are gone or that we cannot decode are left as they are
+func (app *application) summarizePhoto(id int64) error {
+	photo, err := app.models.Photo.Get(id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+	hash := photo.ContentHash
+	if photo.MediaType == data.MediaVideo {
+		hash = photo.PosterHash
+	}
+	if hash == nil {
+		return nil
+	}
+	file, _, err := app.storage.Open(data.BlobKey(*hash))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil || config.Width*config.Height > imaging.MaxPixels {
+		return nil
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil
+	}
+	photo.SetSummary(imaging.Summarize(img, data.PaletteSize))
+	err = app.models.Photo.SaveSummary(photo)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return nil
+	}
+	return err
+}
@@ -4,16 +4,21 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"os"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
+	//time zone names are used by the timeline, so don't rely on the host having them
+	_ "time/tzdata"
 
 	_ "github.com/lib/pq"
 	"photoalbum.joelical.net/internal/data"
 	"photoalbum.joelical.net/internal/jsonlog"
 	"photoalbum.joelical.net/internal/mailer"
+	"photoalbum.joelical.net/internal/storage"
 )
 
 // The application version number
@@ -48,15 +53,56 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	//where uploaded originals are kept
+	storage struct {
+		dir            string
+		maxUploadBytes int64
+		uploadTTL      time.Duration
+	}
+	//the timeouts of routes that upload or download whole files
+	content struct {
+		idleTimeout time.Duration
+		maxDuration time.Duration
+	}
+	//resized copies of originals
+	render struct {
+		secret  string
+		workers int
+		urlTTL  time.Duration
+	}
+	//how long responses to requests with an Idempotency-Key are kept
+	idempotency struct {
+		ttl time.Duration
+	}
+	//how far back a reconnecting event stream can resume
+	events struct {
+		retention time.Duration
+	}
+	//the workers running queued jobs
+	jobs struct {
+		workers int
+	}
+	//where changes written to the outbox are published
+	outbox struct {
+		sinks []string
+	}
 }
 
 // Dependency Injectiion, so its availabe to the handlers.
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config  config
+	logger  *jsonlog.Logger
+	models  data.Models
+	mailer  mailer.Mailer
+	storage storage.Storage
+	renders *renderer
+	events  *eventHub
+	//signals idle job workers that a job was queued
+	jobsQueued chan struct{}
+	//signals the outbox relay that messages were written
+	outboxQueued chan struct{}
+	sinks        []outboxSink
+	wg           sync.WaitGroup
 }
 
 func main() {
@@ -82,6 +128,30 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "8e2dd5f137919b", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "PhotoAlbum <no-reply@photoalbum.icaljoel.net>", "SMTP sender")
 
+	//flags for uploaded files
+	flag.StringVar(&cfg.storage.dir, "storage-dir", "./storage", "Directory uploaded files are stored in")
+	flag.Int64Var(&cfg.storage.maxUploadBytes, "upload-max-bytes", 50<<20, "Maximum size of an uploaded file")
+	flag.DurationVar(&cfg.storage.uploadTTL, "upload-expiry", 24*time.Hour, "How long an unfinished resumable upload is kept after its last chunk")
+
+	flag.DurationVar(&cfg.content.idleTimeout, "content-idle-timeout", 30*time.Second, "How long a file upload or download may stall before it is cut off")
+	flag.DurationVar(&cfg.content.maxDuration, "content-max-duration", 2*time.Hour, "Longest a single file upload or download may take")
+
+	flag.StringVar(&cfg.render.secret, "render-secret", os.Getenv("PA_RENDER_SECRET"), "Key render URLs are signed with")
+	flag.IntVar(&cfg.render.workers, "render-workers", runtime.NumCPU(), "Number of images rendered at the same time")
+	flag.DurationVar(&cfg.render.urlTTL, "render-url-ttl", 24*time.Hour, "How long a signed render URL stays valid")
+
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-ttl", 24*time.Hour, "How long responses to requests with an Idempotency-Key are replayed")
+
+	flag.IntVar(&cfg.jobs.workers, "job-workers", 4, "Number of queued jobs run at the same time")
+
+	flag.DurationVar(&cfg.events.retention, "events-retention", 24*time.Hour, "How long events are kept for streams that reconnect")
+
+	cfg.outbox.sinks = []string{"sse", "webhooks"}
+	flag.Func("outbox-sinks", "Where changes are published: sse, webhooks and log (space separated, default \"sse webhooks\")", func(val string) error {
+		cfg.outbox.sinks = strings.Fields(val)
+		return nil
+	})
+
 	//use the flag.Func() function to parse our trusted origin flag from a string to a slice of string
 	flag.Func("cors-trusted-origins", "Trusted CORS origin (space separated)", func(val string) error {
 		cfg.cors.trustedOrigins = strings.Fields(val)
@@ -101,12 +171,38 @@ func main() {
 	defer db.Close()
 	//log the successful connection pool
 	logger.PrintInfo("database connection pool established", nil)
+	//open the storage for uploaded files
+	store, err := storage.NewFileSystem(cfg.storage.dir)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	//render URLs handed out must keep working across restarts and on every instance
+	if cfg.render.secret == "" {
+		logger.PrintFatal(errors.New("a render secret must be set with -render-secret or PA_RENDER_SECRET"), nil)
+	}
+	if cfg.render.workers < 1 {
+		cfg.render.workers = 1
+	}
+	if cfg.jobs.workers < 1 {
+		cfg.jobs.workers = 1
+	}
+	models := data.NewModels(db)
+	sinks, err := newOutboxSinks(cfg.outbox.sinks, models, logger)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
 	//create a new instance of our application struct
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:       cfg,
+		logger:       logger,
+		models:       models,
+		mailer:       mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		storage:      store,
+		renders:      newRenderer(cfg.render.workers),
+		events:       newEventHub(),
+		jobsQueued:   make(chan struct{}, 1),
+		outboxQueued: make(chan struct{}, 1),
+		sinks:        sinks,
 	}
 
 	//call app.serve() to start the server
@@ -5,6 +5,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -216,3 +217,57 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// streaming() gives routes that move whole files their own timeout policy. the server's
+// read and write timeouts would cut off large uploads and downloads, so instead every read
+// and write pushes the deadline back by the idle timeout. a transfer fails when the client
+// stalls for that long, or when it has taken longer than the maximum in total
+func (app *application) streaming(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		extendRead, extendWrite := app.transferDeadlines(w)
+		r.Body = &streamReader{ReadCloser: r.Body, extend: extendRead}
+		next(&streamWriter{ResponseWriter: w, extend: extendWrite}, r)
+	}
+}
+
+// transferDeadlines() returns functions that push the read and write deadlines of a
+// request back by the idle timeout, never past the maximum transfer time
+func (app *application) transferDeadlines(w http.ResponseWriter) (func(), func()) {
+	limit := time.Now().Add(app.config.content.maxDuration)
+	rc := http.NewResponseController(w)
+	deadline := func() time.Time {
+		d := time.Now().Add(app.config.content.idleTimeout)
+		if d.After(limit) {
+			return limit
+		}
+		return d
+	}
+	return func() { rc.SetReadDeadline(deadline()) }, func() { rc.SetWriteDeadline(deadline()) }
+}
+
+// streamWriter extends the write deadline before every write
+type streamWriter struct {
+	http.ResponseWriter
+	extend func()
+}
+
+func (sw *streamWriter) Write(b []byte) (int, error) {
+	sw.extend()
+	return sw.ResponseWriter.Write(b)
+}
+
+// Unwrap() lets http.ResponseController reach the underlying writer
+func (sw *streamWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// streamReader extends the read deadline before every read of the body
+type streamReader struct {
+	io.ReadCloser
+	extend func()
+}
+
+func (sr *streamReader) Read(b []byte) (int, error) {
+	sr.extend()
+	return sr.ReadCloser.Read(b)
+}
@@ -0,0 +1,227 @@
+//Filename: cmd/api/notifications.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the most notifications listed in one digest email, the rest are only counted
+const digestSize = 20
+
+// notify() records a notification. it is a side effect of the request, so a failure
+// is logged instead of failing the request
+func (app *application) notify(r *http.Request, n *data.Notification) {
+	err := app.models.Notifications.Insert(n)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// listNotificationsHandler for the GET /v1/notifications endpoint
+// lists the caller's notifications newest first. unread=true leaves out the read ones
+func (app *application) listNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.Filters
+	v := validator.New()
+	qs := r.URL.Query()
+	unreadOnly := app.readBool(qs, "unread", false, v)
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	filters.Sort = "-id"
+	filters.SortList = []string{"-id"}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	notifications, metadata, err := app.models.Notifications.GetAll(user.ID, unreadOnly, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	unread, err := app.models.Notifications.CountUnread(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"notifications": notifications, "unread": unread, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateNotificationHandler for the PATCH /v1/notifications/:id endpoint
+// marks a notification as read or unread
+func (app *application) updateNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	var input struct {
+		Read *bool `json:"read"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if v.Check(input.Read != nil, "read", "must be provided"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	err = app.models.Notifications.SetRead(id, user.ID, *input.Read)
+	var n *data.Notification
+	if err == nil {
+		n, err = app.models.Notifications.Get(id, user.ID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"notification": n}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readAllNotificationsHandler for the POST /v1/notifications/read-all endpoint
+// marks every unread notification as read. up_to, the newest id the client has seen,
+// keeps the ones that arrived since unread
+func (app *application) readAllNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UpTo int64 `json:"up_to"`
+	}
+	//the body is optional
+	if r.ContentLength != 0 {
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+	v := validator.New()
+	if v.Check(input.UpTo >= 0, "up_to", "must not be negative"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	marked, err := app.models.Notifications.MarkAllRead(app.contextGetUser(r).ID, input.UpTo)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"marked": marked}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showNotificationPreferencesHandler for the GET /v1/notifications/preferences endpoint
+func (app *application) showNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	prefs, err := app.models.Notifications.GetPreferences(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"preferences": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateNotificationPreferencesHandler for the PUT /v1/notifications/preferences endpoint
+// sets the digest frequency and, per type, if notifications show in the feed and in digests.
+// types left out keep their settings
+func (app *application) updateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	prefs, err := app.models.Notifications.GetPreferences(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	var input struct {
+		Digest *string                        `json:"digest"`
+		Types  map[string]data.TypePreference `json:"types"`
+	}
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Digest != nil {
+		prefs.Digest = *input.Digest
+	}
+	for t, pref := range input.Types {
+		prefs.Types[t] = pref
+	}
+	v := validator.New()
+	if data.ValidateNotificationPreferences(v, prefs); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Notifications.SetPreferences(user.ID, prefs)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"preferences": prefs}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// sendDigests() queues the digests that are due to be emailed. it runs on a schedule, see serve().
+// a digest that can't be queued is logged and left to be tried again on the next run
+func (app *application) sendDigests() error {
+	var after int64
+	for {
+		//notifications that come in while we queue are left for the next digest
+		started := time.Now()
+		digests, err := app.models.Notifications.DueDigests(after, 100, digestSize)
+		if err != nil {
+			return err
+		}
+		for _, d := range digests {
+			after = d.UserID
+			//with nothing counted everything unread is of a type the user does not want emailed
+			if d.Total > 0 {
+				summaries := make([]string, len(d.Notifications))
+				for i, n := range d.Notifications {
+					summaries[i] = n.Summary()
+				}
+				values := map[string]interface{}{
+					"name":          d.Name,
+					"frequency":     d.Frequency,
+					"notifications": summaries,
+					"total":         d.Total,
+					"more":          d.Total - len(d.Notifications),
+				}
+				err = app.enqueueEmail(d.Email, "notification_digest.tmpl", values)
+				if err != nil {
+					app.logger.PrintError(err, map[string]string{"task": "send digests", "user": strconv.FormatInt(d.UserID, 10)})
+					continue
+				}
+			}
+			err = app.models.Notifications.DigestSent(d.UserID, started)
+			if err != nil {
+				return err
+			}
+		}
+		if len(digests) < 100 {
+			return nil
+		}
+	}
+}
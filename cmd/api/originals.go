@@ -0,0 +1,606 @@
+//Filename: cmd/api/originals.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	_ "golang.org/x/image/webp"
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/exif"
+	"photoalbum.joelical.net/internal/mp4"
+	"photoalbum.joelical.net/internal/storage"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the content types accepted as originals
+var (
+	imageContentTypes    = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+	videoContentTypes    = []string{"video/mp4", "video/quicktime"}
+	originalContentTypes = append(append([]string{}, imageContentTypes...), videoContentTypes...)
+)
+
+// what to do when an owner uploads bytes they already have a photo of
+const (
+	duplicateReject = "reject"
+	duplicateReuse  = "reuse"
+	duplicateAllow  = "allow"
+)
+
+// an original is an uploaded file that has been hashed and inspected
+type original struct {
+	blob   data.Blob
+	width  int
+	height int
+	exif   *exif.Data
+	// video is set for MP4 and QuickTime files
+	video *mp4.Info
+}
+
+// a mediaFile is an inspected file and its content
+type mediaFile struct {
+	*original
+	content io.ReadSeeker
+}
+
+// photoFiles are the uploaded files of a photo. content is the original (a still or a video),
+// motion the clip of a live photo and poster the poster frame of a video. upload names the
+// resumable upload they came from, if any, see data.PhotoMedia
+type photoFiles struct {
+	content io.ReadSeeker
+	motion  io.ReadSeeker
+	poster  io.ReadSeeker
+	upload  string
+}
+
+// inspectOriginal() reads an upload once to hash it, then looks at its header for the
+// content type, the dimensions and (for JPEGs) the EXIF data. movies have their container
+// parsed. the summary of an image is worked out later by a job, see enqueueSummarize()
+func (app *application) inspectOriginal(content io.ReadSeeker) (*original, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, content)
+	if err != nil {
+		return nil, err
+	}
+	o := &original{blob: data.Blob{Hash: hex.EncodeToString(h.Sum(nil)), Size: size}}
+
+	//the content type is sniffed from the bytes, not taken from the client
+	head := make([]byte, 512)
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	n, err := io.ReadFull(content, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	o.blob.ContentType = http.DetectContentType(head[:n])
+
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	//movies are only accepted when we can read their header
+	if mp4.Sniff(head[:n]) != "" {
+		o.blob.ContentType = "application/octet-stream"
+		if o.video, err = mp4.Parse(content); err == nil {
+			o.blob.ContentType = o.video.ContentType
+			o.width, o.height = o.video.Width, o.video.Height
+		}
+		_, err = content.Seek(0, io.SeekStart)
+		return o, err
+	}
+	//formats we cannot decode are stored without dimensions
+	if config, _, err := image.DecodeConfig(content); err == nil {
+		o.width, o.height = config.Width, config.Height
+	}
+	if o.blob.ContentType == "image/jpeg" {
+		if _, err = content.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		o.exif, _ = exif.Read(content)
+	}
+	_, err = content.Seek(0, io.SeekStart)
+	return o, err
+}
+
+// apply() fills in the details of a photo from the original. values sent by the client win
+func (o *original) apply(photo *data.Photo) {
+	photo.Width, photo.Height = o.width, o.height
+	photo.MediaType = data.MediaPhoto
+	if o.video != nil {
+		photo.MediaType = data.MediaVideo
+		photo.DurationMS = o.video.Duration.Milliseconds()
+		photo.Codec = o.video.Codec
+	}
+	if o.exif == nil {
+		return
+	}
+	if photo.TakenAt == nil {
+		photo.TakenAt, photo.TakenAtLocal = o.exif.TakenAt, o.exif.TakenAtLocal
+	}
+	if photo.CameraModel == "" {
+		photo.CameraModel = o.exif.Model
+	}
+	if photo.Latitude == nil && photo.Longitude == nil {
+		photo.Latitude, photo.Longitude = o.exif.Latitude, o.exif.Longitude
+	}
+}
+
+// saveBlobFile() stores the bytes of a blob unless they are already stored
+func (app *application) saveBlobFile(blob *data.Blob, content io.ReadSeeker) error {
+	_, err := app.storage.Stat(blob.Key())
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = app.storage.Put(blob.Key(), content)
+	return err
+}
+
+// storeOriginal() creates a photo for an inspected upload and queues its summary with it.
+// unless onDuplicate allows it, the owner's existing photo of the same bytes is returned
+// instead and duplicate is true. the bytes themselves are only ever stored once, whoever
+// uploads them
+func (app *application) storeOriginal(photo *data.Photo, original, motion, poster *mediaFile, onDuplicate string, upload string) (*data.Photo, bool, error) {
+	unique := onDuplicate != duplicateAllow && photo.UserID != nil
+	if unique {
+		existing, duplicate, err := app.existingOriginal(photo, original)
+		if err != nil || duplicate {
+			return existing, duplicate, err
+		}
+	}
+	media := data.PhotoMedia{Original: &original.blob, Unique: unique, UploadID: upload}
+	files := []*mediaFile{original}
+	if motion != nil {
+		media.Motion = &motion.blob
+		files = append(files, motion)
+	}
+	if poster != nil {
+		media.Poster = &poster.blob
+		files = append(files, poster)
+	}
+	for _, f := range files {
+		err := app.saveBlobFile(&f.blob, f.content)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	err := app.models.Transaction(func(ctx context.Context, tx data.DBTX) error {
+		err := app.models.Photo.InsertTx(ctx, tx, photo, media)
+		if err != nil {
+			return err
+		}
+		return app.enqueueSummarize(ctx, tx, photo.ID)
+	})
+	if err != nil {
+		//the same bytes were uploaded at the same time and the other upload won
+		if errors.Is(err, data.ErrDuplicateContent) {
+			existing, duplicate, err := app.existingOriginal(photo, original)
+			if err == nil && !duplicate {
+				//and was deleted again since
+				err = data.ErrDuplicateContent
+			}
+			return existing, duplicate, err
+		}
+		return nil, false, err
+	}
+	app.wakeWorkers()
+	//a blob may have been collected between saving the file and taking our reference
+	for _, f := range files {
+		err = app.saveBlobFile(&f.blob, f.content)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return photo, false, nil
+}
+
+// existingOriginal() returns the owner's existing photo of the same bytes as an upload, if
+// there is one, and reports if there was
+func (app *application) existingOriginal(photo *data.Photo, original *mediaFile) (*data.Photo, bool, error) {
+	existing, err := app.models.Photo.GetByContent(*photo.UserID, original.blob.Hash)
+	switch {
+	case err == nil:
+		return existing, true, nil
+	case errors.Is(err, data.ErrRecordNotFound):
+		return nil, false, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// releaseOriginal() removes the stored files of a deleted photo when nothing else uses them
+func (app *application) releaseOriginal(r *http.Request, photo *data.Photo) {
+	for _, hash := range []*string{photo.ContentHash, photo.MotionHash, photo.PosterHash} {
+		if hash != nil {
+			app.collectBlob(r, *hash)
+		}
+	}
+}
+
+// collectBlob() removes a released blob, its file and its renders when nothing else uses it
+func (app *application) collectBlob(r *http.Request, hash string) {
+	err := app.removeBlob(hash)
+	if err != nil {
+		//the photo is gone either way, collectUnusedBlobs() tries again later
+		app.logError(r, err)
+	}
+}
+
+// removeBlob() deletes a blob, its file and its renders if nothing uses it
+func (app *application) removeBlob(hash string) error {
+	return app.models.Blobs.Collect(hash, func(key string) error {
+		keys, err := app.models.Renders.Keys(hash)
+		if err != nil {
+			return err
+		}
+		for _, key := range append(keys, key) {
+			if err := app.storage.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// collectUnusedBlobs() removes the blobs that failed to be collected when they were released.
+// it runs on a schedule, see serve()
+func (app *application) collectUnusedBlobs() error {
+	hashes, err := app.models.Blobs.Unused(100)
+	if err != nil {
+		return err
+	}
+	//one that can't be removed shouldn't hold up the others
+	errs := []error{}
+	for _, hash := range hashes {
+		errs = append(errs, app.removeBlob(hash))
+	}
+	return errors.Join(errs...)
+}
+
+// photoFromValues() creates a photo from the form fields sent with an original.
+// the filename is the default title and photo reference
+func (app *application) photoFromValues(values url.Values, filename string, owner *data.User) *data.Photo {
+	photo := &data.Photo{
+		Title:       app.readString(values, "title", filename),
+		Photo:       app.readString(values, "photo", filename),
+		Description: app.readString(values, "description", ""),
+		Tags:        app.readCSV(values, "tags", []string{}),
+		Language:    app.readString(values, "language", "simple"),
+		UserID:      &owner.ID,
+		Album:       app.readString(values, "album", ""),
+		Visibility:  app.readString(values, "visibility", data.VisibilityPublic),
+		MediaType:   data.MediaPhoto,
+	}
+	for i := range photo.Tags {
+		photo.Tags[i] = strings.TrimSpace(photo.Tags[i])
+	}
+	return photo
+}
+
+// createPhotoFromOriginal() inspects the uploaded files, fills in the photo from them and
+// stores everything once the photo is valid. problems with the photo are added to v and nothing is stored
+func (app *application) createPhotoFromOriginal(v *validator.Validator, photo *data.Photo, files photoFiles, onDuplicate string) (*data.Photo, bool, error) {
+	o, err := app.inspectOriginal(files.content)
+	if err != nil {
+		return nil, false, err
+	}
+	v.Check(validator.In(o.blob.ContentType, originalContentTypes...), "file", "must be a JPEG, PNG, GIF or WebP image or an MP4 or QuickTime video")
+	o.apply(photo)
+	original := &mediaFile{original: o, content: files.content}
+
+	//a live photo is a still sent with its motion clip
+	var motion *mediaFile
+	if files.motion != nil {
+		m, err := app.inspectOriginal(files.motion)
+		if err != nil {
+			return nil, false, err
+		}
+		v.Check(o.video == nil, "motion", "can only be sent with a still image")
+		v.Check(m.video != nil, "motion", "must be an MP4 or QuickTime video")
+		if m.video != nil {
+			photo.MediaType = data.MediaLive
+			photo.DurationMS = m.video.Duration.Milliseconds()
+			photo.Codec = m.video.Codec
+		}
+		motion = &mediaFile{original: m, content: files.motion}
+	}
+
+	//a video shows the poster sent with it, or the cover art stored in the file
+	var poster *mediaFile
+	switch {
+	case files.poster != nil:
+		p, err := app.inspectOriginal(files.poster)
+		if err != nil {
+			return nil, false, err
+		}
+		v.Check(o.video != nil, "poster", "can only be sent with a video")
+		v.Check(validator.In(p.blob.ContentType, imageContentTypes...), "poster", "must be a JPEG, PNG, GIF or WebP image")
+		poster = &mediaFile{original: p, content: files.poster}
+	case o.video != nil && len(o.video.Cover) > 0:
+		cover := bytes.NewReader(o.video.Cover)
+		p, err := app.inspectOriginal(cover)
+		if err == nil && validator.In(p.blob.ContentType, imageContentTypes...) {
+			poster = &mediaFile{original: p, content: cover}
+		}
+	}
+
+	if data.ValidatePhoto(v, photo); !v.Valid() {
+		return photo, false, nil
+	}
+	return app.storeOriginal(photo, original, motion, poster, onDuplicate, files.upload)
+}
+
+// readFormFile() returns an optional file part of a multipart form. the caller must close it
+func (app *application) readFormFile(r *http.Request, key string) (multipart.File, error) {
+	file, _, err := r.FormFile(key)
+	if errors.Is(err, http.ErrMissingFile) {
+		return nil, nil
+	}
+	return file, err
+}
+
+// uploadPhotoHandler handles POST /v1/photo with a multipart/form-data body.
+// the "file" part is the original and the other fields are the photo details.
+// a still sent with a "motion" clip becomes a live photo, a video may be sent with a "poster" image.
+// on_duplicate=reject|reuse|allow says what to do when the owner already has these bytes
+func (app *application) uploadPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, app.config.storage.maxUploadBytes)
+	//parts bigger than this are spooled to temporary files rather than kept in memory
+	err := r.ParseMultipartForm(8 << 20)
+	if err != nil {
+		app.badRequestResponse(w, r, fmt.Errorf("body must be a multipart form no larger than %d bytes", app.config.storage.maxUploadBytes))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	v := validator.New()
+	onDuplicate := app.readString(r.URL.Query(), "on_duplicate", duplicateReject)
+	v.Check(validator.In(onDuplicate, duplicateReject, duplicateReuse, duplicateAllow), "on_duplicate", "must be reject, reuse or allow")
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		v.AddError("file", "must be provided")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	defer file.Close()
+
+	files := photoFiles{content: file}
+	//the clip of a live photo and the poster of a video are optional
+	motion, err := app.readFormFile(r, "motion")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if motion != nil {
+		defer motion.Close()
+		files.motion = motion
+	}
+	poster, err := app.readFormFile(r, "poster")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if poster != nil {
+		defer poster.Close()
+		files.poster = poster
+	}
+
+	photo := app.photoFromValues(r.MultipartForm.Value, header.Filename, app.contextGetUser(r))
+	photo, duplicate, err := app.createPhotoFromOriginal(v, photo, files, onDuplicate)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/photo/%d", photo.ID))
+	headers.Set("ETag", app.photoETag(photo))
+	switch {
+	case duplicate && onDuplicate == duplicateReject:
+		err = app.writeJSON(w, http.StatusConflict, envelope{"error": "you have already uploaded this file", "photo": photo}, headers)
+	case duplicate:
+		err = app.writeJSON(w, http.StatusOK, envelope{"photo": photo}, headers)
+	default:
+		err = app.writeJSON(w, http.StatusCreated, envelope{"photo": photo}, headers)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showPhotoContentHandler for the GET /v1/photo/:id/content endpoint
+// streams the uploaded original. variant=motion streams the clip of a live photo and
+// variant=poster the poster frame of a video. Range requests are supported so downloads
+// can be resumed and videos seeked
+func (app *application) showPhotoContentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	v := validator.New()
+	variant := app.readString(r.URL.Query(), "variant", "original")
+	if v.Check(validator.In(variant, "original", "motion", "poster"), "variant", "must be original, motion or poster"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	photo, err := app.models.Photo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	hash := map[string]*string{"original": photo.ContentHash, "motion": photo.MotionHash, "poster": photo.PosterHash}[variant]
+	//private photos are only visible to their owner, and not every photo has every file
+	user := app.contextGetUser(r)
+	if !photo.VisibleTo(user) || hash == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	//other people only get watermarked renders of the stills of a watermarked photo
+	still := variant == "poster" || (variant == "original" && photo.MediaType != data.MediaVideo)
+	if still && !photo.OwnedBy(user) {
+		wm, err := app.watermarkFor(photo)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if wm != nil {
+			app.watermarkedOnlyResponse(w, r)
+			return
+		}
+	}
+	blob, err := app.models.Blobs.Get(*hash)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	content, _, err := app.storage.Open(blob.Key())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	defer content.Close()
+
+	//the bytes never change for a hash, so the hash is a strong ETag and the blob was last
+	//modified when it was first stored. ServeContent() answers conditional and Range
+	//(including If-Range) requests with them, sets Content-Length and copies in small pieces
+	w.Header().Set("Content-Type", blob.ContentType)
+	w.Header().Set("ETag", `"`+blob.Hash+`"`)
+	http.ServeContent(w, r, "", blob.CreatedAt, content)
+}
+
+// setPosterHandler for the PUT /v1/photo/:id/poster endpoint
+// replaces the poster frame of a video with the "poster" image of a multipart form.
+// clients choose a frame by grabbing it from the video and sending it here
+func (app *application) setPosterHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	photo, err := app.models.Photo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	//private photos are only visible to their owner
+	if !photo.VisibleTo(app.contextGetUser(r)) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	//only the owner may change a photo, or any writer when it has no owner
+	if !photo.EditableBy(app.contextGetUser(r)) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	//the client's copy must still be the current version
+	if app.preconditionFailed(r, app.photoETag(photo)) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, app.config.storage.maxUploadBytes)
+	err = r.ParseMultipartForm(8 << 20)
+	if err != nil {
+		app.badRequestResponse(w, r, fmt.Errorf("body must be a multipart form no larger than %d bytes", app.config.storage.maxUploadBytes))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	v := validator.New()
+	v.Check(photo.MediaType == data.MediaVideo, "poster", "only videos have a poster")
+	file, err := app.readFormFile(r, "poster")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if file == nil {
+		v.AddError("poster", "must be provided")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	defer file.Close()
+	o, err := app.inspectOriginal(file)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	v.Check(validator.In(o.blob.ContentType, imageContentTypes...), "poster", "must be a JPEG, PNG, GIF or WebP image")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.saveBlobFile(&o.blob, file)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	//the video is now compared and colored by its new poster
+	var previous *string
+	err = app.models.Transaction(func(ctx context.Context, tx data.DBTX) error {
+		previous, err = app.models.Photo.SetPosterTx(ctx, tx, photo, &o.blob)
+		if err != nil {
+			return err
+		}
+		return app.enqueueSummarize(ctx, tx, photo.ID)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.wakeWorkers()
+	//the blob may have been collected between saving the file and taking our reference
+	err = app.saveBlobFile(&o.blob, file)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if previous != nil && *previous != o.blob.Hash {
+		app.collectBlob(r, *previous)
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", app.photoETag(photo))
+	err = app.writeJSON(w, http.StatusOK, envelope{"photo": photo}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,174 @@
+//Filename: cmd/api/outbox.go
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/jsonlog"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+const (
+	// the messages relayed at a time
+	outboxBatch = 100
+	// how long published messages are kept
+	outboxRetention = 24 * time.Hour
+	// how often the relay looks for messages it was not told about, see startRelay()
+	outboxPoll = 10 * time.Second
+)
+
+// an outboxSink publishes the messages relayed from the outbox. it is given the relay's
+// transaction, what it writes in tx is committed with the messages being marked published.
+// a sink that fails has the messages relayed again, to every sink, so sinks that do not
+// write in tx should expect to see a message more than once
+type outboxSink interface {
+	publish(ctx context.Context, tx data.DBTX, msgs []*data.OutboxMessage) error
+}
+
+// newOutboxSinks() returns the sinks with the given names, see the -outbox-sinks flag
+func newOutboxSinks(names []string, models data.Models, logger *jsonlog.Logger) ([]outboxSink, error) {
+	sinks := []outboxSink{}
+	for _, name := range names {
+		switch name {
+		case "sse":
+			sinks = append(sinks, sseSink{events: models.Events})
+		case "webhooks":
+			sinks = append(sinks, webhookSink{events: models.Events, webhooks: models.Webhooks})
+		case "log":
+			sinks = append(sinks, logSink{logger: logger})
+		default:
+			return nil, fmt.Errorf("unknown outbox sink %q", name)
+		}
+	}
+	return sinks, nil
+}
+
+// streamed() reports if a message is about a photo, comment or notification, the changes
+// that are streamed to clients and sent to webhooks
+func streamed(msg *data.OutboxMessage) bool {
+	return msg.PhotoID != nil && validator.In(msg.Topic, data.EventTypes...)
+}
+
+// logEvent() writes a streamed message to the event log in tx and returns the event. the
+// sinks that need it share the one event, so webhooks are sent the ids seen over SSE
+func logEvent(ctx context.Context, tx data.DBTX, events data.EventModel, msg *data.OutboxMessage) (*data.Event, error) {
+	if msg.Event != nil {
+		return msg.Event, nil
+	}
+	e := &data.Event{Type: msg.Topic, UserID: msg.UserID, PhotoID: *msg.PhotoID, Data: msg.Payload}
+	if err := events.Insert(ctx, tx, e); err != nil {
+		return nil, err
+	}
+	msg.Event = e
+	return e, nil
+}
+
+// sseSink writes messages to the event log, which every server streams to its clients
+type sseSink struct {
+	events data.EventModel
+}
+
+func (s sseSink) publish(ctx context.Context, tx data.DBTX, msgs []*data.OutboxMessage) error {
+	for _, msg := range msgs {
+		if !streamed(msg) {
+			continue
+		}
+		if _, err := logEvent(ctx, tx, s.events, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhookSink queues deliveries of messages to the webhooks of their owners. a delivery
+// is of the message's event, which is written to the log if the sse sink has not
+type webhookSink struct {
+	events   data.EventModel
+	webhooks data.WebhookModel
+}
+
+func (s webhookSink) publish(ctx context.Context, tx data.DBTX, msgs []*data.OutboxMessage) error {
+	for _, msg := range msgs {
+		if !streamed(msg) || msg.OwnerID == nil {
+			continue
+		}
+		e, err := logEvent(ctx, tx, s.events, msg)
+		if err != nil {
+			return err
+		}
+		if err := s.webhooks.Queue(ctx, tx, e, *msg.OwnerID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logSink writes every message to the log
+type logSink struct {
+	logger *jsonlog.Logger
+}
+
+func (s logSink) publish(ctx context.Context, tx data.DBTX, msgs []*data.OutboxMessage) error {
+	for _, msg := range msgs {
+		s.logger.PrintInfo("outbox message", map[string]string{
+			"id":           strconv.FormatInt(msg.ID, 10),
+			"topic":        msg.Topic,
+			"aggregate_id": strconv.FormatInt(msg.AggregateID, 10),
+			"payload":      string(msg.Payload),
+		})
+	}
+	return nil
+}
+
+// wakeRelay() tells the outbox relay that messages were written, so it does not wait for
+// its next poll
+func (app *application) wakeRelay() {
+	select {
+	case app.outboxQueued <- struct{}{}:
+	default:
+	}
+}
+
+// startRelay() relays the outbox until ctx is cancelled. every message written to the
+// outbox wakes it through the LISTEN connection, see listenEvents(). it polls as well so
+// messages are relayed while that connection is down
+func (app *application) startRelay(ctx context.Context) {
+	app.background(func() {
+		poll := time.NewTicker(outboxPoll)
+		defer poll.Stop()
+		for {
+			err := app.relayOutbox()
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"task": "relay outbox"})
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-app.outboxQueued:
+			case <-poll.C:
+			}
+		}
+	})
+}
+
+// relayOutbox() publishes the unpublished messages of the outbox to the sinks
+func (app *application) relayOutbox() error {
+	for {
+		n, err := app.models.Outbox.Relay(outboxBatch, func(ctx context.Context, tx data.DBTX, msgs []*data.OutboxMessage) error {
+			for _, sink := range app.sinks {
+				if err := sink.publish(ctx, tx, msgs); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || n < outboxBatch {
+			return err
+		}
+	}
+}
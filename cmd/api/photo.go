@@ -6,6 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"photoalbum.joelical.net/internal/data"
 	"photoalbum.joelical.net/internal/validator"
@@ -13,11 +16,24 @@ import (
 
 // createPhotoHandler for the POST /v1/photo endpoint
 func (app *application) createPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	//uploads send the original and the photo details as a multipart form
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		app.uploadPhotoHandler(w, r)
+		return
+	}
 	//Our target decode destination
 	var input struct {
-		Title       string `json:"title"`
-		Photo       string `json:"photo"`
-		Description string `json:"description"`
+		Title       string     `json:"title"`
+		Photo       string     `json:"photo"`
+		Description string     `json:"description"`
+		Tags        []string   `json:"tags"`
+		Language    string     `json:"language"`
+		TakenAt     *time.Time `json:"taken_at"`
+		CameraModel string     `json:"camera_model"`
+		Album       string     `json:"album"`
+		Visibility  string     `json:"visibility"`
+		Latitude    *float64   `json:"latitude"`
+		Longitude   *float64   `json:"longitude"`
 	}
 	//Initalize a new json.decoder instance
 	err := app.readJSON(w, r, &input)
@@ -30,6 +46,26 @@ func (app *application) createPhotoHandler(w http.ResponseWriter, r *http.Reques
 		Title:       input.Title,
 		Photo:       input.Photo,
 		Description: input.Description,
+		Tags:        input.Tags,
+		Language:    input.Language,
+		UserID:      &app.contextGetUser(r).ID,
+		TakenAt:     input.TakenAt,
+		CameraModel: input.CameraModel,
+		Album:       input.Album,
+		Visibility:  input.Visibility,
+		Latitude:    input.Latitude,
+		Longitude:   input.Longitude,
+		MediaType:   data.MediaPhoto,
+	}
+	//photos without tags or a language are indexed with the simple configuration
+	if photo.Tags == nil {
+		photo.Tags = []string{}
+	}
+	if photo.Language == "" {
+		photo.Language = "simple"
+	}
+	if photo.Visibility == "" {
+		photo.Visibility = data.VisibilityPublic
 	}
 	//Initialize a new validator instance
 	v := validator.New()
@@ -41,14 +77,16 @@ func (app *application) createPhotoHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// create a photo record
-	err = app.models.Photo.Insert(photo)
+	err = app.models.Photo.Insert(photo, data.PhotoMedia{})
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+		return
 	}
 
 	// create a location header for the newly created resource
 	headers := make(http.Header)
 	headers.Set("Location", fmt.Sprintf("/v1/photo/%d", photo.ID))
+	headers.Set("ETag", app.photoETag(photo))
 	// write the response with 201 -created status code with the body being the photo data and the header being the headers map
 	err = app.writeJSON(w, http.StatusCreated, envelope{"photo": photo}, headers)
 	if err != nil {
@@ -76,8 +114,25 @@ func (app *application) showPhotoHandler(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
+	//private photos are only visible to their owner
+	if !photo.VisibleTo(app.contextGetUser(r)) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.forUser(w, r, photo)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	//the client already has this version
+	etag := app.photoETag(photo)
+	if app.notModified(w, r, etag) {
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
 	//write the data returned by get
-	err = app.writeJSON(w, http.StatusOK, envelope{"photo": photo}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"photo": photo}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -105,33 +160,31 @@ func (app *application) updatePhotoHandler(w http.ResponseWriter, r *http.Reques
 		}
 		return
 	}
+	//private photos are only visible to their owner
+	if !photo.VisibleTo(app.contextGetUser(r)) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	//only the owner may change a photo, or any writer when it has no owner
+	if !photo.EditableBy(app.contextGetUser(r)) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	//the client's copy must still be the current version
+	if app.preconditionFailed(r, app.photoETag(photo)) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
 	//create an input struct to hold data read in from the user
 	// our target decode destination
-	//update input struct to use pointers because pointers have a default value of nil
-	//if the filed remains nil, then we know user did not update it
-	var input struct {
-		Title       *string `json:"title"`
-		Photo       *string `json:"photo"`
-		Description *string `json:"description"`
-	}
+	var input photoPatch
 	//initialize a new json.decode instance
 	err = app.readJSON(w, r, &input)
 	if err != nil {
 		app.badRequestResponse(w, r, err)
 		return
 	}
-
-	//check input struct for those updates
-	//check input struct for those updates
-	if input.Title != nil {
-		photo.Title = *input.Title
-	}
-	if input.Photo != nil {
-		photo.Photo = *input.Photo
-	}
-	if input.Description != nil {
-		photo.Description = *input.Description
-	}
+	input.apply(photo)
 	//perform validation on the updated photo record. if validation fails, then we send a 422 - unprocessable entity response to the user
 	//Initialize a new validator instance
 	v := validator.New()
@@ -142,7 +195,7 @@ func (app *application) updatePhotoHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	//pass the updated list record to the update() method
-	err = app.models.Photo.Update(photo)
+	err = app.models.Photo.Update(photo, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -152,8 +205,10 @@ func (app *application) updatePhotoHandler(w http.ResponseWriter, r *http.Reques
 		}
 		return
 	}
+	headers := make(http.Header)
+	headers.Set("ETag", app.photoETag(photo))
 	//write the data returned by get()
-	err = app.writeJSON(w, http.StatusOK, envelope{"photo": photo}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"photo": photo}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -167,18 +222,52 @@ func (app *application) deletePhotoHandler(w http.ResponseWriter, r *http.Reques
 		app.notFoundResponse(w, r)
 		return
 	}
+	//fetch the photo so we can check who may delete it
+	photo, err := app.models.Photo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	//private photos are only visible to their owner
+	if !photo.VisibleTo(app.contextGetUser(r)) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	//only the owner may change a photo, or any writer when it has no owner
+	if !photo.EditableBy(app.contextGetUser(r)) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	//with an If-Match header we only delete the version the client has seen
+	var version int32
+	if r.Header.Get("If-Match") != "" {
+		if app.preconditionFailed(r, app.photoETag(photo)) {
+			app.preconditionFailedResponse(w, r)
+			return
+		}
+		version = photo.Version
+	}
 	//delete the list from the database. sends a 404 not found status code to the user if there is no matching record.
-	err = app.models.Photo.Delete(id)
+	err = app.models.Photo.Delete(id, version)
 	//handle errors
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
+	//the original is removed when this was the last photo using it
+	app.releaseOriginal(r, photo)
 	//return a 200 status ok to the user with a success message
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "photo record successfully deleted"}, nil)
 	if err != nil {
@@ -190,42 +279,230 @@ func (app *application) deletePhotoHandler(w http.ResponseWriter, r *http.Reques
 func (app *application) listPhotoHandler(w http.ResponseWriter, r *http.Request) {
 	//create an input struct to hold our query parameters
 	var input struct {
-		Title       string
-		Photo       string
-		Description string
+		data.PhotoSearch
 		data.Filters
+		Facets []string
 	}
 	//Initialize a validator
 	v := validator.New()
 	//Get the URL values map
 	qs := r.URL.Query()
 	// use the helper methods to extract the values
-	input.Title = app.readString(qs, "title", "")
-	input.Photo = app.readString(qs, "photo", "")
-	input.Description = app.readString(qs, "description", "")
+	input.PhotoSearch = app.readPhotoSearch(r, qs, v)
+	//facets are counted alongside the page when asked for
+	input.Facets = app.readCSV(qs, "facets", []string{})
+	for _, facet := range input.Facets {
+		v.Check(validator.In(facet, data.FacetList...), "facets", "contains an unknown facet")
+	}
 	//get the page information
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	//a cursor from next_cursor/prev_cursor replaces the page number
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	input.Filters.SkipTotal = !app.readBool(qs, "total", true, v)
 	//get the sort information
 	input.Filters.Sort = app.readString(qs, "sort", "id")
 	//specify the allowed sort values
-	input.Filters.SortList = []string{"id", "title", "description", "-id", "-title", "-description"}
+	input.Filters.SortList = []string{"id", "title", "description", "favorites", "-id", "-title", "-description", "-favorites"}
+	//relevance only makes sense when searching
+	if input.Q != "" {
+		input.Filters.SortList = append(input.Filters.SortList, "relevance")
+	}
 	//chek for validation error
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 	//get a listing of all photos
-	photos, metadata, err := app.models.Photo.GetAll(input.Title, input.Photo, input.Description, input.Filters)
+	photos, metadata, err := app.models.Photo.GetAll(input.PhotoSearch, input.Filters)
+	if err == nil {
+		err = app.forUser(w, r, photos...)
+	}
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	env := envelope{"photos": photos, "metadata": metadata}
+	if len(input.Facets) > 0 {
+		facets, err := app.models.Photo.Facets(input.PhotoSearch, input.Facets, 10)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env["facets"] = facets
+	}
+	//the client already has this page, and these counts
+	etag := app.listETag(photos, metadata, env["facets"])
+	if app.notModified(w, r, etag) {
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
 	//Send a JSON response containing all the schools
-	err = app.writeJSON(w, http.StatusOK, envelope{"photos": photos, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+}
+
+// facetsPhotoHandler for the GET /v1/photo/facets endpoint
+// takes the same search parameters as listPhotoHandler and returns bucketed counts
+func (app *application) facetsPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.PhotoSearch
+		Facets []string
+		Size   int
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.PhotoSearch = app.readPhotoSearch(r, qs, v)
+	input.Facets = app.readCSV(qs, "facets", data.FacetList)
+	input.Size = app.readInt(qs, "facet_size", 10, v)
+	for _, facet := range input.Facets {
+		v.Check(validator.In(facet, data.FacetList...), "facets", "contains an unknown facet")
+	}
+	v.Check(validator.Unique(input.Facets), "facets", "must not contain duplicate values")
+	v.Check(input.Size > 0, "facet_size", "must be greater than zero")
+	v.Check(input.Size <= 100, "facet_size", "must be a maxinum of 100")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	facets, err := app.models.Photo.Facets(input.PhotoSearch, input.Facets, input.Size)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"facets": facets}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readPhotoSearch() reads the search parameters shared by the photo listings
+// and checks them with data.ValidatePhotoSearch()
+func (app *application) readPhotoSearch(r *http.Request, qs url.Values, v *validator.Validator) data.PhotoSearch {
+	search := data.PhotoSearch{
+		Title:       app.readString(qs, "title", ""),
+		Photo:       app.readString(qs, "photo", ""),
+		Description: app.readString(qs, "description", ""),
+		//q searches title, description and tags together
+		Q:           app.readString(qs, "q", ""),
+		Language:    app.readString(qs, "lang", "simple"),
+		Tags:        app.readCSV(qs, "tags", nil),
+		Album:       app.readString(qs, "album", ""),
+		CameraModel: app.readString(qs, "camera", ""),
+		Visibility:  app.readString(qs, "visibility", ""),
+		MediaType:   app.readString(qs, "media_type", ""),
+		Taken:       app.readString(qs, "taken", ""),
+		Viewer:      app.contextGetUser(r).ID,
+	}
+	//bbox=minLon,minLat,maxLon,maxLat
+	if bbox := app.readFloats(qs, "bbox", 4, v); bbox != nil {
+		search.BBox = &data.BoundingBox{MinLon: bbox[0], MinLat: bbox[1], MaxLon: bbox[2], MaxLat: bbox[3]}
+	}
+	//near=lat,lon&radius_km=
+	if near := app.readFloats(qs, "near", 2, v); near != nil {
+		search.Near = &data.Circle{Latitude: near[0], Longitude: near[1], RadiusKM: app.readFloat(qs, "radius_km", 10, v)}
+	}
+	//color=#RRGGBB&color_tolerance=, the # must be sent as %23
+	if color := app.readString(qs, "color", ""); color != "" {
+		search.Color = &data.ColorMatch{Color: color, Tolerance: app.readFloat(qs, "color_tolerance", 15, v)}
+	}
+	data.ValidatePhotoSearch(v, search)
+	return search
+}
+
+// mapPhotoHandler for the GET /v1/photo/map endpoint
+// returns markers for the located photos, clustered for the zoom level
+func (app *application) mapPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.PhotoSearch
+		Zoom  int
+		Limit int
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.PhotoSearch = app.readPhotoSearch(r, qs, v)
+	input.Zoom = app.readInt(qs, "zoom", 2, v)
+	input.Limit = app.readInt(qs, "limit", 500, v)
+	v.Check(input.Zoom >= 0 && input.Zoom <= 22, "zoom", "must be between 0 and 22")
+	v.Check(input.Limit > 0, "limit", "must be greater than zero")
+	v.Check(input.Limit <= 5000, "limit", "must be a maxinum of 5000")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	clusters, err := app.models.Photo.MapClusters(input.PhotoSearch, input.Zoom, input.Limit)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"markers": clusters, "precision": data.ClusterPrecision(input.Zoom)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// photoPatch holds the fields of a partial photo update
+// the fields are pointers because pointers have a default value of nil
+// if the field remains nil, then we know user did not update it
+type photoPatch struct {
+	Title       *string    `json:"title"`
+	Photo       *string    `json:"photo"`
+	Description *string    `json:"description"`
+	Tags        *[]string  `json:"tags"`
+	Language    *string    `json:"language"`
+	TakenAt     *time.Time `json:"taken_at"`
+	CameraModel *string    `json:"camera_model"`
+	Album       *string    `json:"album"`
+	Visibility  *string    `json:"visibility"`
+	Latitude    *float64   `json:"latitude"`
+	Longitude   *float64   `json:"longitude"`
+	// CommentsDisabled stops new comments, see CommentModel
+	CommentsDisabled *bool `json:"comments_disabled"`
+}
 
+// apply() copies the fields that were sent onto the photo
+func (input *photoPatch) apply(photo *data.Photo) {
+	if input.Title != nil {
+		photo.Title = *input.Title
+	}
+	if input.Photo != nil {
+		photo.Photo = *input.Photo
+	}
+	if input.Description != nil {
+		photo.Description = *input.Description
+	}
+	if input.Tags != nil {
+		photo.Tags = *input.Tags
+		if photo.Tags == nil {
+			photo.Tags = []string{}
+		}
+	}
+	if input.Language != nil {
+		photo.Language = *input.Language
+	}
+	if input.TakenAt != nil {
+		photo.TakenAt, photo.TakenAtLocal = input.TakenAt, false
+	}
+	if input.CameraModel != nil {
+		photo.CameraModel = *input.CameraModel
+	}
+	if input.Album != nil {
+		photo.Album = *input.Album
+	}
+	if input.Visibility != nil {
+		photo.Visibility = *input.Visibility
+	}
+	//a location is always set as a pair, validation catches a missing half
+	if input.Latitude != nil || input.Longitude != nil {
+		photo.Latitude = input.Latitude
+		photo.Longitude = input.Longitude
+	}
+	if input.CommentsDisabled != nil {
+		photo.CommentsDisabled = *input.CommentsDisabled
+	}
 }
@@ -0,0 +1,143 @@
+//Filename: cmd/api/reactions.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// forUser() fills in which of the photos the caller has favorited and reacted to. the
+// response then differs from user to user, so shared caches are told to keep out of it
+func (app *application) forUser(w http.ResponseWriter, r *http.Request, photos ...*data.Photo) error {
+	varyBy(w.Header(), "Authorization")
+	user := app.contextGetUser(r)
+	if user.IsAnonymous() {
+		return nil
+	}
+	w.Header().Set("Cache-Control", "private")
+	return app.models.Reactions.ForUser(photos, user.ID)
+}
+
+// togglePhotoReaction() runs a favorite or reaction change on the :id photo, if the
+// caller can see it, and responds with the photo's new counts. when the change adds
+// something, the owner is sent notification n
+func (app *application) togglePhotoReaction(w http.ResponseWriter, r *http.Request, toggle func(photoID, userID int64) (bool, error), n *data.Notification) {
+	photo, ok := app.readVisiblePhoto(w, r)
+	if !ok {
+		return
+	}
+	user := app.contextGetUser(r)
+	changed, err := toggle(photo.ID, user.ID)
+	if err == nil && changed && n != nil && photo.UserID != nil {
+		n.UserID, n.ActorID, n.PhotoID = *photo.UserID, user.ID, photo.ID
+		app.notify(r, n)
+	}
+	if err == nil {
+		photo, err = app.models.Photo.Get(photo.ID)
+	}
+	if err == nil {
+		err = app.forUser(w, r, photo)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", app.photoETag(photo))
+	env := envelope{"favorites": photo.Favorites, "favorited": photo.Favorited, "reactions": photo.Reactions}
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// favoritePhotoHandler for the POST /v1/photo/:id/favorite endpoint
+// adds the photo to the caller's favorites. favoriting it again changes nothing
+func (app *application) favoritePhotoHandler(w http.ResponseWriter, r *http.Request) {
+	app.togglePhotoReaction(w, r, app.models.Reactions.Favorite, &data.Notification{Type: data.NotificationFavorite})
+}
+
+// unfavoritePhotoHandler for the DELETE /v1/photo/:id/favorite endpoint
+func (app *application) unfavoritePhotoHandler(w http.ResponseWriter, r *http.Request) {
+	app.togglePhotoReaction(w, r, app.models.Reactions.Unfavorite, nil)
+}
+
+// readEmojiParam() gets the ":emoji" parameter from the URL and checks it
+func (app *application) readEmojiParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	emoji := httprouter.ParamsFromContext(r.Context()).ByName("emoji")
+	v := validator.New()
+	if data.ValidateEmoji(v, emoji); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return "", false
+	}
+	return emoji, true
+}
+
+// reactPhotoHandler for the PUT /v1/photo/:id/reactions/:emoji endpoint
+// adds the caller's reaction to the photo. the emoji is percent-encoded in the URL
+func (app *application) reactPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	emoji, ok := app.readEmojiParam(w, r)
+	if !ok {
+		return
+	}
+	app.togglePhotoReaction(w, r, func(photoID, userID int64) (bool, error) {
+		return app.models.Reactions.React(photoID, userID, emoji)
+	}, &data.Notification{Type: data.NotificationReaction, Emoji: &emoji})
+}
+
+// unreactPhotoHandler for the DELETE /v1/photo/:id/reactions/:emoji endpoint
+func (app *application) unreactPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	emoji, ok := app.readEmojiParam(w, r)
+	if !ok {
+		return
+	}
+	app.togglePhotoReaction(w, r, func(photoID, userID int64) (bool, error) {
+		return app.models.Reactions.Unreact(photoID, userID, emoji)
+	}, nil)
+}
+
+// listFavoritesHandler for the GET /v1/users/me/favorites endpoint
+// lists the caller's favorite photos, the most recently favorited first
+func (app *application) listFavoritesHandler(w http.ResponseWriter, r *http.Request) {
+	var filters data.Filters
+	v := validator.New()
+	qs := r.URL.Query()
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	//favorites only come in the order they were added
+	filters.Sort = "-favorited_at"
+	filters.SortList = []string{"-favorited_at"}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	user := app.contextGetUser(r)
+	photos, metadata, err := app.models.Reactions.GetFavorites(user.ID, filters)
+	if err == nil {
+		err = app.forUser(w, r, photos...)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	etag := app.listETag(photos, metadata)
+	if app.notModified(w, r, etag) {
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", etag)
+	err = app.writeJSON(w, http.StatusOK, envelope{"photos": photos, "metadata": metadata}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,338 @@
+//Filename: cmd/api/render.go
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/imaging"
+	"photoalbum.joelical.net/internal/storage"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the original is in a format we cannot decode, or too big to decode safely
+var errNotRenderable = errors.New("the original cannot be rendered")
+
+// renderer bounds the CPU spent on renders to a fixed number of workers and
+// collapses concurrent requests for the same render into one
+type renderer struct {
+	slots chan struct{}
+	mu    sync.Mutex
+	calls map[string]*renderCall
+}
+
+// a renderCall is a render in progress. done is closed once render and err are set
+type renderCall struct {
+	done   chan struct{}
+	render *data.Render
+	err    error
+}
+
+func newRenderer(workers int) *renderer {
+	return &renderer{slots: make(chan struct{}, workers), calls: make(map[string]*renderCall)}
+}
+
+// do() runs fn on a free worker, unless a render of the same key is already running,
+// in which case it waits for that render's result instead
+func (rr *renderer) do(ctx context.Context, key string, fn func() (*data.Render, error)) (*data.Render, error) {
+	rr.mu.Lock()
+	if call, ok := rr.calls[key]; ok {
+		rr.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.render, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	//waiters get this error if fn panics
+	call := &renderCall{done: make(chan struct{}), err: errors.New("render abandoned")}
+	rr.calls[key] = call
+	rr.mu.Unlock()
+	defer func() {
+		rr.mu.Lock()
+		delete(rr.calls, key)
+		rr.mu.Unlock()
+		close(call.done)
+	}()
+
+	//the render is shared with the waiters, so it goes ahead even if this request is cancelled
+	rr.slots <- struct{}{}
+	defer func() { <-rr.slots }()
+	call.render, call.err = fn()
+	return call.render, call.err
+}
+
+// readRenderOptions() reads the options of a render from the query string
+func (app *application) readRenderOptions(qs url.Values, v *validator.Validator) data.RenderOptions {
+	return data.RenderOptions{
+		Width:   app.readInt(qs, "w", 0, v),
+		Height:  app.readInt(qs, "h", 0, v),
+		Fit:     app.readString(qs, "fit", "cover"),
+		Format:  app.readString(qs, "fmt", "jpeg"),
+		Quality: app.readInt(qs, "q", 80, v),
+	}
+}
+
+// renderSignature() signs the options of a render of a photo until expires (unix seconds).
+// watermarked says if the owner's watermark is drawn on it
+func (app *application) renderSignature(id int64, o data.RenderOptions, watermarked bool, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(app.config.render.secret))
+	fmt.Fprintf(mac, "%d:%d:%d:%s:%s:%d:%t:%d", id, o.Width, o.Height, o.Fit, o.Format, o.Quality, watermarked, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// renderBlob() renders the blob with the given hash, stores the result and records it
+func (app *application) renderBlob(hash string, o data.RenderOptions) (*data.Render, error) {
+	blob, err := app.models.Blobs.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	file, _, err := app.storage.Open(blob.Key())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil || config.Width*config.Height > imaging.MaxPixels {
+		return nil, errNotRenderable
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, errNotRenderable
+	}
+	out := imaging.Fit(img, o.Width, o.Height, o.Fit)
+	if o.Watermark != nil {
+		mark, err := app.watermarkImage(o.Watermark)
+		if err != nil {
+			return nil, err
+		}
+		if mark != nil {
+			imaging.Watermark(out, mark, o.Watermark.Position, o.Watermark.Opacity, o.Watermark.Scale)
+		}
+	}
+
+	var buf bytes.Buffer
+	switch o.Format {
+	case "png":
+		err = png.Encode(&buf, out)
+	case "webp":
+		err = imaging.EncodeWebP(&buf, out)
+	default:
+		err = jpeg.Encode(&buf, out, &jpeg.Options{Quality: o.Quality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	render := &data.Render{Key: o.Key(hash), BlobHash: hash, ContentType: o.ContentType()}
+	if o.Watermark != nil {
+		render.WatermarkID = &o.Watermark.ID
+	}
+	render.Size, err = app.storage.Put(render.Key, &buf)
+	if err != nil {
+		return nil, err
+	}
+	err = app.models.Renders.Insert(render)
+	if err != nil {
+		//most likely the blob was collected or the watermark changed while we were rendering
+		app.storage.Delete(render.Key)
+		return nil, err
+	}
+	return render, nil
+}
+
+// signRenderHandler for the GET /v1/photo/:id/render-url endpoint
+// returns a signed URL for a render of a photo the caller can see. the URL can be
+// used without authenticating, in an <img> tag for example, until it expires.
+// renders of other people's photos carry the owner's watermark, owners get clean ones
+func (app *application) signRenderHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	v := validator.New()
+	options := app.readRenderOptions(r.URL.Query(), v)
+	if data.ValidateRenderOptions(v, options); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	photo, err := app.models.Photo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	//private photos are only visible to their owner
+	user := app.contextGetUser(r)
+	if !photo.VisibleTo(user) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	watermarked := !photo.OwnedBy(user)
+
+	expires := time.Now().Add(app.config.render.urlTTL).Truncate(time.Second)
+	qs := url.Values{}
+	qs.Set("w", strconv.Itoa(options.Width))
+	qs.Set("h", strconv.Itoa(options.Height))
+	qs.Set("fit", options.Fit)
+	qs.Set("fmt", options.Format)
+	qs.Set("q", strconv.Itoa(options.Quality))
+	qs.Set("wm", strconv.FormatBool(watermarked))
+	qs.Set("exp", strconv.FormatInt(expires.Unix(), 10))
+	qs.Set("sig", app.renderSignature(photo.ID, options, watermarked, expires.Unix()))
+	render := envelope{
+		"url":        fmt.Sprintf("/v1/photo/%d/render?%s", photo.ID, qs.Encode()),
+		"expires_at": expires,
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"render": render}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// renderPhotoHandler for the GET /v1/photo/:id/render endpoint
+// serves the original (or the poster of a video) scaled to w x h. fit=cover fills the box,
+// fit=contain fits inside it. the parameters must carry a signature from signRenderHandler,
+// which also decides if the owner's watermark is drawn.
+// renders are cached in the storage, concurrent requests for the same render wait for one
+// another and rendering runs on a fixed number of workers
+func (app *application) renderPhotoHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	options := app.readRenderOptions(qs, v)
+	watermarked := app.readBool(qs, "wm", false, v)
+	expires := app.readInt(qs, "exp", 0, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	signature := app.renderSignature(id, options, watermarked, int64(expires))
+	if !hmac.Equal([]byte(signature), []byte(qs.Get("sig"))) || time.Now().Unix() > int64(expires) {
+		app.invalidRenderSignatureResponse(w, r)
+		return
+	}
+	//signed options are always valid, unless the rules have changed since
+	if data.ValidateRenderOptions(v, options); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	photo, err := app.models.Photo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	//the signature stands in for the viewer, who could see the photo when it was signed.
+	//URLs signed for anyone but the owner stop working once the photo is made private
+	if watermarked && !photo.VisibleTo(data.AnonymousUser) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	hash := photo.ContentHash
+	if photo.MediaType == data.MediaVideo {
+		hash = photo.PosterHash
+	}
+	if hash == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	//the watermark is looked up on every request so changes apply to URLs already handed out
+	if watermarked {
+		options.Watermark, err = app.watermarkFor(photo)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	key := options.Key(*hash)
+	var content io.ReadSeekCloser
+	render, err := app.models.Renders.Get(key)
+	if err == nil {
+		content, _, err = app.storage.Open(key)
+		//the file is gone, render it again
+		if errors.Is(err, storage.ErrNotFound) {
+			err = data.ErrRecordNotFound
+		}
+	}
+	if errors.Is(err, data.ErrRecordNotFound) {
+		render, err = app.renders.do(r.Context(), key, func() (*data.Render, error) {
+			return app.renderBlob(*hash, options)
+		})
+		if err == nil {
+			content, _, err = app.storage.Open(key)
+		}
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, errNotRenderable):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		case errors.Is(err, context.Canceled):
+			//the client went away while waiting
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer content.Close()
+
+	//a key always holds the same bytes, so it makes a strong ETag
+	w.Header().Set("Content-Type", render.ContentType)
+	w.Header().Set("ETag", `"`+key+`"`)
+	http.ServeContent(w, r, "", render.CreatedAt, content)
+}
+
+// watermarkImage() returns the mark a watermark draws: its logo, or else its text.
+// a watermark with neither draws nothing
+func (app *application) watermarkImage(wm *data.Watermark) (image.Image, error) {
+	if wm.LogoHash == nil {
+		if wm.Text == "" {
+			return nil, nil
+		}
+		return imaging.Text(wm.Text, color.RGBA{255, 255, 255, 255}), nil
+	}
+	file, _, err := app.storage.Open(data.BlobKey(*wm.LogoHash))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	//logos are checked when they are uploaded
+	logo, _, err := image.Decode(file)
+	return logo, err
+}
@@ -0,0 +1,159 @@
+//Filename: cmd/api/revisions.go
+
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"photoalbum.joelical.net/internal/data"
+)
+
+// listRevisionsHandler for the GET /v1/photo/:id/revisions endpoint
+func (app *application) listRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	//make sure the photo exists so we don't return an empty history for a missing photo
+	photo, err := app.models.Photo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	//private photos are only visible to their owner
+	if !photo.VisibleTo(app.contextGetUser(r)) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	revisions, err := app.models.Revisions.GetAll(photo.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"current_version": photo.Version, "revisions": revisions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showRevisionHandler for the GET /v1/photo/:id/revisions/:version endpoint
+// the response includes the fields that differ from the current photo
+func (app *application) showRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	version, err := app.readVersionParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	photo, err := app.models.Photo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	//private photos are only visible to their owner
+	if !photo.VisibleTo(app.contextGetUser(r)) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	revision, err := app.models.Revisions.Get(photo.ID, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"revision": revision, "changes": revision.Diff(photo)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// restoreRevisionHandler for the POST /v1/photo/:id/revisions/:version/restore endpoint
+// restoring copies the old values onto the photo, which creates a new version
+func (app *application) restoreRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	version, err := app.readVersionParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	photo, err := app.models.Photo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	//private photos are only visible to their owner
+	if !photo.VisibleTo(app.contextGetUser(r)) {
+		app.notFoundResponse(w, r)
+		return
+	}
+	//only the owner may change a photo, or any writer when it has no owner
+	if !photo.EditableBy(app.contextGetUser(r)) {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	revision, err := app.models.Revisions.Get(photo.ID, version)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	//the client's copy must still be the current version
+	if app.preconditionFailed(r, app.photoETag(photo)) {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+	//copy the old values over the current ones
+	photo.Title = revision.Title
+	photo.Photo = revision.Photo
+	photo.Description = revision.Description
+
+	err = app.models.Photo.Update(photo, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("ETag", app.photoETag(photo))
+	err = app.writeJSON(w, http.StatusOK, envelope{"photo": photo}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -15,18 +15,106 @@ func (app *application) routes() http.Handler {
 	//implement error handling in router
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedesponse)
+	//routes moving whole files are not bound by the server's read and write timeouts.
+	//they are also kept in streams so idempotent() can tell them apart
+	streams := httprouter.New()
+	stream := func(method, path string, handler http.HandlerFunc) {
+		router.HandlerFunc(method, path, app.streaming(handler))
+		streams.HandlerFunc(method, path, handler)
+	}
 	router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
 
 	router.HandlerFunc(http.MethodGet, "/v1/photo", app.requirePermission("photo:read", app.listPhotoHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/photo", app.requirePermission("photo:write", app.createPhotoHandler))
+	stream(http.MethodPost, "/v1/photo", app.requirePermission("photo:write", app.createPhotoHandler))
 
-	router.HandlerFunc(http.MethodGet, "/v1/photo/:id", app.requirePermission("photo:read", app.showPhotoHandler))
+	//httprouter does not allow /v1/photo/facets next to /v1/photo/:id so named
+	//paths are picked out by photoRoute()
+	router.HandlerFunc(http.MethodGet, "/v1/photo/:id", app.photoRoute(app.requirePermission("photo:read", app.showPhotoHandler), map[string]http.HandlerFunc{
+		"facets": app.requirePermission("photo:read", app.facetsPhotoHandler),
+		"map":    app.requirePermission("photo:read", app.mapPhotoHandler),
+	}))
 	router.HandlerFunc(http.MethodPatch, "/v1/photo/:id", app.requirePermission("photo:write", app.updatePhotoHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/photo/:id", app.requirePermission("photo:write", app.deletePhotoHandler))
+	//no photo takes a POST, so only the named paths answer one
+	router.HandlerFunc(http.MethodPost, "/v1/photo/:id", app.photoRoute(app.notFoundResponse, map[string]http.HandlerFunc{
+		"batch": app.requirePermission("photo:write", app.batchPhotoHandler),
+	}))
+
+	router.HandlerFunc(http.MethodGet, "/v1/timeline", app.requirePermission("photo:read", app.timelineHandler))
+
+	stream(http.MethodGet, "/v1/photo/:id/content", app.requirePermission("photo:read", app.showPhotoContentHandler))
+	stream(http.MethodPut, "/v1/photo/:id/poster", app.requirePermission("photo:write", app.setPosterHandler))
+
+	//render URLs carry their own signature instead of needing a token
+	router.HandlerFunc(http.MethodGet, "/v1/photo/:id/render", app.renderPhotoHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/photo/:id/render-url", app.requirePermission("photo:read", app.signRenderHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/photo/:id/similar", app.requirePermission("photo:read", app.similarPhotosHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/duplicates", app.requirePermission("photo:read", app.listDuplicatesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/duplicates/resolve", app.requirePermission("photo:write", app.resolveDuplicatesHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/photo/:id/revisions", app.requirePermission("photo:read", app.listRevisionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/photo/:id/revisions/:version", app.requirePermission("photo:read", app.showRevisionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/photo/:id/revisions/:version/restore", app.requirePermission("photo:write", app.restoreRevisionHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/photo/:id/favorite", app.requirePermission("photo:read", app.favoritePhotoHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/photo/:id/favorite", app.requirePermission("photo:read", app.unfavoritePhotoHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/photo/:id/reactions/:emoji", app.requirePermission("photo:read", app.reactPhotoHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/photo/:id/reactions/:emoji", app.requirePermission("photo:read", app.unreactPhotoHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/favorites", app.requirePermission("photo:read", app.listFavoritesHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/photo/:id/comments", app.requirePermission("photo:read", app.listCommentsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/photo/:id/comments", app.requirePermission("comment:write", app.createCommentHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/photo/:id/comments/:comment_id", app.requirePermission("photo:read", app.showCommentHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/photo/:id/comments/:comment_id", app.requirePermission("comment:write", app.updateCommentHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/photo/:id/comments/:comment_id", app.requirePermission("comment:write", app.deleteCommentHandler))
+
+	//resumable uploads speak the tus protocol
+	router.HandlerFunc(http.MethodOptions, "/v1/uploads", app.optionsUploadHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/uploads", app.requirePermission("photo:write", app.createUploadHandler))
+	router.HandlerFunc(http.MethodHead, "/v1/uploads/:id", app.requirePermission("photo:write", app.headUploadHandler))
+	stream(http.MethodPatch, "/v1/uploads/:id", app.requirePermission("photo:write", app.patchUploadHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/uploads/:id", app.requirePermission("photo:write", app.deleteUploadHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/watermarks", app.requirePermission("photo:read", app.listWatermarksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/watermarks", app.requirePermission("photo:write", app.createWatermarkHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/watermarks/:id", app.requirePermission("photo:read", app.showWatermarkHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/watermarks/:id", app.requirePermission("photo:write", app.updateWatermarkHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/watermarks/:id", app.requirePermission("photo:write", app.deleteWatermarkHandler))
+	stream(http.MethodPut, "/v1/watermarks/:id/logo", app.requirePermission("photo:write", app.setWatermarkLogoHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/notifications", app.requireActivatedUser(app.listNotificationsHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/notifications/:id", app.requireActivatedUser(app.updateNotificationHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/notifications/read-all", app.requireActivatedUser(app.readAllNotificationsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/notifications/preferences", app.requireActivatedUser(app.showNotificationPreferencesHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/notifications/preferences", app.requireActivatedUser(app.updateNotificationPreferencesHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/events", app.requirePermission("photo:read", app.eventsHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks", app.requireActivatedUser(app.listWebhooksHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks", app.requireActivatedUser(app.createWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id", app.requireActivatedUser(app.showWebhookHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/webhooks/:id", app.requireActivatedUser(app.updateWebhookHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/webhooks/:id", app.requireActivatedUser(app.deleteWebhookHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/webhooks/:id/deliveries", app.requireActivatedUser(app.listWebhookDeliveriesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/webhooks/:id/deliveries/:delivery_id/redeliver", app.requireActivatedUser(app.redeliverWebhookHandler))
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
 
-	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
+	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(app.idempotent(router, streams)))))
+}
+
+// photoRoute() sends /v1/photo/<name> to the handler registered for the name
+// and every other /v1/photo/:id to the default handler
+func (app *application) photoRoute(next http.HandlerFunc, named map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		if handler, ok := named[params.ByName("id")]; ok {
+			handler(w, r)
+			return
+		}
+		next(w, r)
+	}
 }
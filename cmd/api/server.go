@@ -27,6 +27,35 @@ func (app *application) serve() error {
 
 	//The Shutdown function should return its error to this channel. channel used to communicate with serve()
 	shutdownError := make(chan error)
+	//Shutdown() waits for open requests, so end the event streams when it starts
+	srv.RegisterOnShutdown(app.events.close)
+
+	//background maintenance runs until the server shuts down
+	ctx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	app.schedule(ctx, time.Hour, "delete expired idempotency keys", func() error {
+		_, err := app.models.Idempotency.DeleteExpired()
+		return err
+	})
+	app.schedule(ctx, 10*time.Minute, "delete expired uploads", app.deleteExpiredUploads)
+	app.schedule(ctx, time.Hour, "collect unused blobs", app.collectUnusedBlobs)
+	app.schedule(ctx, time.Hour, "send digests", app.sendDigests)
+	app.schedule(ctx, time.Hour, "delete old events", func() error {
+		_, err := app.models.Events.DeleteOlderThan(time.Now().Add(-app.config.events.retention))
+		return err
+	})
+	app.startRelay(ctx)
+	app.schedule(ctx, time.Hour, "delete published outbox messages", func() error {
+		_, err := app.models.Outbox.DeletePublishedBefore(time.Now().Add(-outboxRetention))
+		return err
+	})
+	app.listenEvents(ctx)
+	app.startWorkers(ctx)
+	app.schedule(ctx, 5*time.Second, "deliver webhooks", app.deliverWebhooks)
+	app.schedule(ctx, time.Hour, "delete old webhook deliveries", func() error {
+		_, err := app.models.Webhooks.DeleteOlderThan(time.Now().Add(-webhookLogRetention))
+		return err
+	})
 
 	//start a background Goroutine
 	go func() {
@@ -55,6 +84,7 @@ func (app *application) serve() error {
 		app.logger.PrintInfo("completing background tasks", map[string]string{
 			"addr": srv.Addr,
 		})
+		stopBackground()
 		app.wg.Wait()
 		//once nil it execute next line
 		shutdownError <- nil
@@ -86,3 +116,23 @@ func (app *application) serve() error {
 
 	return nil
 }
+
+// schedule() runs fn every interval in the background until ctx is cancelled.
+// the shutdown waits for a run in progress to finish
+func (app *application) schedule(ctx context.Context, interval time.Duration, name string, fn func() error) {
+	app.background(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := fn()
+				if err != nil {
+					app.logger.PrintError(err, map[string]string{"task": name})
+				}
+			}
+		}
+	})
+}
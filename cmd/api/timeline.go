@@ -0,0 +1,58 @@
+//Filename: cmd/api/timeline.go
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// timelineHandler for the GET /v1/timeline endpoint
+// groups the photos by day, month or year of capture in the caller's time zone
+func (app *application) timelineHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.PhotoSearch
+		data.Timeline
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	//the timeline can be narrowed with the same search parameters as the photo listing
+	input.PhotoSearch = app.readPhotoSearch(r, qs, v)
+	input.Granularity = app.readString(qs, "granularity", "month")
+	input.At = app.readString(qs, "at", "")
+	input.Buckets = app.readInt(qs, "buckets", 12, v)
+	input.Previews = app.readInt(qs, "previews", 4, v)
+	//tz is an IANA time zone name such as America/Belize. Go also knows "Local", the
+	//server's own zone, which is not a name postgres can look up
+	tz := app.readString(qs, "tz", "UTC")
+	location, err := time.LoadLocation(tz)
+	if err != nil || tz == "Local" || location.String() != tz {
+		v.AddError("tz", "must be a valid IANA time zone")
+		location = time.UTC
+	}
+	input.Location = location
+	if data.ValidateTimeline(v, input.Timeline); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	buckets, next, err := app.models.Photo.Timeline(input.PhotoSearch, input.Timeline)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	metadata := map[string]string{
+		"granularity": input.Granularity,
+		"time_zone":   input.Location.String(),
+	}
+	//pass next_bucket as at= to continue down the timeline
+	if next != "" {
+		metadata["next_bucket"] = next
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"timeline": buckets, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,417 @@
+//Filename: cmd/api/uploads.go
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the version of the tus resumable upload protocol we speak, see https://tus.io/protocols/resumable-upload
+const tusVersion = "1.0.0"
+
+// tusResumable() sets the protocol header every tus response carries and checks the
+// client speaks our version. a client that does not is sent a 412 response
+func (app *application) tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		app.errorResponse(w, r, http.StatusPreconditionFailed, "the Tus-Resumable header must be "+tusVersion)
+		return false
+	}
+	return true
+}
+
+// readUploadHeader() reads a non-negative integer header such as Upload-Length
+func (app *application) readUploadHeader(r *http.Request, name string) (int64, error) {
+	value, err := strconv.ParseInt(r.Header.Get(name), 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("the %s header must be a non-negative integer", name)
+	}
+	return value, nil
+}
+
+// parseUploadMetadata() decodes an Upload-Metadata header: comma separated
+// pairs of a key and a base64 encoded value. the value may be left out
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, errors.New("the Upload-Metadata header must be comma separated keys with base64 values")
+		}
+		if _, exists := metadata[fields[0]]; exists {
+			return nil, fmt.Errorf("the Upload-Metadata key %q appears more than once", fields[0])
+		}
+		metadata[fields[0]] = ""
+		if len(fields) == 2 {
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("the Upload-Metadata value of %q must be base64 encoded", fields[0])
+			}
+			metadata[fields[0]] = string(value)
+		}
+	}
+	return metadata, nil
+}
+
+// uploadValues() turns upload metadata into the form fields of a photo
+func uploadValues(metadata map[string]string) url.Values {
+	values := url.Values{}
+	for key, value := range metadata {
+		values.Set(key, value)
+	}
+	return values
+}
+
+// readUpload() fetches the upload named in the URL. other users' uploads are not found
+func (app *application) readUpload(w http.ResponseWriter, r *http.Request) (*data.Upload, bool) {
+	params := httprouter.ParamsFromContext(r.Context())
+	upload, err := app.models.Uploads.Get(params.ByName("id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	if upload.UserID != app.contextGetUser(r).ID {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	return upload, true
+}
+
+// uploadExpired() sends a 410 response for an upload that expired and is waiting to be
+// removed, and reports if it did
+func (app *application) uploadExpired(w http.ResponseWriter, r *http.Request, upload *data.Upload) bool {
+	if time.Now().Before(upload.ExpiresAt) {
+		return false
+	}
+	app.errorResponse(w, r, http.StatusGone, "the upload has expired")
+	return true
+}
+
+// setUploadHeaders() describes the state of an upload
+func (app *application) setUploadHeaders(w http.ResponseWriter, upload *data.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.PhotoID != nil {
+		w.Header().Set("Photo-Location", fmt.Sprintf("/v1/photo/%d", *upload.PhotoID))
+	}
+}
+
+// removeUpload() deletes the stored bytes of an upload and then the upload itself
+func (app *application) removeUpload(upload *data.Upload) error {
+	for _, key := range append(upload.ChunkKeys, upload.DataKey()) {
+		err := app.storage.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	err := app.models.Uploads.Delete(upload.ID)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return nil
+	}
+	return err
+}
+
+// deleteExpiredUploads() removes abandoned uploads
+func (app *application) deleteExpiredUploads() error {
+	for {
+		uploads, err := app.models.Uploads.GetExpired(100)
+		if err != nil {
+			return err
+		}
+		for _, upload := range uploads {
+			err = app.removeUpload(upload)
+			if err != nil {
+				return err
+			}
+		}
+		if len(uploads) < 100 {
+			return nil
+		}
+	}
+}
+
+// optionsUploadHandler for the OPTIONS /v1/uploads endpoint
+// tells tus clients what the server supports
+func (app *application) optionsUploadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration,termination")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(app.config.storage.maxUploadBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createUploadHandler for the POST /v1/uploads endpoint
+// starts a resumable upload of Upload-Length bytes. Upload-Metadata holds the photo
+// fields of the multipart upload (filename, title, description, tags, ...) and on_duplicate
+func (app *application) createUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.tusResumable(w, r) {
+		return
+	}
+	length, err := app.readUploadHeader(r, "Upload-Length")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if length > app.config.storage.maxUploadBytes {
+		app.errorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("uploads must not be larger than %d bytes", app.config.storage.maxUploadBytes))
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	//the photo fields are checked now rather than after the whole file has been sent
+	user := app.contextGetUser(r)
+	values := uploadValues(metadata)
+	v := validator.New()
+	onDuplicate := app.readString(values, "on_duplicate", duplicateReject)
+	v.Check(validator.In(onDuplicate, duplicateReject, duplicateReuse, duplicateAllow), "on_duplicate", "must be reject, reuse or allow")
+	if data.ValidatePhoto(v, app.photoFromValues(values, metadata["filename"], user)); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	id, err := data.NewUploadID()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	upload := &data.Upload{ID: id, UserID: user.ID, Length: length, Metadata: metadata}
+	err = app.models.Uploads.Insert(upload, app.config.storage.uploadTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.setUploadHeaders(w, upload)
+	w.Header().Set("Location", "/v1/uploads/"+upload.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// headUploadHandler for the HEAD /v1/uploads/:id endpoint
+// reports how many bytes have been received so the client knows where to resume
+func (app *application) headUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.tusResumable(w, r) {
+		return
+	}
+	upload, ok := app.readUpload(w, r)
+	if !ok || app.uploadExpired(w, r, upload) {
+		return
+	}
+	app.setUploadHeaders(w, upload)
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// patchUploadHandler for the PATCH /v1/uploads/:id endpoint
+// appends the body at Upload-Offset. whatever arrives before a connection drops is kept.
+// the request that completes the upload turns it into a photo, named by Photo-Location
+func (app *application) patchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.tusResumable(w, r) {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		app.errorResponse(w, r, http.StatusUnsupportedMediaType, "the Content-Type must be application/offset+octet-stream")
+		return
+	}
+	offset, err := app.readUploadHeader(r, "Upload-Offset")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	upload, ok := app.readUpload(w, r)
+	if !ok || app.uploadExpired(w, r, upload) {
+		return
+	}
+	if offset != upload.Offset || upload.PhotoID != nil {
+		app.errorResponse(w, r, http.StatusConflict, "the Upload-Offset does not match the upload, send a HEAD request to find where to resume")
+		return
+	}
+
+	var readErr error
+	if !upload.Complete() {
+		body := &partialReader{r: io.LimitReader(r.Body, upload.Length-upload.Offset)}
+		//requests sent at the same offset each write their own file and the upload records the
+		//key of the one whose Append wins, so the others can't overwrite or remove its chunk
+		key, err := upload.NewChunkKey()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		n, err := app.storage.Put(key, body)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		readErr = body.err
+		if n == 0 {
+			app.storage.Delete(key)
+		} else {
+			err = app.models.Uploads.Append(upload, key, n, app.config.storage.uploadTTL)
+			if err != nil {
+				app.storage.Delete(key)
+				switch {
+				case errors.Is(err, data.ErrEditConflict):
+					app.errorResponse(w, r, http.StatusConflict, "the upload was changed by another request, send a HEAD request to find where to resume")
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+		}
+	}
+	//the client has gone away, it resumes from what we kept
+	if readErr != nil {
+		app.logger.PrintInfo("upload interrupted", map[string]string{"upload": upload.ID, "offset": strconv.FormatInt(upload.Offset, 10)})
+		return
+	}
+	//an upload that finished earlier but never became a photo is finished by the next PATCH
+	if upload.Complete() {
+		if !app.finishUpload(w, r, upload) {
+			return
+		}
+	}
+	app.setUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload() joins the chunks of a complete upload and creates its photo. when the
+// photo can't be created the response is written, the upload is removed and false is returned
+func (app *application) finishUpload(w http.ResponseWriter, r *http.Request, upload *data.Upload) bool {
+	chunks := make([]io.Reader, 0, len(upload.ChunkKeys))
+	for _, key := range upload.ChunkKeys {
+		chunk, _, err := app.storage.Open(key)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+		defer chunk.Close()
+		chunks = append(chunks, chunk)
+	}
+	_, err := app.storage.Put(upload.DataKey(), io.MultiReader(chunks...))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	content, _, err := app.storage.Open(upload.DataKey())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	defer content.Close()
+
+	values := uploadValues(upload.Metadata)
+	photo := app.photoFromValues(values, upload.Metadata["filename"], app.contextGetUser(r))
+	onDuplicate := app.readString(values, "on_duplicate", duplicateReject)
+	v := validator.New()
+	//a new photo finishes the upload in its own transaction, so an upload only ever becomes one photo
+	photo, duplicate, err := app.createPhotoFromOriginal(v, photo, photoFiles{content: content, upload: upload.ID}, onDuplicate)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.uploadFinishedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	switch {
+	case !v.Valid():
+		//the bytes are of no use, the client has to start again
+		if err = app.removeUpload(upload); err != nil {
+			app.logError(r, err)
+		}
+		app.failedValidationResponse(w, r, v.Errors)
+		return false
+	case duplicate && onDuplicate == duplicateReject:
+		if err = app.removeUpload(upload); err != nil {
+			app.logError(r, err)
+		}
+		w.Header().Set("Photo-Location", fmt.Sprintf("/v1/photo/%d", photo.ID))
+		err = app.writeJSON(w, http.StatusConflict, envelope{"error": "you have already uploaded this file", "photo": photo}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+
+	if duplicate {
+		err = app.models.Uploads.Finish(upload, photo.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrEditConflict):
+				app.uploadFinishedResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return false
+		}
+	} else {
+		upload.PhotoID = &photo.ID
+	}
+	//the photo has its own copy of the bytes now
+	for _, key := range append(upload.ChunkKeys, upload.DataKey()) {
+		if err = app.storage.Delete(key); err != nil {
+			app.logError(r, err)
+		}
+	}
+	return true
+}
+
+// deleteUploadHandler for the DELETE /v1/uploads/:id endpoint
+// abandons an upload and removes the bytes received so far
+func (app *application) deleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.tusResumable(w, r) {
+		return
+	}
+	upload, ok := app.readUpload(w, r)
+	if !ok {
+		return
+	}
+	err := app.removeUpload(upload)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// partialReader ends a body early instead of failing, so the bytes that arrived
+// before a dropped connection can be kept. err is the error that ended it
+type partialReader struct {
+	r   io.Reader
+	err error
+}
+
+func (p *partialReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+		err = io.EOF
+	}
+	return n, err
+}
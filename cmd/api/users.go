@@ -3,9 +3,9 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
-	"time"
 
 	"photoalbum.joelical.net/internal/data"
 	"photoalbum.joelical.net/internal/validator"
@@ -47,8 +47,19 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	//Insert the data into the database
-	err = app.models.Users.Insert(user)
+	//Insert the user with their permissions and queue the welcome email, all or nothing.
+	//a worker mints the activation token and sends it, retrying while SMTP is down
+	err = app.models.Transaction(func(ctx context.Context, tx data.DBTX) error {
+		err := app.models.Users.InsertTx(ctx, tx, user)
+		if err != nil {
+			return err
+		}
+		err = app.models.Permissions.AddForUserTx(ctx, tx, user.ID, "photo:read", "comment:write")
+		if err != nil {
+			return err
+		}
+		return app.enqueueActivation(ctx, tx, user.ID)
+	})
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrDuplicateEmail):
@@ -59,34 +70,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 		return
 	}
-
-	//add permission to newly inserted user
-	err = app.models.Permissions.AddForUser(user.ID, "photo:read")
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	//create a token to inclue in the email
-	//Generate a token for the new created user
-	token, err := app.models.Tokens.New(user.ID, 1*24*time.Hour, data.ScopeActivation)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	app.background(func() {
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-			"userID":          user.ID,
-		}
-		//send the email to the new user
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-		if err != nil {
-			//log the errors
-			app.logger.PrintError(err, nil)
-		}
-	})
+	app.wakeWorkers()
 
 	//Write a 202 accepted request status
 	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
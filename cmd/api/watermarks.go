@@ -0,0 +1,300 @@
+//Filename: cmd/api/watermarks.go
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// watermarkFor() returns the watermark other people see on a photo, or nil when it has none
+func (app *application) watermarkFor(photo *data.Photo) (*data.Watermark, error) {
+	if photo.UserID == nil {
+		return nil, nil
+	}
+	wm, err := app.models.Watermarks.ForAlbum(*photo.UserID, photo.Album)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return wm, err
+}
+
+// dropWatermarkedRenders() removes the cached renders made with a watermark that has changed
+func (app *application) dropWatermarkedRenders(r *http.Request, id int64) {
+	keys, err := app.models.Renders.DeleteWatermarked(id)
+	if err != nil {
+		//the renders are keyed by version so they are not served again, they only cost space
+		app.logError(r, err)
+		return
+	}
+	for _, key := range keys {
+		if err := app.storage.Delete(key); err != nil {
+			app.logError(r, err)
+		}
+	}
+}
+
+// readWatermark() reads the :id of a watermark and returns it if it belongs to the caller
+func (app *application) readWatermark(w http.ResponseWriter, r *http.Request) (*data.Watermark, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	wm, err := app.models.Watermarks.Get(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return wm, true
+}
+
+// listWatermarksHandler for the GET /v1/watermarks endpoint
+// lists the caller's watermarks, the one for every album first
+func (app *application) listWatermarksHandler(w http.ResponseWriter, r *http.Request) {
+	watermarks, err := app.models.Watermarks.GetAll(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"watermarks": watermarks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createWatermarkHandler for the POST /v1/watermarks endpoint
+// creates the watermark of an album, or without an album the one for every other album.
+// a logo can be added with PUT /v1/watermarks/:id/logo and is drawn instead of the text
+func (app *application) createWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Album    *string  `json:"album"`
+		Text     string   `json:"text"`
+		Position *string  `json:"position"`
+		Opacity  *float64 `json:"opacity"`
+		Scale    *float64 `json:"scale"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	wm := &data.Watermark{
+		UserID:   app.contextGetUser(r).ID,
+		Album:    input.Album,
+		Text:     input.Text,
+		Position: "bottom-right",
+		Opacity:  0.5,
+		Scale:    0.2,
+	}
+	if input.Position != nil {
+		wm.Position = *input.Position
+	}
+	if input.Opacity != nil {
+		wm.Opacity = *input.Opacity
+	}
+	if input.Scale != nil {
+		wm.Scale = *input.Scale
+	}
+	v := validator.New()
+	if data.ValidateWatermark(v, wm); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Watermarks.Insert(wm)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateWatermark):
+			v.AddError("album", "a watermark for this album already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/watermarks/%d", wm.ID))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"watermark": wm}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showWatermarkHandler for the GET /v1/watermarks/:id endpoint
+func (app *application) showWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	wm, ok := app.readWatermark(w, r)
+	if !ok {
+		return
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"watermark": wm}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateWatermarkHandler for the PATCH /v1/watermarks/:id endpoint
+// changes the settings of a watermark. renders made with the old settings are thrown away
+func (app *application) updateWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	wm, ok := app.readWatermark(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		Album    *string  `json:"album"`
+		Text     *string  `json:"text"`
+		Position *string  `json:"position"`
+		Opacity  *float64 `json:"opacity"`
+		Scale    *float64 `json:"scale"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Album != nil {
+		wm.Album = input.Album
+	}
+	if input.Text != nil {
+		wm.Text = *input.Text
+	}
+	if input.Position != nil {
+		wm.Position = *input.Position
+	}
+	if input.Opacity != nil {
+		wm.Opacity = *input.Opacity
+	}
+	if input.Scale != nil {
+		wm.Scale = *input.Scale
+	}
+	v := validator.New()
+	if data.ValidateWatermark(v, wm); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Watermarks.Update(wm)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrDuplicateWatermark):
+			v.AddError("album", "a watermark for this album already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.dropWatermarkedRenders(r, wm.ID)
+	err = app.writeJSON(w, http.StatusOK, envelope{"watermark": wm}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setWatermarkLogoHandler for the PUT /v1/watermarks/:id/logo endpoint
+// replaces the logo of a watermark with the "logo" PNG of a multipart form
+func (app *application) setWatermarkLogoHandler(w http.ResponseWriter, r *http.Request) {
+	wm, ok := app.readWatermark(w, r)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, app.config.storage.maxUploadBytes)
+	err := r.ParseMultipartForm(8 << 20)
+	if err != nil {
+		app.badRequestResponse(w, r, fmt.Errorf("body must be a multipart form no larger than %d bytes", app.config.storage.maxUploadBytes))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	v := validator.New()
+	file, err := app.readFormFile(r, "logo")
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if file == nil {
+		v.AddError("logo", "must be provided")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	defer file.Close()
+	o, err := app.inspectOriginal(file)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	//a logo is drawn on every render, so it has to be small enough to decode each time
+	v.Check(o.blob.ContentType == "image/png", "logo", "must be a PNG image")
+	v.Check(o.width > 0 && o.width*o.height <= 4_000_000, "logo", "must not be more than 4 megapixels")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.saveBlobFile(&o.blob, file)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	previous, err := app.models.Watermarks.SetLogo(wm, &o.blob)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	//the blob may have been collected between saving the file and taking our reference
+	err = app.saveBlobFile(&o.blob, file)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if previous != nil && *previous != o.blob.Hash {
+		app.collectBlob(r, *previous)
+	}
+	app.dropWatermarkedRenders(r, wm.ID)
+	err = app.writeJSON(w, http.StatusOK, envelope{"watermark": wm}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteWatermarkHandler for the DELETE /v1/watermarks/:id endpoint
+// removes a watermark along with its logo and the renders made with it
+func (app *application) deleteWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	wm, ok := app.readWatermark(w, r)
+	if !ok {
+		return
+	}
+	//the render records go with the watermark, so their files are removed first
+	app.dropWatermarkedRenders(r, wm.ID)
+	logo, err := app.models.Watermarks.Delete(wm.ID, wm.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if logo != nil {
+		app.collectBlob(r, *logo)
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "watermark successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
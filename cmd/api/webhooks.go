@@ -0,0 +1,402 @@
+//Filename: cmd/api/webhooks.go
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+const (
+	// the deliveries claimed at a time, and how many of them are sent at once
+	webhookBatch   = 50
+	webhookWorkers = 8
+	// how long a request to a webhook may take
+	webhookTimeout = 10 * time.Second
+	// how long a claimed delivery is left to the server that claimed it: long enough for
+	// every delivery of a batch to time out, a worker's worth at a time, and then some
+	webhookLease = (webhookBatch+webhookWorkers-1)/webhookWorkers*webhookTimeout + time.Minute
+	// a delivery is attempted this many times, waiting webhookBackoff after the first
+	// failure and twice as long after each one since
+	webhookAttempts = 8
+	webhookBackoff  = 30 * time.Second
+	// the failed attempts in a row after which a webhook is disabled
+	webhookMaxFailures = 20
+	// how long sent and failed deliveries stay in the log
+	webhookLogRetention = 30 * 24 * time.Hour
+)
+
+// errWebhookAddress is returned for a webhook whose host resolves to an address that is not public
+var errWebhookAddress = errors.New("the webhook's host is not a public internet address")
+
+// webhookClient does not follow redirects, a webhook has to be given its final URL. its
+// URL was checked when it was saved, but the host may resolve somewhere else by now, so
+// every address it connects to is checked again. it connects directly, never through a proxy
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if !data.PublicIP(net.ParseIP(host)) {
+					return errWebhookAddress
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConnsPerHost: webhookWorkers,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// webhookRetryAt() returns when to try a delivery again after its attempts-th attempt
+// failed, counting from 1: webhookBackoff after the first, twice as long after each
+// one since. nil means the delivery has been tried webhookAttempts times and has failed
+func webhookRetryAt(attempts int, now time.Time) *time.Time {
+	if attempts >= webhookAttempts {
+		return nil
+	}
+	next := now.Add(webhookBackoff << (attempts - 1))
+	return &next
+}
+
+// signWebhook() returns the signature of a request to a webhook: the hex HMAC-SHA256,
+// keyed with the secret, of the timestamp, a dot and the body
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook() POSTs a delivery to its webhook and returns the status code of the response.
+// receivers check X-Webhook-Signature against the body and X-Webhook-Timestamp, and can
+// use X-Webhook-Delivery to spot a delivery they have already handled
+func sendWebhook(d *data.DueDelivery) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PhotoAlbum-Webhooks")
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(d.ID, 10))
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(d.Secret, timestamp, d.Payload))
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	//read some of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	return res.StatusCode, nil
+}
+
+// deliverWebhooks() sends the deliveries that are due. it runs on a schedule, see serve()
+func (app *application) deliverWebhooks() error {
+	due, err := app.models.Webhooks.Due(webhookBatch, webhookLease)
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, webhookWorkers)
+	for _, d := range due {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(d *data.DueDelivery) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			err := app.deliverWebhook(d)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"task": "deliver webhooks"})
+			}
+		}(d)
+	}
+	wg.Wait()
+	return nil
+}
+
+// deliverWebhook() makes an attempt at a delivery and records how it went
+func (app *application) deliverWebhook(d *data.DueDelivery) error {
+	code, err := sendWebhook(d)
+	if err == nil && code >= 200 && code < 300 {
+		return app.models.Webhooks.Delivered(d.WebhookDelivery, code)
+	}
+	var responseCode *int
+	var message string
+	if err != nil {
+		message = err.Error()
+		if len(message) > 500 {
+			message = message[:500]
+		}
+	} else {
+		responseCode = &code
+		message = fmt.Sprintf("unexpected response status %d", code)
+	}
+	retryAt := webhookRetryAt(d.Attempts+1, time.Now())
+	disabled, err := app.models.Webhooks.Failed(d.WebhookDelivery, responseCode, message, retryAt, webhookMaxFailures)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		app.logger.PrintInfo("disabled failing webhook", map[string]string{
+			"webhook_id": strconv.FormatInt(d.WebhookID, 10),
+		})
+	}
+	return nil
+}
+
+// readWebhook() reads the :id of a webhook and returns it if it belongs to the caller
+func (app *application) readWebhook(w http.ResponseWriter, r *http.Request) (*data.Webhook, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+	wh, err := app.models.Webhooks.Get(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+	return wh, true
+}
+
+// listWebhooksHandler for the GET /v1/webhooks endpoint
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := app.models.Webhooks.GetAll(app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// createWebhookHandler for the POST /v1/webhooks endpoint
+// subscribes a URL to the given types of events about the caller's photos and
+// notifications. without a secret one is generated. the secret is only shown here
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		URL    string   `json:"url"`
+		Secret *string  `json:"secret"`
+		Events []string `json:"events"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	wh := &data.Webhook{
+		UserID: app.contextGetUser(r).ID,
+		URL:    input.URL,
+		Events: input.Events,
+	}
+	if input.Secret != nil {
+		wh.Secret = *input.Secret
+	} else {
+		wh.Secret, err = data.GenerateWebhookSecret()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	v := validator.New()
+	if data.ValidateWebhook(v, wh); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Webhooks.Insert(wh)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/webhooks/%d", wh.ID))
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": wh, "secret": wh.Secret}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// showWebhookHandler for the GET /v1/webhooks/:id endpoint
+func (app *application) showWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"webhook": wh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// updateWebhookHandler for the PATCH /v1/webhooks/:id endpoint
+// changes the settings of a webhook. active=false disables it, active=true enables it
+// again and sends the deliveries that queued up while it was disabled
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	var input struct {
+		URL    *string  `json:"url"`
+		Secret *string  `json:"secret"`
+		Events []string `json:"events"`
+		Active *bool    `json:"active"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.URL != nil {
+		wh.URL = *input.URL
+	}
+	if input.Secret != nil {
+		wh.Secret = *input.Secret
+	}
+	if input.Events != nil {
+		wh.Events = input.Events
+	}
+	if input.Active != nil {
+		switch {
+		case *input.Active:
+			wh.DisabledAt = nil
+			wh.Failures = 0
+		case wh.DisabledAt == nil:
+			now := time.Now()
+			wh.DisabledAt = &now
+		}
+	}
+	v := validator.New()
+	if data.ValidateWebhook(v, wh); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Webhooks.Update(wh)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": wh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteWebhookHandler for the DELETE /v1/webhooks/:id endpoint
+// removes a webhook along with its queue and log of deliveries
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Webhooks.Delete(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// listWebhookDeliveriesHandler for the GET /v1/webhooks/:id/deliveries endpoint
+// lists the deliveries of a webhook newest first, with the response to the last attempt
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	var filters data.Filters
+	v := validator.New()
+	qs := r.URL.Query()
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	filters.Sort = "-id"
+	filters.SortList = []string{"-id"}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	deliveries, metadata, err := app.models.Webhooks.GetDeliveries(wh.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"deliveries": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// redeliverWebhookHandler for the POST /v1/webhooks/:id/deliveries/:delivery_id/redeliver endpoint
+// queues the event of a delivery to be sent again as a new delivery
+func (app *application) redeliverWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	wh, ok := app.readWebhook(w, r)
+	if !ok {
+		return
+	}
+	deliveryID, err := app.readDeliveryIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	d, err := app.models.Webhooks.Redeliver(deliveryID, wh.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"delivery": d}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,142 @@
+//Filename: cmd/api/webhooks_test.go
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"photoalbum.joelical.net/internal/data"
+)
+
+func TestSignWebhook(t *testing.T) {
+	const secret = "a-webhook-secret-0123"
+	body := []byte(`{"id":1,"type":"photo.created"}`)
+	//worked out with: printf '1700000000.<body>' | openssl dgst -sha256 -hmac <secret>
+	want := "sha256=551bc16fd5548bfd1ff568e0d3476c93cbc857f3c1f3b85b674ab732436e2d8b"
+	if got := signWebhook(secret, 1700000000, body); got != want {
+		t.Fatalf("signWebhook() = %s, want %s", got, want)
+	}
+
+	//changing anything that is signed changes the signature
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp int64
+		body      []byte
+	}{
+		{"secret", secret + "x", 1700000000, body},
+		{"timestamp", secret, 1700000001, body},
+		{"body", secret, 1700000000, []byte(`{"id":2,"type":"photo.created"}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signWebhook(tt.secret, tt.timestamp, tt.body); got == want {
+				t.Errorf("signWebhook() with another %s = %s, want a different signature", tt.name, got)
+			}
+		})
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	var got *http.Request
+	var gotBody []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer receiver.Close()
+
+	//the test receiver listens on a loopback address, which webhookClient refuses
+	client := webhookClient
+	webhookClient = &http.Client{Timeout: webhookTimeout}
+	t.Cleanup(func() { webhookClient = client })
+
+	d := &data.DueDelivery{
+		WebhookDelivery: &data.WebhookDelivery{ID: 42, EventType: "photo.created", Payload: []byte(`{"id":7}`)},
+		URL:             receiver.URL,
+		Secret:          "a-webhook-secret-0123",
+	}
+	code, err := sendWebhook(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusAccepted {
+		t.Errorf("status = %d, want %d", code, http.StatusAccepted)
+	}
+	if got.Method != http.MethodPost || string(gotBody) != `{"id":7}` {
+		t.Errorf("received %s %q, want POST of the payload", got.Method, gotBody)
+	}
+	if h := got.Header.Get("X-Webhook-Delivery"); h != "42" {
+		t.Errorf("X-Webhook-Delivery = %q, want 42", h)
+	}
+	if h := got.Header.Get("X-Webhook-Event"); h != "photo.created" {
+		t.Errorf("X-Webhook-Event = %q, want photo.created", h)
+	}
+	//the receiver can check the signature with what it was sent
+	timestamp, err := strconv.ParseInt(got.Header.Get("X-Webhook-Timestamp"), 10, 64)
+	if err != nil {
+		t.Fatalf("X-Webhook-Timestamp: %v", err)
+	}
+	if h := got.Header.Get("X-Webhook-Signature"); h != signWebhook(d.Secret, timestamp, gotBody) {
+		t.Errorf("X-Webhook-Signature = %q does not match the body and timestamp", h)
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request reached a loopback address")
+	}))
+	defer receiver.Close()
+
+	d := &data.DueDelivery{
+		WebhookDelivery: &data.WebhookDelivery{ID: 1, EventType: "photo.created", Payload: []byte(`{}`)},
+		URL:             receiver.URL,
+		Secret:          "a-webhook-secret-0123",
+	}
+	_, err := sendWebhook(d)
+	if !errors.Is(err, errWebhookAddress) {
+		t.Fatalf("sendWebhook() to %s: err = %v, want %v", receiver.URL, err, errWebhookAddress)
+	}
+}
+
+func TestWebhookRetryAt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	want := []time.Duration{
+		30 * time.Second,
+		time.Minute,
+		2 * time.Minute,
+		4 * time.Minute,
+		8 * time.Minute,
+		16 * time.Minute,
+		32 * time.Minute,
+	}
+	for i, wait := range want {
+		attempts := i + 1
+		retryAt := webhookRetryAt(attempts, now)
+		if retryAt == nil {
+			t.Fatalf("webhookRetryAt(%d) = nil, want a retry after %s", attempts, wait)
+		}
+		if got := retryAt.Sub(now); got != wait {
+			t.Errorf("webhookRetryAt(%d) waits %s, want %s", attempts, got, wait)
+		}
+	}
+	//the last attempt is not followed by another
+	if retryAt := webhookRetryAt(webhookAttempts, now); retryAt != nil {
+		t.Errorf("webhookRetryAt(%d) = %s, want nil", webhookAttempts, retryAt)
+	}
+}
+
+func TestWebhookLease(t *testing.T) {
+	//a delivery must not be claimed again while its batch may still be sending it
+	rounds := (webhookBatch + webhookWorkers - 1) / webhookWorkers
+	if slowest := time.Duration(rounds) * webhookTimeout; webhookLease <= slowest {
+		t.Errorf("webhookLease = %s, want longer than the %s a batch can take", webhookLease, slowest)
+	}
+}
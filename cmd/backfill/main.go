@@ -0,0 +1,121 @@
+//Filename: cmd/backfill/main.go
+
+// backfill works out the summary (BlurHash, colors and perceptual hash) of photos stored
+// before it was part of processing an upload. it can be run while the API is serving,
+// and again after an interruption, since it only picks up photos without a BlurHash
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "golang.org/x/image/webp"
+	"photoalbum.joelical.net/internal/data"
+	"photoalbum.joelical.net/internal/imaging"
+	"photoalbum.joelical.net/internal/jsonlog"
+	"photoalbum.joelical.net/internal/storage"
+)
+
+func main() {
+	var (
+		dsn        string
+		storageDir string
+		batchSize  int
+	)
+	flag.StringVar(&dsn, "db-dsn", os.Getenv("PA_DB_DSN"), "PostgreSQL_DSN")
+	flag.StringVar(&storageDir, "storage-dir", "./storage", "Directory uploaded files are stored in")
+	flag.IntVar(&batchSize, "batch-size", 100, "Number of photos read from the database at a time")
+	flag.Parse()
+
+	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	store, err := storage.NewFileSystem(storageDir)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	models := data.NewModels(db)
+
+	updated, skipped := 0, 0
+	var after int64
+	for {
+		photos, err := models.Photo.WithoutBlurHash(after, batchSize)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		if len(photos) == 0 {
+			break
+		}
+		for _, photo := range photos {
+			//photos that fail are left as they are and reported, the next run tries them again
+			after = photo.ID
+			err := summarize(store, photo)
+			if err == nil {
+				err = models.Photo.SaveSummary(photo)
+			}
+			if err != nil {
+				skipped++
+				logger.PrintError(err, map[string]string{"photo_id": strconv.FormatInt(photo.ID, 10)})
+				continue
+			}
+			updated++
+		}
+		logger.PrintInfo("backfilled photos", map[string]string{"up_to_id": strconv.FormatInt(after, 10)})
+	}
+	logger.PrintInfo("backfill finished", map[string]string{
+		"updated": strconv.Itoa(updated),
+		"skipped": strconv.Itoa(skipped),
+	})
+}
+
+// summarize() decodes the image of a photo (the poster of a video) and sets its summary
+func summarize(store storage.Storage, photo *data.Photo) error {
+	hash := photo.ContentHash
+	if photo.MediaType == data.MediaVideo {
+		hash = photo.PosterHash
+	}
+	if hash == nil {
+		return errors.New("the photo has no image")
+	}
+	file, _, err := store.Open(data.BlobKey(*hash))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return err
+	}
+	if config.Width*config.Height > imaging.MaxPixels {
+		return fmt.Errorf("the image is larger than %d pixels", imaging.MaxPixels)
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return err
+	}
+	photo.SetSummary(imaging.Summarize(img, data.PaletteSize))
+	return nil
+}
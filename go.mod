@@ -1,6 +1,6 @@
 module photoalbum.joelical.net
 
-go 1.19
+go 1.20
 
 require github.com/julienschmidt/httprouter v1.3.0
 
@@ -10,6 +10,7 @@ require golang.org/x/time v0.2.0
 
 require (
 	golang.org/x/crypto v0.3.0
+	golang.org/x/image v0.18.0
 	gopkg.in/mail.v2 v2.3.1
 )
 
@@ -0,0 +1,102 @@
+//Filename: internal/data/batch.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrBatchAborted is reported for the operations of an all-or-nothing batch that were
+// rolled back or never run because another operation failed
+var ErrBatchAborted = errors.New("batch aborted")
+
+// PhotoTx gives the operations of a batch access to its transaction
+type PhotoTx struct {
+	m   PhotoModel
+	ctx context.Context
+	tx  *sql.Tx
+}
+
+// Get() returns a photo and locks it until the batch ends
+func (t *PhotoTx) Get(id int64) (*Photo, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT ` + photoColumns + `
+		FROM photos
+		WHERE id = $1
+		FOR UPDATE
+	`
+	var photo Photo
+	err := t.tx.QueryRowContext(t.ctx, query, id).Scan(photo.scanDest()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &photo, nil
+}
+
+// Update() works like PhotoModel.Update() inside the batch
+func (t *PhotoTx) Update(photo *Photo, changedBy int64) error {
+	return t.m.update(t.ctx, t.tx, photo, changedBy)
+}
+
+// Delete() works like PhotoModel.Delete() inside the batch. it returns the hashes of the
+// released blobs, which should be collected once the batch has committed
+func (t *PhotoTx) Delete(id int64, version int32) ([]string, error) {
+	return t.m.delete(t.ctx, t.tx, id, version)
+}
+
+// Batch() runs n operations in one transaction and returns the error of each one.
+// when atomic is set the first failure rolls everything back and the other operations
+// report ErrBatchAborted. otherwise every operation runs in its own savepoint so a
+// failure only undoes that operation. committed says if the transaction was committed
+func (m PhotoModel) Batch(n int, atomic bool, op func(t *PhotoTx, i int) error) (results []error, committed bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	t := &PhotoTx{m: m, ctx: ctx, tx: tx}
+	results = make([]error, n)
+	for i := 0; i < n; i++ {
+		if atomic {
+			results[i] = op(t, i)
+			if results[i] != nil {
+				for j := range results {
+					if j != i {
+						results[j] = ErrBatchAborted
+					}
+				}
+				return results, false, nil
+			}
+			continue
+		}
+		if _, err = tx.ExecContext(ctx, "SAVEPOINT batch_item"); err != nil {
+			return nil, false, err
+		}
+		results[i] = op(t, i)
+		statement := "RELEASE SAVEPOINT batch_item"
+		if results[i] != nil {
+			statement = "ROLLBACK TO SAVEPOINT batch_item"
+		}
+		if _, err = tx.ExecContext(ctx, statement); err != nil {
+			return nil, false, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	return results, true, nil
+}
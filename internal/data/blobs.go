@@ -0,0 +1,143 @@
+//Filename: internal/data/blobs.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// a Blob is an uploaded original, stored once per content hash.
+// RefCount is the number of photos using it
+type Blob struct {
+	Hash        string    `json:"hash"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	RefCount    int       `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// BlobKey() returns the storage key of the blob with the given hex encoded SHA-256
+func BlobKey(hash string) string {
+	return "originals/" + hash[:2] + "/" + hash
+}
+
+// Key() returns the storage key of the blob
+func (b *Blob) Key() string {
+	return BlobKey(b.Hash)
+}
+
+// define a BlobModel which wraps a sql.db connection pool
+type BlobModel struct {
+	DB *sql.DB
+}
+
+// Get() returns the blob with the given hash
+func (m BlobModel) Get(hash string) (*Blob, error) {
+	query := `
+		SELECT hash, size, content_type, ref_count, created_at
+		FROM blobs
+		WHERE hash = $1
+	`
+	var blob Blob
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, hash).Scan(&blob.Hash, &blob.Size, &blob.ContentType, &blob.RefCount, &blob.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &blob, nil
+}
+
+// acquire() adds a reference to a blob inside a photo's transaction, creating it if needed.
+// when the blob is being collected the insert waits for the collection to finish
+func (m BlobModel) acquire(ctx context.Context, tx DBTX, blob *Blob) error {
+	query := `
+		INSERT INTO blobs (hash, size, content_type, ref_count)
+		VALUES ($1, $2, $3, 1)
+		ON CONFLICT (hash) DO UPDATE SET ref_count = blobs.ref_count + 1
+		RETURNING ref_count, created_at
+	`
+	return tx.QueryRowContext(ctx, query, blob.Hash, blob.Size, blob.ContentType).Scan(&blob.RefCount, &blob.CreatedAt)
+}
+
+// release() removes a reference to a blob inside a photo's transaction.
+// blobs nobody uses any more are removed by Collect()
+func (m BlobModel) release(ctx context.Context, tx DBTX, hash string) error {
+	query := `
+		UPDATE blobs
+		SET ref_count = ref_count - 1
+		WHERE hash = $1
+	`
+	_, err := tx.ExecContext(ctx, query, hash)
+	return err
+}
+
+// Collect() deletes a blob once no photo uses it. remove is called to delete the stored
+// file while the row is still locked, so a concurrent upload of the same bytes waits
+// and then stores the file again
+func (m BlobModel) Collect(hash string, remove func(key string) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		DELETE FROM blobs
+		WHERE hash = $1 AND ref_count = 0
+	`
+	result, err := tx.ExecContext(ctx, query, hash)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	//still in use
+	if rowsAffected == 0 {
+		return nil
+	}
+	err = remove(BlobKey(hash))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Unused() returns up to limit blobs no photo uses any more. they are normally collected
+// when their last photo goes, these are the ones that failed to be
+func (m BlobModel) Unused(limit int) ([]string, error) {
+	query := `
+		SELECT hash
+		FROM blobs
+		WHERE ref_count = 0
+		LIMIT $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := []string{}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
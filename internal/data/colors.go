@@ -0,0 +1,58 @@
+//Filename: internal/data/colors.go
+
+package data
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/lib/pq"
+	"photoalbum.joelical.net/internal/imaging"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the most colors kept in the palette of a photo
+const PaletteSize = 5
+
+// ColorRX matches a color written as #rrggbb, the # is optional
+var ColorRX = regexp.MustCompile(`^#?[0-9a-fA-F]{6}$`)
+
+// a ColorMatch finds photos with a palette color within Tolerance of Color. the tolerance
+// is a distance in CIELAB, about 2 is just noticeable and 10 to 20 is the same color family
+type ColorMatch struct {
+	Color     string
+	Tolerance float64
+}
+
+// ValidateColorMatch() checks a color and its tolerance
+func ValidateColorMatch(v *validator.Validator, c ColorMatch) {
+	v.Check(validator.Matches(c.Color, ColorRX), "color", "must be a color in the form #RRGGBB")
+	v.Check(c.Tolerance >= 0 && c.Tolerance <= 100, "color_tolerance", "must be between 0 and 100")
+}
+
+// condition() returns the SQL matching photos with a palette color close to the color
+func (c ColorMatch) condition(args *[]interface{}) string {
+	//the color was checked by ValidateColorMatch()
+	rgba, _ := imaging.ParseHex(c.Color)
+	l, a, b := imaging.Lab(rgba)
+	*args = append(*args, l, a, b, c.Tolerance*c.Tolerance)
+	n := len(*args)
+	return fmt.Sprintf(`EXISTS (
+			SELECT 1 FROM unnest(photos.palette_l, photos.palette_a, photos.palette_b) AS p(l, a, b)
+			WHERE (p.l - $%d) ^ 2 + (p.a - $%d) ^ 2 + (p.b - $%d) ^ 2 <= $%d
+		)`, n-3, n-2, n-1, n)
+}
+
+// paletteLab() returns the components of the photo's palette in CIELAB for storage
+func (photo *Photo) paletteLab() (l, a, b interface{}) {
+	ls, as, bs := []float64{}, []float64{}, []float64{}
+	for _, hex := range photo.Palette {
+		rgba, err := imaging.ParseHex(hex)
+		if err != nil {
+			continue
+		}
+		cl, ca, cb := imaging.Lab(rgba)
+		ls, as, bs = append(ls, cl), append(as, ca), append(bs, cb)
+	}
+	return pq.Array(ls), pq.Array(as), pq.Array(bs)
+}
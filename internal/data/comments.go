@@ -0,0 +1,204 @@
+//Filename: internal/data/comments.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the longest comment we accept
+const MaxCommentLength = 2000
+
+// a Comment is left on a photo. a reply has the ID of a top level comment as its ParentID.
+// hidden comments were hidden by the owner of the photo, deleted ones by their author or
+// the owner. both stay in the thread so their replies keep their place
+type Comment struct {
+	ID        int64      `json:"id"`
+	PhotoID   int64      `json:"photo_id"`
+	UserID    int64      `json:"user_id"`
+	Author    string     `json:"author"`
+	ParentID  *int64     `json:"parent_id"`
+	Body      string     `json:"body"`
+	Hidden    bool       `json:"hidden"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	Version   int32      `json:"version"`
+	// Replies is only filled in on top level comments by Thread()
+	Replies []*Comment `json:"replies,omitempty"`
+}
+
+// Deleted() reports if the comment has been deleted
+func (c *Comment) Deleted() bool {
+	return c.DeletedAt != nil
+}
+
+// ValidateComment() checks the body of a comment
+func ValidateComment(v *validator.Validator, c *Comment) {
+	v.Check(c.Body != "", "body", "must be provided")
+	v.Check(len(c.Body) <= MaxCommentLength, "body", "must not be more than 2000 bytes long")
+}
+
+// Thread() nests the replies of a photo's comments under their parent. the comments
+// must be in the order they were written, as returned by GetAllForPhoto()
+func Thread(comments []*Comment) []*Comment {
+	thread := []*Comment{}
+	parents := make(map[int64]*Comment)
+	for _, c := range comments {
+		if c.ParentID == nil {
+			parents[c.ID] = c
+			thread = append(thread, c)
+			continue
+		}
+		if parent, ok := parents[*c.ParentID]; ok {
+			parent.Replies = append(parent.Replies, c)
+		}
+	}
+	return thread
+}
+
+// define a CommentModel which wraps a sql.db connection pool
+type CommentModel struct {
+	DB *sql.DB
+}
+
+// commentColumns is the select list read by scanComment(). the query has to join users
+const commentColumns = `comments.id, comments.photo_id, comments.user_id, users.name, comments.parent_id,
+		comments.body, comments.hidden, comments.deleted_at, comments.created_at, comments.updated_at, comments.version`
+
+// scanComment() reads a row of commentColumns
+func scanComment(row interface{ Scan(...interface{}) error }) (*Comment, error) {
+	var c Comment
+	err := row.Scan(&c.ID, &c.PhotoID, &c.UserID, &c.Author, &c.ParentID, &c.Body, &c.Hidden, &c.DeletedAt, &c.CreatedAt, &c.UpdatedAt, &c.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// Insert() adds a comment to a photo. the parent of a reply must be a top level comment
+// on the same photo that has not been deleted, otherwise ErrRecordNotFound is returned
+func (m CommentModel) Insert(c *Comment) error {
+	query := `
+		INSERT INTO comments (photo_id, user_id, parent_id, body)
+		SELECT $1, $2, $3, $4
+		WHERE $3::bigint IS NULL OR EXISTS (
+			SELECT 1
+			FROM comments parent
+			WHERE parent.id = $3
+			AND parent.photo_id = $1
+			AND parent.parent_id IS NULL
+			AND parent.deleted_at IS NULL
+		)
+		RETURNING id, created_at, updated_at, version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, c.PhotoID, c.UserID, c.ParentID, c.Body).Scan(&c.ID, &c.CreatedAt, &c.UpdatedAt, &c.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Get() returns a comment on a photo
+func (m CommentModel) Get(id int64, photoID int64) (*Comment, error) {
+	query := `
+		SELECT ` + commentColumns + `
+		FROM comments
+		INNER JOIN users ON users.id = comments.user_id
+		WHERE comments.id = $1 AND comments.photo_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return scanComment(m.DB.QueryRowContext(ctx, query, id, photoID))
+}
+
+// GetAllForPhoto() returns the comments on a photo in the order they were written,
+// see Thread() to nest the replies
+func (m CommentModel) GetAllForPhoto(photoID int64) ([]*Comment, error) {
+	query := `
+		SELECT ` + commentColumns + `
+		FROM comments
+		INNER JOIN users ON users.id = comments.user_id
+		WHERE comments.photo_id = $1
+		ORDER BY comments.created_at, comments.id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, photoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	comments := []*Comment{}
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// Update() saves the body and hidden flag of a comment. it fails with ErrEditConflict
+// when the comment changed or was deleted since it was read
+func (m CommentModel) Update(c *Comment) error {
+	query := `
+		UPDATE comments
+		SET body = $3, hidden = $4, updated_at = NOW(), version = version + 1
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		RETURNING updated_at, version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, c.ID, c.Version, c.Body, c.Hidden).Scan(&c.UpdatedAt, &c.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() marks a comment as deleted. the row is kept so its replies stay in the thread
+func (m CommentModel) Delete(id int64) error {
+	query := `
+		UPDATE comments
+		SET deleted_at = NOW(), version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
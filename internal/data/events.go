@@ -0,0 +1,138 @@
+//Filename: internal/data/events.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// the types of events streamed to clients and sent to webhooks
+var EventTypes = []string{
+	"photo.created", "photo.updated", "photo.deleted",
+	"comment.created", "comment.updated", "comment.deleted",
+	"notification.created",
+}
+
+// an Event is a change to a photo, a comment or a notification, written to the log by
+// the outbox relay. Data holds the ids a client needs to fetch what changed
+type Event struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	UserID    *int64          `json:"-"`
+	PhotoID   int64           `json:"photo_id"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// VisibleTo() reports if the event may be sent to the user. an event with a UserID
+// is about something only that user can see
+func (e *Event) VisibleTo(user *User) bool {
+	return e.UserID == nil || (!user.IsAnonymous() && *e.UserID == user.ID)
+}
+
+// define an EventModel which wraps a sql.db connection pool
+type EventModel struct {
+	DB *sql.DB
+}
+
+// Get() returns an event
+func (m EventModel) Get(id int64) (*Event, error) {
+	query := `
+		SELECT id, type, user_id, photo_id, data, created_at
+		FROM events
+		WHERE id = $1
+	`
+	var e Event
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&e.ID, &e.Type, &e.UserID, &e.PhotoID, &e.Data, &e.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &e, nil
+}
+
+// Insert() writes an event to the log in db, so it is committed with the caller's
+// transaction. every server is told about it once it is, see migration 000023.
+// db must be a transaction: the events lock it takes is held until the caller commits,
+// so no later id can commit before this one and clients resuming by id miss nothing
+func (m EventModel) Insert(ctx context.Context, db DBTX, e *Event) error {
+	_, err := db.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('events'))`)
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO events (type, user_id, photo_id, data)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`
+	return db.QueryRowContext(ctx, query, e.Type, e.UserID, e.PhotoID, e.Data).Scan(&e.ID, &e.CreatedAt)
+}
+
+// After() returns up to limit events after the given id, oldest first. it returns every
+// user's events, the caller picks the ones a user may see with Event.VisibleTo()
+func (m EventModel) After(id int64, limit int) ([]*Event, error) {
+	query := `
+		SELECT id, type, user_id, photo_id, data, created_at
+		FROM events
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []*Event{}
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.Type, &e.UserID, &e.PhotoID, &e.Data, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, &e)
+	}
+	return events, rows.Err()
+}
+
+// Last() returns the id of the newest event, 0 when the log is empty
+func (m EventModel) Last() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var id int64
+	err := m.DB.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM events`).Scan(&id)
+	return id, err
+}
+
+// Retained() reports if the log still goes back to the event with the given id, so
+// every event after it can be replayed. old events are deleted oldest first, so that is
+// the case while any event up to that id is left
+func (m EventModel) Retained(id int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var retained bool
+	err := m.DB.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM events WHERE id <= $1)`, id).Scan(&retained)
+	return retained, err
+}
+
+// DeleteOlderThan() trims the log to the events written since the cutoff
+func (m EventModel) DeleteOlderThan(cutoff time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM events WHERE created_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
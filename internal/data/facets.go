@@ -0,0 +1,87 @@
+//Filename: internal/data/facets.go
+
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the facets a photo listing can be bucketed by
+var FacetList = []string{"tag", "year", "month", "camera", "album", "visibility"}
+
+// facetQueries holds the SELECT for each facet. each one reads the matched photos
+// and returns the facet name, the bucket value and the number of photos in the bucket
+var facetQueries = map[string]string{
+	"tag": `SELECT 'tag', tag, COUNT(*) FROM matched, unnest(matched.tags) AS tag
+		GROUP BY 2 ORDER BY 3 DESC, 2 LIMIT %d`,
+	"year": `SELECT 'year', to_char(taken_at, 'YYYY'), COUNT(*) FROM matched WHERE taken_at IS NOT NULL
+		GROUP BY 2 ORDER BY 2 DESC LIMIT %d`,
+	"month": `SELECT 'month', to_char(taken_at, 'YYYY-MM'), COUNT(*) FROM matched WHERE taken_at IS NOT NULL
+		GROUP BY 2 ORDER BY 2 DESC LIMIT %d`,
+	"camera": `SELECT 'camera', camera_model, COUNT(*) FROM matched WHERE camera_model <> ''
+		GROUP BY 2 ORDER BY 3 DESC, 2 LIMIT %d`,
+	"album": `SELECT 'album', album, COUNT(*) FROM matched WHERE album <> ''
+		GROUP BY 2 ORDER BY 3 DESC, 2 LIMIT %d`,
+	"visibility": `SELECT 'visibility', visibility, COUNT(*) FROM matched
+		GROUP BY 2 ORDER BY 3 DESC, 2 LIMIT %d`,
+}
+
+// a FacetBucket is one value of a facet and the number of photos having it
+type FacetBucket struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facets() counts the photos matching the search by each of the requested facets.
+// the matching photos are only read once and every facet is a small GROUP BY over them
+func (m PhotoModel) Facets(search PhotoSearch, facets []string, size int) (map[string][]FacetBucket, error) {
+	args := []interface{}{}
+	from := search.from(&args)
+	where := search.where(&args)
+
+	selects := []string{}
+	for _, facet := range facets {
+		query, ok := facetQueries[facet]
+		if !ok {
+			panic("unknown facet: " + facet)
+		}
+		selects = append(selects, "("+fmt.Sprintf(query, size)+")")
+	}
+	query := fmt.Sprintf(`
+		WITH matched AS MATERIALIZED (
+			SELECT photos.tags, photos.taken_at, photos.camera_model, photos.album, photos.visibility
+			%s
+			%s
+		)
+		%s`, from, where, strings.Join(selects, "\n\t\tUNION ALL\n\t\t"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	//every requested facet is in the result even when it has no buckets
+	result := make(map[string][]FacetBucket)
+	for _, facet := range facets {
+		result[facet] = []FacetBucket{}
+	}
+	for rows.Next() {
+		var facet string
+		var bucket FacetBucket
+		err := rows.Scan(&facet, &bucket.Value, &bucket.Count)
+		if err != nil {
+			return nil, err
+		}
+		result[facet] = append(result[facet], bucket)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -3,6 +3,10 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
 	"strings"
 
@@ -14,12 +18,49 @@ type Filters struct {
 	PageSize int
 	Sort     string
 	SortList []string
+	// Cursor is an opaque next_cursor/prev_cursor from an earlier page. when set Page is ignored
+	Cursor string
+	// SkipTotal leaves out the total record count, which has to visit every matching row
+	SkipTotal bool
+}
+
+// a cursor marks a position in a sorted listing by the sort key and id of a row
+type cursor struct {
+	Sort     string `json:"s"`
+	Key      string `json:"k"`
+	ID       int64  `json:"i"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+// encodeCursor() turns a cursor into the opaque string handed to clients
+func encodeCursor(c cursor) string {
+	js, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+// decodeCursor() reverses encodeCursor()
+func decodeCursor(s string) (*cursor, error) {
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	var c cursor
+	err = json.Unmarshal(js, &c)
+	if err != nil || c.ID < 1 {
+		return nil, errors.New("malformed cursor")
+	}
+	return &c, nil
 }
 
 func ValidateFilters(v *validator.Validator, f Filters) {
 	//check page and page size parameters
 	v.Check(f.Page > 0, "page", "must be greater than zero")
 	v.Check(f.Page <= 1000, "page", "must be a maxinum of 1000")
+	//a cursor is only valid for the sort it was created with
+	if f.Cursor != "" {
+		c, err := decodeCursor(f.Cursor)
+		v.Check(err == nil && c.Sort == f.Sort, "cursor", "invalid cursor for this sort")
+	}
 
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maxinum of 100")
@@ -40,12 +81,43 @@ func (f Filters) sortColumn() string {
 
 // The sortOrder() method that determines whether we should sort by DESC/ASC
 func (f Filters) sortOrder() string {
+	//the best match always comes first
+	if f.Sort == "relevance" {
+		return "DESC"
+	}
 	if strings.HasPrefix(f.Sort, "-") {
 		return "DESC"
 	}
 	return "ASC"
 }
 
+// the keysetCondition() method returns the WHERE condition selecting the rows after
+// (or before, going backward) the row with the given sort key and id
+func (f Filters) keysetCondition(backward bool, keyArg, idArg string) string {
+	column := f.sortColumn()
+	op, idOp := ">", ">"
+	if f.sortOrder() == "DESC" {
+		op = "<"
+	}
+	//going backward flips both comparisons
+	if backward {
+		op = map[string]string{">": "<", "<": ">"}[op]
+		idOp = "<"
+	}
+	return fmt.Sprintf("(%s %s %s OR (%s = %s AND id %s %s))", column, op, keyArg, column, keyArg, idOp, idArg)
+}
+
+// the orderBy() method returns the ORDER BY list. going backward reverses it
+// so the rows closest to the cursor come first
+func (f Filters) orderBy(backward bool) string {
+	order, idOrder := f.sortOrder(), "ASC"
+	if backward {
+		order = map[string]string{"ASC": "DESC", "DESC": "ASC"}[order]
+		idOrder = "DESC"
+	}
+	return fmt.Sprintf("%s %s, id %s", f.sortColumn(), order, idOrder)
+}
+
 // the limit() method determines the LIMIT
 func (f Filters) limit() int {
 	return f.PageSize
@@ -58,11 +130,13 @@ func (f Filters) offset() int {
 
 // the metadata type contains metdata to help with pagination
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 // the calculateMetadata() function computes the values for the metadata fields
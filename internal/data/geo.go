@@ -0,0 +1,198 @@
+//Filename: internal/data/geo.go
+
+package data
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the mean radius of the earth used for distances
+const earthRadiusKM = 6371.0
+
+// the alphabet geohashes are written in
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Geohash() encodes a location as a geohash of the given length.
+// every extra character narrows the cell, so nearby locations share a prefix
+func Geohash(latitude, longitude float64, length int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, length)
+	bit, ch, even := 0, 0, true
+	for len(hash) < length {
+		//bits alternate between longitude and latitude, starting with longitude
+		if even {
+			mid := (lonRange[0] + lonRange[1]) / 2
+			if longitude >= mid {
+				ch |= 1 << (4 - bit)
+				lonRange[0] = mid
+			} else {
+				lonRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if latitude >= mid {
+				ch |= 1 << (4 - bit)
+				latRange[0] = mid
+			} else {
+				latRange[1] = mid
+			}
+		}
+		even = !even
+		if bit < 4 {
+			bit++
+		} else {
+			hash = append(hash, geohashAlphabet[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// ValidateLocation() checks a latitude/longitude pair. both or neither must be set
+func ValidateLocation(v *validator.Validator, latitude, longitude *float64) {
+	v.Check((latitude == nil) == (longitude == nil), "location", "latitude and longitude must be provided together")
+	if latitude != nil {
+		v.Check(*latitude >= -90 && *latitude <= 90, "latitude", "must be between -90 and 90")
+	}
+	if longitude != nil {
+		v.Check(*longitude >= -180 && *longitude <= 180, "longitude", "must be between -180 and 180")
+	}
+}
+
+// a BoundingBox is an area of the map. MinLon greater than MaxLon means the box crosses the antimeridian
+type BoundingBox struct {
+	MinLon, MinLat, MaxLon, MaxLat float64
+}
+
+// ValidateBoundingBox() checks the corners of a bounding box
+func ValidateBoundingBox(v *validator.Validator, key string, b BoundingBox) {
+	v.Check(b.MinLat >= -90 && b.MaxLat <= 90 && b.MinLat <= b.MaxLat, key, "latitudes must be between -90 and 90 with the minimum first")
+	v.Check(b.MinLon >= -180 && b.MaxLon <= 180 && b.MaxLon >= -180 && b.MinLon <= 180, key, "longitudes must be between -180 and 180")
+}
+
+// condition() returns the SQL matching locations inside the box
+func (b BoundingBox) condition(args *[]interface{}) string {
+	*args = append(*args, b.MinLat, b.MaxLat, b.MinLon, b.MaxLon)
+	n := len(*args)
+	join := "AND"
+	if b.MinLon > b.MaxLon {
+		join = "OR"
+	}
+	return fmt.Sprintf("(photos.latitude BETWEEN $%d AND $%d AND (photos.longitude >= $%d %s photos.longitude <= $%d))", n-3, n-2, n-1, join, n)
+}
+
+// a Circle is the area within RadiusKM of a point
+type Circle struct {
+	Latitude, Longitude, RadiusKM float64
+}
+
+// ValidateCircle() checks the centre and radius of a circle
+func ValidateCircle(v *validator.Validator, c Circle) {
+	v.Check(c.Latitude >= -90 && c.Latitude <= 90, "near", "latitude must be between -90 and 90")
+	v.Check(c.Longitude >= -180 && c.Longitude <= 180, "near", "longitude must be between -180 and 180")
+	v.Check(c.RadiusKM > 0, "radius_km", "must be greater than zero")
+	v.Check(c.RadiusKM <= 20000, "radius_km", "must be a maxinum of 20000")
+}
+
+// bounds() returns a box around the circle. it is cheap to check with the
+// location index and rules out most rows before the exact distance is computed
+func (c Circle) bounds() BoundingBox {
+	dLat := c.RadiusKM / (math.Pi * earthRadiusKM / 180)
+	box := BoundingBox{MinLat: math.Max(c.Latitude-dLat, -90), MaxLat: math.Min(c.Latitude+dLat, 90), MinLon: -180, MaxLon: 180}
+	//near the poles every longitude is close
+	cos := math.Cos(c.Latitude * math.Pi / 180)
+	if box.MinLat > -90 && box.MaxLat < 90 && cos > 0 {
+		dLon := dLat / cos
+		if dLon < 180 {
+			box.MinLon = math.Mod(c.Longitude-dLon+540, 360) - 180
+			box.MaxLon = math.Mod(c.Longitude+dLon+540, 360) - 180
+		}
+	}
+	return box
+}
+
+// condition() returns the SQL matching locations inside the circle
+func (c Circle) condition(args *[]interface{}) string {
+	box := c.bounds().condition(args)
+	*args = append(*args, c.Latitude, c.Longitude, c.RadiusKM)
+	n := len(*args)
+	//the haversine distance. rounding can take the argument of asin() just past 1 for
+	//antipodal points, which postgres rejects
+	return fmt.Sprintf(`%s
+		AND %f * 2 * asin(LEAST(1, sqrt(
+			power(sin(radians(photos.latitude - $%d) / 2), 2) +
+			cos(radians($%d)) * cos(radians(photos.latitude)) * power(sin(radians(photos.longitude - $%d) / 2), 2)
+		))) <= $%d`, box, earthRadiusKM, n-2, n-2, n-1, n)
+}
+
+// a MapCluster is a group of nearby photos shown as a single marker
+type MapCluster struct {
+	Geohash   string  `json:"geohash"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Count     int     `json:"count"`
+	// PhotoID is set when the marker is a single photo
+	PhotoID int64 `json:"photo_id,omitempty"`
+}
+
+// ClusterPrecision() returns the geohash length used to cluster markers at a map zoom level.
+// each zoom level halves the width of the map, each geohash character divides a cell by 32
+func ClusterPrecision(zoom int) int {
+	precision := (zoom + 3) * 2 / 5
+	if precision < 1 {
+		return 1
+	}
+	if precision > 9 {
+		return 9
+	}
+	return precision
+}
+
+// MapClusters() groups the located photos matching the search by geohash prefix.
+// the marker of a cluster is placed at the average location of its photos
+func (m PhotoModel) MapClusters(search PhotoSearch, zoom int, limit int) ([]*MapCluster, error) {
+	args := []interface{}{ClusterPrecision(zoom)}
+	from := search.from(&args)
+	where := search.where(&args)
+	args = append(args, limit)
+	query := fmt.Sprintf(`
+		SELECT left(photos.geohash, $1), AVG(photos.latitude), AVG(photos.longitude), COUNT(*), MIN(photos.id)
+		%s
+		%s
+		AND photos.geohash IS NOT NULL
+		GROUP BY 1
+		ORDER BY 4 DESC, 1
+		LIMIT $%d`, from, where, len(args))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clusters := []*MapCluster{}
+	for rows.Next() {
+		var cluster MapCluster
+		var photoID int64
+		err := rows.Scan(&cluster.Geohash, &cluster.Latitude, &cluster.Longitude, &cluster.Count, &photoID)
+		if err != nil {
+			return nil, err
+		}
+		if cluster.Count == 1 {
+			cluster.PhotoID = photoID
+		}
+		clusters = append(clusters, &cluster)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return clusters, nil
+}
@@ -0,0 +1,211 @@
+//Filename: internal/data/idempotency.go
+
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// StoredResponse is a response kept for replaying to a retried request
+type StoredResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// an IdempotencyKey is an Idempotency-Key of a user. Response is set when the key was used
+// before, Busy when another request is still running with it. otherwise the key is claimed
+// by this request until Complete() or Release() is called
+type IdempotencyKey struct {
+	Fingerprint []byte
+	Response    *StoredResponse
+	Busy        bool
+	userID      int64
+	key         string
+	// token marks the claim as ours, it is nil when the key was not claimed
+	token []byte
+	db    *sql.DB
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// ValidateIdempotencyKey() checks a client supplied Idempotency-Key
+func ValidateIdempotencyKey(v *validator.Validator, key string) {
+	v.Check(len(key) <= 255, "Idempotency-Key", "must not be more than 255 bytes long")
+	for _, c := range key {
+		if c < 0x21 || c > 0x7e {
+			v.AddError("Idempotency-Key", "must only contain printable ASCII characters")
+			break
+		}
+	}
+}
+
+// define an IdempotencyModel which wraps a sql.db connection pool
+type IdempotencyModel struct {
+	DB *sql.DB
+}
+
+// Lock() claims a key for a request with the given fingerprint. the claim is a row that is
+// locked for lease and kept locked while the request runs, no transaction is held open.
+// a key claimed by a request that is still running comes back Busy, and one whose claim ran
+// out (its server stopped) is taken over. keys older than ttl are reused
+func (m IdempotencyModel) Lock(userID int64, key string, fingerprint []byte, ttl time.Duration, lease time.Duration) (*IdempotencyKey, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		INSERT INTO idempotency_keys (user_id, key, fingerprint, expires_at, lock_token, locked_until)
+		VALUES ($1, $2, $3, NOW() + $4 * interval '1 second', $5, NOW() + $6 * interval '1 second')
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status = NULL, headers = '{}', body = '',
+			created_at = NOW(), expires_at = EXCLUDED.expires_at,
+			lock_token = EXCLUDED.lock_token, locked_until = EXCLUDED.locked_until
+		WHERE idempotency_keys.expires_at <= NOW()
+		OR (idempotency_keys.status IS NULL AND (idempotency_keys.locked_until IS NULL OR idempotency_keys.locked_until <= NOW()))
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = m.DB.ExecContext(ctx, query, userID, key, fingerprint, ttl.Seconds(), token, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	query = `
+		SELECT fingerprint, status, headers, body, lock_token = $3
+		FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2
+	`
+	k := &IdempotencyKey{userID: userID, key: key, db: m.DB}
+	var status sql.NullInt32
+	var headers []byte
+	var body []byte
+	var claimed sql.NullBool
+	err = m.DB.QueryRowContext(ctx, query, userID, key, token).Scan(&k.Fingerprint, &status, &headers, &body, &claimed)
+	if err != nil {
+		//the key expired and was removed in between
+		if errors.Is(err, sql.ErrNoRows) {
+			return m.Lock(userID, key, fingerprint, ttl, lease)
+		}
+		return nil, err
+	}
+	switch {
+	case status.Valid:
+		k.Response = &StoredResponse{Status: int(status.Int32), Body: body}
+		err = json.Unmarshal(headers, &k.Response.Header)
+		if err != nil {
+			return nil, err
+		}
+	case claimed.Bool:
+		k.token = token
+		k.stop = make(chan struct{})
+		go k.keepLocked(lease)
+	default:
+		k.Busy = true
+	}
+	return k, nil
+}
+
+// keepLocked() extends the claim on the key until it is completed or released, so a
+// request running longer than the lease isn't taken over
+func (k *IdempotencyKey) keepLocked(lease time.Duration) {
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	query := `
+		UPDATE idempotency_keys
+		SET locked_until = NOW() + $4 * interval '1 second'
+		WHERE user_id = $1 AND key = $2 AND lock_token = $3
+	`
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			//a failed extension is tried again on the next tick
+			k.db.ExecContext(ctx, query, k.userID, k.key, k.token, lease.Seconds())
+			cancel()
+		}
+	}
+}
+
+// unlock() stops extending the claim
+func (k *IdempotencyKey) unlock() {
+	k.once.Do(func() {
+		if k.stop != nil {
+			close(k.stop)
+		}
+	})
+}
+
+// Matches() reports if the key was claimed for a request with the same fingerprint
+func (k *IdempotencyKey) Matches(fingerprint []byte) bool {
+	return bytes.Equal(k.Fingerprint, fingerprint)
+}
+
+// Complete() stores the response to the request and releases the key
+func (k *IdempotencyKey) Complete(response StoredResponse) error {
+	if k.token == nil {
+		return nil
+	}
+	k.unlock()
+	headers, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+	query := `
+		UPDATE idempotency_keys
+		SET status = $4, headers = $5, body = $6, lock_token = NULL, locked_until = NULL
+		WHERE user_id = $1 AND key = $2 AND lock_token = $3
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err = k.db.ExecContext(ctx, query, k.userID, k.key, k.token, response.Status, headers, response.Body)
+	if err != nil {
+		return err
+	}
+	k.token = nil
+	return nil
+}
+
+// Release() gives up the key without storing anything. the key is forgotten, so the next
+// request with it runs as if it were new. it does nothing once the key is completed
+func (k *IdempotencyKey) Release() error {
+	if k.token == nil {
+		return nil
+	}
+	k.unlock()
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE user_id = $1 AND key = $2 AND lock_token = $3 AND status IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := k.db.ExecContext(ctx, query, k.userID, k.key, k.token)
+	return err
+}
+
+// DeleteExpired() removes the keys that can no longer be replayed
+func (m IdempotencyModel) DeleteExpired() (int64, error) {
+	query := `
+		DELETE FROM idempotency_keys
+		WHERE expires_at <= NOW()
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,173 @@
+//Filename: internal/data/jobs.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// the types of jobs
+const (
+	JobSendActivation = "send_activation"
+	JobSendEmail      = "send_email"
+	JobSummarizePhoto = "summarize_photo"
+)
+
+// ErrLeaseLost is returned when a job is finished by a worker whose lease on it ran out,
+// and another worker has claimed it since
+var ErrLeaseLost = errors.New("lease lost")
+
+// a Job is a piece of work queued to run outside of a request. Payload holds its
+// arguments, which depend on its Type
+type Job struct {
+	ID          int64           `json:"id"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   *string         `json:"last_error"`
+	CreatedAt   time.Time       `json:"created_at"`
+}
+
+// define a JobModel which wraps a sql.db connection pool
+type JobModel struct {
+	DB *sql.DB
+}
+
+// jobColumns is the select list read by scanJob()
+const jobColumns = `id, type, payload, status, attempts, max_attempts, run_at, last_error, created_at`
+
+// scanJob() reads a row of jobColumns
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var job Job
+	err := row.Scan(&job.ID, &job.Type, &job.Payload, &job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt, &job.LastError, &job.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &job, nil
+}
+
+// Enqueue() queues a job of the given type to run at runAt, with payload as its
+// arguments. it is tried at most maxAttempts times
+func (m JobModel) Enqueue(jobType string, payload interface{}, runAt time.Time, maxAttempts int) (*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.EnqueueTx(ctx, m.DB, jobType, payload, runAt, maxAttempts)
+}
+
+// EnqueueTx() queues a job in the caller's transaction, so it is only run once the
+// changes it follows up on are committed
+func (m JobModel) EnqueueTx(ctx context.Context, db DBTX, jobType string, payload interface{}, runAt time.Time, maxAttempts int) (*Job, error) {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+		INSERT INTO jobs (type, payload, run_at, max_attempts)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + jobColumns
+	return scanJob(db.QueryRowContext(ctx, query, jobType, js, runAt, maxAttempts))
+}
+
+// Claim() takes up to limit jobs that are due and counts an attempt for each. a claimed
+// job is locked for lease, after which another worker may take it over, so it should
+// finish well within it. other workers skip the jobs being claimed instead of waiting
+func (m JobModel) Claim(limit int, lease time.Duration) ([]*Job, error) {
+	query := `
+		UPDATE jobs
+		SET status = 'running', attempts = attempts + 1,
+			locked_until = NOW() + $2 * INTERVAL '1 second', updated_at = NOW()
+		WHERE id IN (
+			SELECT id
+			FROM jobs
+			WHERE (status = 'pending' AND run_at <= NOW())
+			OR (status = 'running' AND locked_until < NOW())
+			ORDER BY run_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + jobColumns
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []*Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Complete() removes a job that ran successfully. it fails with ErrLeaseLost, and leaves
+// the job alone, when the job was claimed again since this attempt started
+func (m JobModel) Complete(job *Job) error {
+	query := `
+		DELETE FROM jobs
+		WHERE id = $1 AND attempts = $2 AND status = 'running'
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, job.ID, job.Attempts)
+	return leaseHeld(result, err)
+}
+
+// Retry() records a failed attempt at a job and queues it to run again at runAt
+func (m JobModel) Retry(job *Job, message string, runAt time.Time) error {
+	query := `
+		UPDATE jobs
+		SET status = 'pending', run_at = $4, locked_until = NULL, last_error = $3, updated_at = NOW()
+		WHERE id = $1 AND attempts = $2 AND status = 'running'
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, job.ID, job.Attempts, message, runAt)
+	return leaseHeld(result, err)
+}
+
+// Bury() records the last failed attempt at a job. the job is kept, dead, so it can be
+// looked into and requeued by hand
+func (m JobModel) Bury(job *Job, message string) error {
+	query := `
+		UPDATE jobs
+		SET status = 'dead', locked_until = NULL, last_error = $3, updated_at = NOW()
+		WHERE id = $1 AND attempts = $2 AND status = 'running'
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, job.ID, job.Attempts, message)
+	return leaseHeld(result, err)
+}
+
+// leaseHeld() turns an update of a claimed job that matched no row into ErrLeaseLost.
+// every claim counts an attempt, so the row only matches for the latest one
+func leaseHeld(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
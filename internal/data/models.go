@@ -3,8 +3,10 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
@@ -12,20 +14,73 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// DBTX is what *sql.DB and *sql.Tx have in common. methods that take one run their
+// queries in the caller's transaction when given one
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 // create a wrapper for our data models
 type Models struct {
-	Permissions PermissionModel
-	Photo       PhotoModel
-	Tokens      TokenModel
-	Users       UserModel
+	Blobs         BlobModel
+	Comments      CommentModel
+	Events        EventModel
+	Idempotency   IdempotencyModel
+	Jobs          JobModel
+	Notifications NotificationModel
+	Outbox        OutboxModel
+	Permissions   PermissionModel
+	Photo         PhotoModel
+	Reactions     ReactionModel
+	Renders       RenderModel
+	Revisions     PhotoRevisionModel
+	Tokens        TokenModel
+	Uploads       UploadModel
+	Users         UserModel
+	Watermarks    WatermarkModel
+	Webhooks      WebhookModel
+	db            *sql.DB
 }
 
 // NewModels() allows us to create a new models
 func NewModels(db *sql.DB) Models {
 	return Models{
-		Permissions: PermissionModel{DB: db},
-		Photo:       PhotoModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		Blobs:         BlobModel{DB: db},
+		Comments:      CommentModel{DB: db},
+		Events:        EventModel{DB: db},
+		Idempotency:   IdempotencyModel{DB: db},
+		Jobs:          JobModel{DB: db},
+		Notifications: NotificationModel{DB: db},
+		Outbox:        OutboxModel{DB: db},
+		Permissions:   PermissionModel{DB: db},
+		Photo:         PhotoModel{DB: db},
+		Reactions:     ReactionModel{DB: db},
+		Renders:       RenderModel{DB: db},
+		Revisions:     PhotoRevisionModel{DB: db},
+		Tokens:        TokenModel{DB: db},
+		Uploads:       UploadModel{DB: db},
+		Users:         UserModel{DB: db},
+		Watermarks:    WatermarkModel{DB: db},
+		Webhooks:      WebhookModel{DB: db},
+		db:            db,
+	}
+}
+
+// Transaction() runs fn in a transaction that is committed when fn returns nil. fn hands
+// tx to the methods that take a DBTX so their changes are committed or rolled back together
+func (m Models) Transaction(fn func(ctx context.Context, tx DBTX) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(ctx, tx)
+	if err != nil {
+		return err
 	}
+	return tx.Commit()
 }
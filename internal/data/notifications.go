@@ -0,0 +1,447 @@
+//Filename: internal/data/notifications.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the types of notification. each can be turned off in the feed and in digests
+const (
+	NotificationComment  = "comment"
+	NotificationReply    = "reply"
+	NotificationReaction = "reaction"
+	NotificationFavorite = "favorite"
+)
+
+var NotificationTypes = []string{NotificationComment, NotificationReply, NotificationReaction, NotificationFavorite}
+
+// how often unread notifications are emailed
+var DigestFrequencies = []string{"off", "daily", "weekly"}
+
+// a Notification tells UserID that ActorID did something to one of their photos or comments
+type Notification struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-"`
+	ActorID    int64      `json:"actor_id"`
+	Actor      string     `json:"actor"`
+	Type       string     `json:"type"`
+	PhotoID    int64      `json:"photo_id"`
+	PhotoTitle string     `json:"photo_title"`
+	CommentID  *int64     `json:"comment_id,omitempty"`
+	Emoji      *string    `json:"emoji,omitempty"`
+	ReadAt     *time.Time `json:"read_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Summary() describes the notification in a sentence, as used in digests
+func (n *Notification) Summary() string {
+	switch n.Type {
+	case NotificationComment:
+		return fmt.Sprintf("%s commented on %q", n.Actor, n.PhotoTitle)
+	case NotificationReply:
+		return fmt.Sprintf("%s replied to your comment on %q", n.Actor, n.PhotoTitle)
+	case NotificationReaction:
+		emoji := ""
+		if n.Emoji != nil {
+			emoji = " " + *n.Emoji
+		}
+		return fmt.Sprintf("%s reacted%s to %q", n.Actor, emoji, n.PhotoTitle)
+	default:
+		return fmt.Sprintf("%s added %q to their favorites", n.Actor, n.PhotoTitle)
+	}
+}
+
+// TypePreference says where notifications of a type are delivered
+type TypePreference struct {
+	InApp bool `json:"in_app"`
+	Email bool `json:"email"`
+}
+
+// NotificationPreferences are a user's settings for every notification type
+type NotificationPreferences struct {
+	Digest string                    `json:"digest"`
+	Types  map[string]TypePreference `json:"types"`
+}
+
+// ValidateNotificationPreferences() checks the settings of a user
+func ValidateNotificationPreferences(v *validator.Validator, prefs *NotificationPreferences) {
+	v.Check(validator.In(prefs.Digest, DigestFrequencies...), "digest", "must be off, daily or weekly")
+	for t := range prefs.Types {
+		v.Check(validator.In(t, NotificationTypes...), "types", fmt.Sprintf("%q is not a notification type", t))
+	}
+}
+
+// a Digest is the unread notifications to email to a user. Notifications holds
+// the newest of them, Total counts them all. Since is when the last digest went out,
+// or when the user signed up if none has
+type Digest struct {
+	UserID        int64
+	Email         string
+	Name          string
+	Frequency     string
+	Since         time.Time
+	Notifications []*Notification
+	Total         int
+}
+
+// define a NotificationModel which wraps a sql.db connection pool
+type NotificationModel struct {
+	DB *sql.DB
+}
+
+// notificationColumns is the select list read by scanNotification(). the query has
+// to join the actor as users and the photo as photos
+const notificationColumns = `notifications.id, notifications.user_id, notifications.actor_id, users.name,
+		notifications.type, notifications.photo_id, photos.title, notifications.comment_id, notifications.emoji,
+		notifications.read_at, notifications.created_at`
+
+// notificationFrom is the FROM clause notificationColumns is read from
+const notificationFrom = `
+		FROM notifications
+		INNER JOIN users ON users.id = notifications.actor_id
+		INNER JOIN photos ON photos.id = notifications.photo_id`
+
+// notificationShown is the condition leaving out the types the user ($1) turned off in the feed
+const notificationShown = `NOT EXISTS (
+			SELECT 1
+			FROM notification_preferences
+			WHERE user_id = $1 AND type = notifications.type AND NOT in_app
+		)`
+
+// notificationCurrent is the condition leaving out notifications about comments that have
+// been hidden or deleted since, and about photos the user can no longer see
+const notificationCurrent = `(notifications.comment_id IS NULL OR EXISTS (
+			SELECT 1
+			FROM comments
+			WHERE comments.id = notifications.comment_id
+			AND NOT comments.hidden
+			AND comments.deleted_at IS NULL
+		))
+		AND (photos.visibility = 'public' OR photos.user_id IS NULL OR photos.user_id = notifications.user_id)`
+
+// scanNotification() reads a row of notificationColumns
+func scanNotification(row interface{ Scan(...interface{}) error }) (*Notification, error) {
+	var n Notification
+	err := row.Scan(&n.ID, &n.UserID, &n.ActorID, &n.Actor, &n.Type, &n.PhotoID, &n.PhotoTitle, &n.CommentID, &n.Emoji, &n.ReadAt, &n.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &n, nil
+}
+
+// Insert() records a notification unless it is about the user's own doing or the
+// user has turned its type off everywhere
+func (m NotificationModel) Insert(n *Notification) error {
+	if n.UserID == n.ActorID {
+		return nil
+	}
+	query := `
+		INSERT INTO notifications (user_id, actor_id, type, photo_id, comment_id, emoji)
+		SELECT $1, $2, $3, $4, $5, $6
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM notification_preferences
+			WHERE user_id = $1 AND type = $3 AND NOT in_app AND NOT email
+		)
+		RETURNING id, created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, n.UserID, n.ActorID, n.Type, n.PhotoID, n.CommentID, n.Emoji).Scan(&n.ID, &n.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+// Get() returns a notification of the user
+func (m NotificationModel) Get(id int64, userID int64) (*Notification, error) {
+	query := `
+		SELECT ` + notificationColumns + notificationFrom + `
+		WHERE notifications.id = $1 AND notifications.user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return scanNotification(m.DB.QueryRowContext(ctx, query, id, userID))
+}
+
+// GetAll() returns the user's feed, newest first, without the types they turned off in the feed
+func (m NotificationModel) GetAll(userID int64, unreadOnly bool, filters Filters) ([]*Notification, Metadata, error) {
+	query := `
+		SELECT COUNT(*) OVER(), ` + notificationColumns + notificationFrom + `
+		WHERE notifications.user_id = $1
+		AND ` + notificationShown + `
+		AND (notifications.read_at IS NULL OR NOT $2)
+		ORDER BY notifications.id DESC
+		LIMIT $3 OFFSET $4
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, unreadOnly, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	notifications := []*Notification{}
+	for rows.Next() {
+		n, err := scanNotification(scanPrefix{row: rows, dest: []interface{}{&totalRecords}})
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		notifications = append(notifications, n)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return notifications, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// CountUnread() returns the number of unread notifications in the user's feed
+func (m NotificationModel) CountUnread(userID int64) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM notifications
+		WHERE notifications.user_id = $1
+		AND notifications.read_at IS NULL
+		AND ` + notificationShown
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var unread int
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&unread)
+	return unread, err
+}
+
+// scanPrefix scans dest from the first columns of row and the rest into what Scan() is given
+type scanPrefix struct {
+	row  interface{ Scan(...interface{}) error }
+	dest []interface{}
+}
+
+func (s scanPrefix) Scan(dest ...interface{}) error {
+	return s.row.Scan(append(s.dest, dest...)...)
+}
+
+// scanSuffix scans dest from the last columns of row and the rest into what Scan() is given
+type scanSuffix struct {
+	row  interface{ Scan(...interface{}) error }
+	dest []interface{}
+}
+
+func (s scanSuffix) Scan(dest ...interface{}) error {
+	return s.row.Scan(append(dest, s.dest...)...)
+}
+
+// SetRead() marks a notification of the user as read or unread
+func (m NotificationModel) SetRead(id int64, userID int64, read bool) error {
+	query := `
+		UPDATE notifications
+		SET read_at = CASE WHEN $3 THEN COALESCE(read_at, NOW()) END
+		WHERE id = $1 AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, userID, read)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// MarkAllRead() marks the user's unread notifications as read and returns how many there
+// were. upTo, when greater than zero, leaves out notifications newer than that id so
+// the ones that came in after the client last looked stay unread
+func (m NotificationModel) MarkAllRead(userID int64, upTo int64) (int64, error) {
+	query := `
+		UPDATE notifications
+		SET read_at = NOW()
+		WHERE user_id = $1 AND read_at IS NULL AND ($2 = 0 OR id <= $2)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, upTo)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetPreferences() returns the settings of a user, with the defaults filled in
+func (m NotificationModel) GetPreferences(userID int64) (*NotificationPreferences, error) {
+	prefs := &NotificationPreferences{Digest: "weekly", Types: make(map[string]TypePreference)}
+	for _, t := range NotificationTypes {
+		prefs.Types[t] = TypePreference{InApp: true, Email: true}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, `SELECT frequency FROM notification_digests WHERE user_id = $1`, userID).Scan(&prefs.Digest)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	query := `
+		SELECT type, in_app, email
+		FROM notification_preferences
+		WHERE user_id = $1
+	`
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t string
+		var pref TypePreference
+		if err := rows.Scan(&t, &pref.InApp, &pref.Email); err != nil {
+			return nil, err
+		}
+		prefs.Types[t] = pref
+	}
+	return prefs, rows.Err()
+}
+
+// SetPreferences() saves the settings of a user. types left out of prefs.Types keep theirs
+func (m NotificationModel) SetPreferences(userID int64, prefs *NotificationPreferences) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO notification_digests (user_id, frequency)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET frequency = EXCLUDED.frequency
+	`
+	_, err = tx.ExecContext(ctx, query, userID, prefs.Digest)
+	if err != nil {
+		return err
+	}
+	query = `
+		INSERT INTO notification_preferences (user_id, type, in_app, email)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, type) DO UPDATE SET in_app = EXCLUDED.in_app, email = EXCLUDED.email
+	`
+	for t, pref := range prefs.Types {
+		_, err = tx.ExecContext(ctx, query, userID, t, pref.InApp, pref.Email)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DueDigests() returns up to limit digests that are due, for users after the given id: the
+// user's last digest is a day or a week old and they have unread notifications since then.
+// a user who never had one counts from when they signed up. each digest holds up to
+// perDigest notifications
+func (m NotificationModel) DueDigests(after int64, limit int, perDigest int) ([]*Digest, error) {
+	//an hour short of a day or a week so the hourly run does not push every digest later
+	query := `
+		SELECT users.id, users.email, users.name, COALESCE(d.frequency, 'weekly'), COALESCE(d.last_sent_at, users.created_at)
+		FROM users
+		LEFT JOIN notification_digests d ON d.user_id = users.id
+		WHERE users.id > $1
+		AND users.activated
+		AND COALESCE(d.frequency, 'weekly') <> 'off'
+		AND COALESCE(d.last_sent_at, users.created_at) <= NOW() -
+			CASE d.frequency WHEN 'daily' THEN interval '23 hours' ELSE interval '167 hours' END
+		AND EXISTS (
+			SELECT 1
+			FROM notifications
+			INNER JOIN photos ON photos.id = notifications.photo_id
+			WHERE notifications.user_id = users.id
+			AND notifications.read_at IS NULL
+			AND notifications.created_at > COALESCE(d.last_sent_at, users.created_at)
+			AND ` + notificationCurrent + `
+		)
+		ORDER BY users.id
+		LIMIT $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	digests := []*Digest{}
+	for rows.Next() {
+		var d Digest
+		if err := rows.Scan(&d.UserID, &d.Email, &d.Name, &d.Frequency, &d.Since); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		digests = append(digests, &d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT COUNT(*) OVER(), ` + notificationColumns + notificationFrom + `
+		WHERE notifications.user_id = $1
+		AND notifications.read_at IS NULL
+		AND notifications.created_at > $2
+		AND NOT EXISTS (
+			SELECT 1
+			FROM notification_preferences
+			WHERE user_id = $1 AND type = notifications.type AND NOT email
+		)
+		AND ` + notificationCurrent + `
+		ORDER BY notifications.id DESC
+		LIMIT $3
+	`
+	for _, d := range digests {
+		rows, err := m.DB.QueryContext(ctx, query, d.UserID, d.Since, perDigest)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			n, err := scanNotification(scanPrefix{row: rows, dest: []interface{}{&d.Total}})
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			d.Notifications = append(d.Notifications, n)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
+
+// DigestSent() records that a digest went out, or had nothing to send, at sentAt
+func (m NotificationModel) DigestSent(userID int64, sentAt time.Time) error {
+	query := `
+		INSERT INTO notification_digests (user_id, last_sent_at)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET last_sent_at = EXCLUDED.last_sent_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, sentAt)
+	return err
+}
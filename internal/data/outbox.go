@@ -0,0 +1,136 @@
+//Filename: internal/data/outbox.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// an OutboxMessage is a change waiting to be published. it is written in the transaction
+// that makes the change, so it is published if and only if the change is committed.
+// UserID, when set, is the only user who may see it, OwnerID is the user it is about.
+// Event is the event the relay wrote the message to the log as, if it did
+type OutboxMessage struct {
+	ID          int64
+	Topic       string
+	AggregateID int64
+	PhotoID     *int64
+	UserID      *int64
+	OwnerID     *int64
+	Payload     json.RawMessage
+	CreatedAt   time.Time
+	Event       *Event
+}
+
+// define an OutboxModel which wraps a sql.db connection pool
+type OutboxModel struct {
+	DB *sql.DB
+}
+
+// addMessage() writes a message to the outbox in db, the transaction making the change.
+// payload is marshalled to JSON
+func addMessage(ctx context.Context, db DBTX, msg *OutboxMessage, payload interface{}) error {
+	js, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO outbox (topic, aggregate_id, photo_id, user_id, owner_id, payload)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+	_, err = db.ExecContext(ctx, query, msg.Topic, msg.AggregateID, msg.PhotoID, msg.UserID, msg.OwnerID, js)
+	return err
+}
+
+// addPhotoMessage() writes a change to a photo to the outbox. a private photo is only
+// seen by its owner
+func addPhotoMessage(ctx context.Context, db DBTX, topic string, photo *Photo) error {
+	msg := &OutboxMessage{Topic: topic, AggregateID: photo.ID, PhotoID: &photo.ID, OwnerID: photo.UserID}
+	if photo.Visibility == VisibilityPrivate {
+		msg.UserID = photo.UserID
+	}
+	return addMessage(ctx, db, msg, map[string]interface{}{"id": photo.ID, "version": photo.Version})
+}
+
+// addUserMessage() writes a change to a user, or to their tokens, to the outbox. only
+// the user sees it
+func addUserMessage(ctx context.Context, db DBTX, topic string, userID int64, payload interface{}) error {
+	msg := &OutboxMessage{Topic: topic, AggregateID: userID, UserID: &userID, OwnerID: &userID}
+	return addMessage(ctx, db, msg, payload)
+}
+
+// Relay() takes up to limit unpublished messages, oldest first, and hands them to publish
+// with the transaction they are locked in. they are marked published when publish
+// succeeds, and everything publish wrote in tx is committed with them. when it fails
+// nothing is, and the messages are relayed again later. one relay runs at a time across
+// every server and the others wait for it, so one batch is never published alongside
+// another. it returns how many it relayed
+func (m OutboxModel) Relay(limit int, publish func(ctx context.Context, tx DBTX, msgs []*OutboxMessage) error) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	//the lock is held until the messages are marked published and released with tx
+	_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('outbox'))`)
+	if err != nil {
+		return 0, err
+	}
+	query := `
+		SELECT id, topic, aggregate_id, photo_id, user_id, owner_id, payload, created_at
+		FROM outbox
+		WHERE published_at IS NULL
+		ORDER BY id
+		LIMIT $1
+	`
+	rows, err := tx.QueryContext(ctx, query, limit)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	msgs := []*OutboxMessage{}
+	ids := []int64{}
+	for rows.Next() {
+		var msg OutboxMessage
+		err := rows.Scan(&msg.ID, &msg.Topic, &msg.AggregateID, &msg.PhotoID, &msg.UserID, &msg.OwnerID, &msg.Payload, &msg.CreatedAt)
+		if err != nil {
+			return 0, err
+		}
+		msgs = append(msgs, &msg)
+		ids = append(ids, msg.ID)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	err = publish(ctx, tx, msgs)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE outbox SET published_at = NOW() WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return 0, err
+	}
+	return len(msgs), tx.Commit()
+}
+
+// DeletePublishedBefore() removes the messages published before the cutoff
+func (m OutboxModel) DeletePublishedBefore(cutoff time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM outbox WHERE published_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
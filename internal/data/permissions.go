@@ -60,16 +60,14 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
 	return permissions, nil
 }
 
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+// AddForUserTx() grants a user permissions in the caller's transaction
+func (m PermissionModel) AddForUserTx(ctx context.Context, db DBTX, userID int64, codes ...string) error {
 	query := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id
 		FROM permissions
 		WHERE permissions.code = ANY($2)
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	_, err := db.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/lib/pq"
+	"photoalbum.joelical.net/internal/imaging"
 	"photoalbum.joelical.net/internal/validator"
 )
 
@@ -20,7 +22,167 @@ type Photo struct {
 	Title       string    `json:"title"`
 	Photo       string    `json:"photo"`
 	Description string    `json:"description"`
-	Version     int32     `json:"version"`
+	Tags        []string  `json:"tags"`
+	Language    string    `json:"language"`
+	// UserID is the owner. photos created before owners were recorded have none
+	UserID      *int64     `json:"user_id"`
+	TakenAt     *time.Time `json:"taken_at"`
+	CameraModel string     `json:"camera_model"`
+	Album       string     `json:"album"`
+	Visibility  string     `json:"visibility"`
+	Latitude    *float64   `json:"latitude"`
+	Longitude   *float64   `json:"longitude"`
+	// TakenAtLocal is set when TakenAt is the camera's clock in a zone we don't know,
+	// stored as if it were UTC
+	TakenAtLocal bool `json:"taken_at_local"`
+	// ContentHash is the SHA-256 of the uploaded original, if there is one
+	ContentHash *string `json:"content_hash"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	// MediaType says if the photo is a still, a video or a live photo
+	MediaType  string `json:"media_type"`
+	DurationMS int64  `json:"duration_ms"`
+	Codec      string `json:"codec"`
+	// MotionHash is the clip of a live photo, PosterHash the poster frame of a video
+	MotionHash *string `json:"motion_hash"`
+	PosterHash *string `json:"poster_hash"`
+	// Palette holds the dominant colors as #rrggbb, most common first, see imaging.Palette().
+	// clients can show AverageColor while the image loads
+	Palette      []string `json:"palette"`
+	AverageColor *string  `json:"average_color"`
+	// BlurHash is a placeholder for grids to lay out with Width and Height before the image loads
+	BlurHash *string `json:"blurhash"`
+	// CommentsDisabled is set by the owner to stop new comments, see CommentModel
+	CommentsDisabled bool `json:"comments_disabled"`
+	// Favorites and Reactions count what everyone did. Favorited and Reactions[].Reacted say
+	// what the user asking did and are only set by ReactionModel.ForUser()
+	Favorites int       `json:"favorites"`
+	Favorited bool      `json:"favorited"`
+	Reactions Reactions `json:"reactions"`
+	// ReactionsVersion is bumped by every favorite and reaction, unlike Version
+	ReactionsVersion int32 `json:"-"`
+	// PHash is the perceptual hash of the original, see imaging.DHash()
+	PHash   *int64 `json:"-"`
+	Version int32  `json:"version"`
+	// Highlights is only set on listings searched with q
+	Highlights *PhotoHighlights `json:"highlights,omitempty"`
+}
+
+// the visibility a photo can have. private photos are only seen by their owner
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+)
+
+// the media types of a photo
+const (
+	MediaPhoto = "photo"
+	MediaVideo = "video"
+	MediaLive  = "live"
+)
+
+// the longest video (or live photo clip) we accept
+const MaxVideoDuration = 10 * time.Minute
+
+// PhotoMedia are the stored files of a photo. only a video has a poster and only a live photo has motion.
+// Unique stops the owner from having a second photo of the same original, see ErrDuplicateContent
+type PhotoMedia struct {
+	Original *Blob
+	Motion   *Blob
+	Poster   *Blob
+	Unique   bool
+	// UploadID names the resumable upload the photo is made from. the upload is finished
+	// in the photo's transaction, and Insert() fails with ErrEditConflict if it already was
+	UploadID string
+}
+
+// ErrDuplicateContent is returned by Insert() when PhotoMedia.Unique is set and the owner
+// already has a photo of the original
+var ErrDuplicateContent = errors.New("duplicate content")
+
+// photoColumns is the select list read by Photo.scanDest()
+const photoColumns = `photos.id, photos.created_at, photos.title, photos.photo, photos.description, photos.tags,
+		photos.language, photos.user_id, photos.taken_at, photos.taken_at_local, photos.camera_model, photos.album, photos.visibility,
+		photos.latitude, photos.longitude, photos.blob_hash, photos.width, photos.height,
+		photos.media_type, photos.duration_ms, photos.codec, photos.motion_blob_hash, photos.poster_blob_hash,
+		photos.palette, photos.average_color, photos.blurhash, photos.comments_disabled,
+		photos.favorites, photos.reaction_counts, photos.reactions_version, photos.version`
+
+// scanDest() returns the scan destinations for photoColumns
+func (photo *Photo) scanDest() []interface{} {
+	return []interface{}{
+		&photo.ID,
+		&photo.CreatedAt,
+		&photo.Title,
+		&photo.Photo,
+		&photo.Description,
+		pq.Array(&photo.Tags),
+		&photo.Language,
+		&photo.UserID,
+		&photo.TakenAt,
+		&photo.TakenAtLocal,
+		&photo.CameraModel,
+		&photo.Album,
+		&photo.Visibility,
+		&photo.Latitude,
+		&photo.Longitude,
+		&photo.ContentHash,
+		&photo.Width,
+		&photo.Height,
+		&photo.MediaType,
+		&photo.DurationMS,
+		&photo.Codec,
+		&photo.MotionHash,
+		&photo.PosterHash,
+		pq.Array(&photo.Palette),
+		&photo.AverageColor,
+		&photo.BlurHash,
+		&photo.CommentsDisabled,
+		&photo.Favorites,
+		&photo.Reactions,
+		&photo.ReactionsVersion,
+		&photo.Version,
+	}
+}
+
+// geohash() returns the geohash stored for the photo's location
+func (photo *Photo) geohash() interface{} {
+	if photo.Latitude == nil || photo.Longitude == nil {
+		return nil
+	}
+	return Geohash(*photo.Latitude, *photo.Longitude, 12)
+}
+
+// SetSummary() fills in what was worked out from the pixels of the photo
+func (photo *Photo) SetSummary(s imaging.Summary) {
+	phash := int64(s.PHash)
+	photo.PHash = &phash
+	photo.Palette = make([]string, len(s.Palette))
+	for i, c := range s.Palette {
+		photo.Palette[i] = imaging.Hex(c)
+	}
+	average := imaging.Hex(s.Average)
+	photo.AverageColor = &average
+	photo.BlurHash = &s.BlurHash
+}
+
+// VisibleTo() reports if a user may see the photo
+func (photo *Photo) VisibleTo(user *User) bool {
+	if photo.Visibility == VisibilityPublic || photo.UserID == nil {
+		return true
+	}
+	return !user.IsAnonymous() && *photo.UserID == user.ID
+}
+
+// OwnedBy() reports if the user owns the photo
+func (photo *Photo) OwnedBy(user *User) bool {
+	return photo.UserID != nil && !user.IsAnonymous() && *photo.UserID == user.ID
+}
+
+// EditableBy() reports if the user may change the photo, given they may write photos at
+// all. photos stored before photos had owners belong to nobody and stay open to every writer
+func (photo *Photo) EditableBy(user *User) bool {
+	return photo.OwnedBy(user) || (photo.UserID == nil && !user.IsAnonymous())
 }
 
 func ValidatePhoto(v *validator.Validator, photo *Photo) {
@@ -35,6 +197,25 @@ func ValidatePhoto(v *validator.Validator, photo *Photo) {
 	v.Check(photo.Description != "", "description", "must be provided")
 	v.Check(len(photo.Description) <= 800, "description", "must not be more than 800 bytes long")
 
+	v.Check(len(photo.Tags) <= 20, "tags", "must not contain more than 20 tags")
+	v.Check(validator.Unique(photo.Tags), "tags", "must not contain duplicate values")
+	for _, tag := range photo.Tags {
+		v.Check(tag != "", "tags", "must not contain empty tags")
+		v.Check(len(tag) <= 50, "tags", "must not contain tags longer than 50 bytes")
+	}
+
+	v.Check(validator.In(photo.Language, SearchLanguages...), "language", "is not a supported language")
+
+	v.Check(len(photo.CameraModel) <= 200, "camera_model", "must not be more than 200 bytes long")
+	v.Check(len(photo.Album) <= 200, "album", "must not be more than 200 bytes long")
+	v.Check(validator.In(photo.Visibility, VisibilityPublic, VisibilityPrivate), "visibility", "must be public or private")
+
+	ValidateLocation(v, photo.Latitude, photo.Longitude)
+
+	v.Check(validator.In(photo.MediaType, MediaPhoto, MediaVideo, MediaLive), "media_type", "must be photo, video or live")
+	v.Check(photo.DurationMS >= 0, "duration", "must not be negative")
+	v.Check(photo.DurationMS <= MaxVideoDuration.Milliseconds(), "duration", fmt.Sprintf("must not be longer than %s", MaxVideoDuration))
+
 }
 
 // define a ListModel which wraps a sql.db connection pool
@@ -43,23 +224,127 @@ type PhotoModel struct {
 }
 
 // Insert() allows us to create a new photo
-func (m PhotoModel) Insert(photo *Photo) error {
-	query := `
-		INSERT INTO photos (title, photo, description)
-		VALUES ($1, $2, $3)
-		RETURNING id, created_at, version
-	`
+func (m PhotoModel) Insert(photo *Photo, media PhotoMedia) error {
 	// Create a context. time starts when context is created
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	// cleanup to prevent memory leaks
 	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = m.InsertTx(ctx, tx, photo, media)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// InsertTx() creates a new photo in the caller's transaction.
+// uploaded files get a reference in the same transaction so they can't be collected under us
+func (m PhotoModel) InsertTx(ctx context.Context, tx DBTX, photo *Photo, media PhotoMedia) error {
+	query := `
+		INSERT INTO photos (title, photo, description, tags, language, user_id, taken_at, camera_model, album, visibility,
+			latitude, longitude, geohash, blob_hash, width, height, phash,
+			media_type, duration_ms, codec, motion_blob_hash, poster_blob_hash,
+			palette, average_color, palette_l, palette_a, palette_b, blurhash, taken_at_local, unique_content)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22,
+			$23, $24, $25, $26, $27, $28, $29, $30)
+		RETURNING id, created_at, version
+	`
+	for _, file := range []struct {
+		blob *Blob
+		hash **string
+	}{{media.Original, &photo.ContentHash}, {media.Motion, &photo.MotionHash}, {media.Poster, &photo.PosterHash}} {
+		if file.blob == nil {
+			continue
+		}
+		err := BlobModel{DB: m.DB}.acquire(ctx, tx, file.blob)
+		if err != nil {
+			return err
+		}
+		*file.hash = &file.blob.Hash
+	}
+
+	if photo.Palette == nil {
+		photo.Palette = []string{}
+	}
+	photo.Reactions = Reactions{}
+	l, a, b := photo.paletteLab()
 	// collect the data fields into a slice
 	args := []interface{}{
 		photo.Title,
 		photo.Photo,
 		photo.Description,
+		pq.Array(photo.Tags),
+		photo.Language,
+		photo.UserID,
+		photo.TakenAt,
+		photo.CameraModel,
+		photo.Album,
+		photo.Visibility,
+		photo.Latitude,
+		photo.Longitude,
+		photo.geohash(),
+		photo.ContentHash,
+		photo.Width,
+		photo.Height,
+		photo.PHash,
+		photo.MediaType,
+		photo.DurationMS,
+		photo.Codec,
+		photo.MotionHash,
+		photo.PosterHash,
+		pq.Array(photo.Palette),
+		photo.AverageColor,
+		l,
+		a,
+		b,
+		photo.BlurHash,
+		photo.TakenAtLocal,
+		media.Unique,
 	}
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&photo.ID, &photo.CreatedAt, &photo.Version)
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&photo.ID, &photo.CreatedAt, &photo.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "photos_user_id_blob_hash_unique_idx"`:
+			return ErrDuplicateContent
+		default:
+			return err
+		}
+	}
+	if media.UploadID != "" {
+		err = UploadModel{DB: m.DB}.finish(ctx, tx, media.UploadID, photo.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return addPhotoMessage(ctx, tx, "photo.created", photo)
+}
+
+// GetByContent() returns the oldest photo of a user with the given original
+func (m PhotoModel) GetByContent(userID int64, hash string) (*Photo, error) {
+	query := `
+		SELECT ` + photoColumns + `
+		FROM photos
+		WHERE user_id = $1 AND blob_hash = $2
+		ORDER BY id
+		LIMIT 1
+	`
+	var photo Photo
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, userID, hash).Scan(photo.scanDest()...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &photo, nil
 }
 
 // Get() allows us to get a specific photo
@@ -70,7 +355,7 @@ func (m PhotoModel) Get(id int64) (*Photo, error) {
 	}
 	//create the query
 	query := `
-		SELECT id, created_at, title, photo, description ,version
+		SELECT ` + photoColumns + `
 		FROM photos
 		WHERE id = $1
 	`
@@ -81,14 +366,7 @@ func (m PhotoModel) Get(id int64) (*Photo, error) {
 	//cleanup to prevent memory leaks
 	defer cancel()
 	//execute the query using QueryRowcontext
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&photo.ID,
-		&photo.CreatedAt,
-		&photo.Title,
-		&photo.Photo,
-		&photo.Description,
-		&photo.Version,
-	)
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(photo.scanDest()...)
 	//handle any errors
 	if err != nil {
 		//check the type of error
@@ -105,31 +383,98 @@ func (m PhotoModel) Get(id int64) (*Photo, error) {
 
 // Update() allows us to edit/alter a specific photo
 // optimistic locking on version #
-func (m PhotoModel) Update(photo *Photo) error {
-	//create a query using the newly updated data
+// the version being replaced is saved to photo_revisions in the same transaction
+func (m PhotoModel) Update(photo *Photo, changedBy int64) error {
+	//Create a context. time starts when context is created
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	//cleanup to prevent memory leaks
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	//rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+	err = m.update(ctx, tx, photo, changedBy)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// update() saves the current version of a photo as a revision and writes the new one inside a transaction
+func (m PhotoModel) update(ctx context.Context, tx *sql.Tx, photo *Photo, changedBy int64) error {
+	//copy the current version, with who wrote it, into the revision history. this also
+	//locks the row so no rows means someone else changed (or deleted) the photo first
 	query := `
+		INSERT INTO photo_revisions (photo_id, version, title, photo, description, changed_by, changed_at)
+		SELECT id, version, title, photo, description, ` + photoAuthorColumns + `
+		FROM photos
+		WHERE id = $1
+		AND version = $2
+		FOR UPDATE
+	`
+	var editor interface{}
+	if changedBy > 0 {
+		editor = changedBy
+	}
+	result, err := tx.ExecContext(ctx, query, photo.ID, photo.Version)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	//create a query using the newly updated data
+	query = `
 		UPDATE photos
 		SET title = $1,
 			photo = $2,
 			description = $3,
+			tags = $4,
+			language = $5,
+			taken_at = $6,
+			taken_at_local = $17,
+			camera_model = $7,
+			album = $8,
+			visibility = $9,
+			latitude = $10,
+			longitude = $11,
+			geohash = $12,
+			comments_disabled = $13,
+			updated_by = $16,
+			updated_at = NOW(),
 			version = version + 1
-		WHERE id = $4
-		AND version = $5 
+		WHERE id = $14
+		AND version = $15
 		RETURNING version
 	`
-	//Create a context. time starts when context is created
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	//cleanup to prevent memory leaks
-	defer cancel()
 	args := []interface{}{
 		photo.Title,
 		photo.Photo,
 		photo.Description,
+		pq.Array(photo.Tags),
+		photo.Language,
+		photo.TakenAt,
+		photo.CameraModel,
+		photo.Album,
+		photo.Visibility,
+		photo.Latitude,
+		photo.Longitude,
+		photo.geohash(),
+		photo.CommentsDisabled,
 		photo.ID,
 		photo.Version,
+		editor,
+		photo.TakenAtLocal,
 	}
 	//check for edit conflicts
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&photo.Version)
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&photo.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -138,59 +483,235 @@ func (m PhotoModel) Update(photo *Photo) error {
 			return err
 		}
 	}
-	return nil
+	return addPhotoMessage(ctx, tx, "photo.updated", photo)
 }
 
 // Delete() removes a specific photo
-func (m PhotoModel) Delete(id int64) error {
+// a version greater than zero only deletes the photo if it is still at that version.
+// the reference to its original is dropped in the same transaction, see BlobModel.Collect()
+func (m PhotoModel) Delete(id int64, version int32) error {
 	//check if the id exist
 	if id < 1 {
 		return ErrRecordNotFound
 	}
+	//Create a context. time starts when context is created
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	//cleanup to prevent memory leaks
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = m.delete(ctx, tx, id, version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// delete() removes a photo inside a transaction and releases its files.
+// it returns the hashes of the released blobs
+func (m PhotoModel) delete(ctx context.Context, tx *sql.Tx, id int64, version int32) ([]string, error) {
 	//create the delete query
 	query := `
 		DELETE FROM photos
 		WHERE id = $1
+		AND (version = $2 OR $2 = 0)
+		RETURNING blob_hash, motion_blob_hash, poster_blob_hash, user_id, visibility, version
 	`
+	//execute the query
+	var hashes [3]*string
+	deleted := Photo{ID: id}
+	err := tx.QueryRowContext(ctx, query, id, version).Scan(&hashes[0], &hashes[1], &hashes[2], &deleted.UserID, &deleted.Visibility, &deleted.Version)
+	if err != nil {
+		switch {
+		//zero rows were deleted
+		case errors.Is(err, sql.ErrNoRows) && version > 0:
+			return nil, ErrEditConflict
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	//the references are dropped by a trigger, which also covers photos deleted with their owner
+	released := []string{}
+	for _, hash := range hashes {
+		if hash != nil {
+			released = append(released, *hash)
+		}
+	}
+	err = addPhotoMessage(ctx, tx, "photo.deleted", &deleted)
+	if err != nil {
+		return nil, err
+	}
+	return released, nil
+}
 
-	//Create a context. time starts when context is created
+// SetPosterTx() replaces the poster frame of a video in the caller's transaction, if it
+// is still at the given version. it returns the hash of the poster it replaced, which
+// should be collected once the transaction is committed
+func (m PhotoModel) SetPosterTx(ctx context.Context, tx DBTX, photo *Photo, poster *Blob) (*string, error) {
+	var previous *string
+	query := `
+		SELECT poster_blob_hash
+		FROM photos
+		WHERE id = $1 AND version = $2
+		FOR UPDATE
+	`
+	err := tx.QueryRowContext(ctx, query, photo.ID, photo.Version).Scan(&previous)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrEditConflict
+		default:
+			return nil, err
+		}
+	}
+	blobs := BlobModel{DB: m.DB}
+	err = blobs.acquire(ctx, tx, poster)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		err = blobs.release(ctx, tx, *previous)
+		if err != nil {
+			return nil, err
+		}
+	}
+	query = `
+		UPDATE photos
+		SET poster_blob_hash = $2, version = version + 1
+		WHERE id = $1
+		RETURNING version
+	`
+	err = tx.QueryRowContext(ctx, query, photo.ID, poster.Hash).Scan(&photo.Version)
+	if err != nil {
+		return nil, err
+	}
+	photo.PosterHash = &poster.Hash
+	err = addPhotoMessage(ctx, tx, "photo.updated", photo)
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// WithoutBlurHash() returns up to limit photos after the given id that have an original
+// or a poster but no BlurHash, in id order. it walks the photos stored before BlurHashes
+func (m PhotoModel) WithoutBlurHash(after int64, limit int) ([]*Photo, error) {
+	query := `
+		SELECT ` + photoColumns + `
+		FROM photos
+		WHERE photos.id > $1
+		AND photos.blurhash IS NULL
+		AND (photos.blob_hash IS NOT NULL OR photos.poster_blob_hash IS NOT NULL)
+		ORDER BY photos.id
+		LIMIT $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	photos := []*Photo{}
+	for rows.Next() {
+		var photo Photo
+		err := rows.Scan(photo.scanDest()...)
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, &photo)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return photos, nil
+}
+
+// SaveSummary() stores the summary of a photo worked out after it was created, see
+// Photo.SetSummary(). the version is bumped so clients holding the photo refetch it
+func (m PhotoModel) SaveSummary(photo *Photo) error {
+	query := `
+		UPDATE photos
+		SET phash = $2, palette = $3, average_color = $4, palette_l = $5, palette_a = $6, palette_b = $7,
+			blurhash = $8, version = version + 1
+		WHERE id = $1
+		RETURNING version
+	`
+	l, a, b := photo.paletteLab()
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	//cleanup to prevent memory leaks
 	defer cancel()
-	//execute the query
-	result, err := m.DB.ExecContext(ctx, query, id)
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	//check how many rows affected by the delte operation. we will use the RowsAffected() on the result variable
-	rowsAffected, err := result.RowsAffected()
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, query, photo.ID, photo.PHash, pq.Array(photo.Palette), photo.AverageColor,
+		l, a, b, photo.BlurHash).Scan(&photo.Version)
 	if err != nil {
-		return err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
 	}
-	//check to see if zero rows were affected
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
+	err = addPhotoMessage(ctx, tx, "photo.updated", photo)
+	if err != nil {
+		return err
 	}
-	return nil
+	return tx.Commit()
 }
 
 // the GetAll() method returns a list of all the list sorted by id
-func (m PhotoModel) GetAll(title string, photo string, description string, filters Filters) ([]*Photo, Metadata, error) {
+// pages are selected either by page number or by a cursor from an earlier page
+func (m PhotoModel) GetAll(search PhotoSearch, filters Filters) ([]*Photo, Metadata, error) {
+	var c *cursor
+	if filters.Cursor != "" {
+		var err error
+		c, err = decodeCursor(filters.Cursor)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
+	//the search conditions are shared by the page query and the count query
+	args := []interface{}{}
+	from := search.from(&args)
+	where := search.where(&args)
+	searchWhere, searchArgs := where, len(args)
+
+	backward := c != nil && c.Backward
+	offset := filters.offset()
+	if c != nil {
+		//keyset pagination starts right after the cursor row instead of skipping rows
+		args = append(args, c.Key, c.ID)
+		where += "\n\t\tAND " + filters.keysetCondition(backward, fmt.Sprintf("$%d", len(args)-1), fmt.Sprintf("$%d", len(args)))
+		offset = 0
+	}
+	//the window count is only right when we are not skipping rows with a cursor
+	total := "0"
+	if c == nil && !filters.SkipTotal {
+		total = "COUNT(*) OVER()"
+	}
+	//fetch one extra row so we know if there is another page
+	args = append(args, filters.limit()+1, offset)
 	//construct the query to return all photos
 	query := fmt.Sprintf(`
-		SELECT COUNT(*) OVER(), id, created_at, title, photo, description, version
-		FROM photos
-		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) or $1 = '')
-		AND (to_tsvector('simple', photo) @@ plainto_tsquery('simple', $2) or $2 = '')
-		AND (to_tsvector('simple', description) @@ plainto_tsquery('simple', $3) or $3 = '')
-		ORDER BY %s %s, id ASC
-		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortOrder())
+		SELECT %s, %s::text, `+photoColumns+`,
+		%s
+		%s
+		%s
+		ORDER BY %s
+		LIMIT $%d OFFSET $%d`, total, filters.sortColumn(), search.highlights(), from, where, filters.orderBy(backward), len(args)-1, len(args))
 
 	//create a 3 second timeout context
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	//execute the query
-	args := []interface{}{title, photo, description, filters.limit(), filters.offset()}
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err
@@ -200,30 +721,73 @@ func (m PhotoModel) GetAll(title string, photo string, description string, filte
 	totalRecords := 0
 	// initialize an empty slce to hold the photo data
 	photos := []*Photo{}
+	sortKeys := []string{}
 	//iterate over the rows in the resultset
 	for rows.Next() {
 		var photo Photo
+		var sortKey string
+		var highlights PhotoHighlights
 		//scan the values from the row into photo
-		err := rows.Scan(
-			&totalRecords,
-			&photo.ID,
-			&photo.CreatedAt,
-			&photo.Title,
-			&photo.Photo,
-			&photo.Description,
-			&photo.Version,
-		)
+		dest := []interface{}{&totalRecords, &sortKey}
+		dest = append(dest, photo.scanDest()...)
+		dest = append(dest, &highlights.Title, &highlights.Description)
+		err := rows.Scan(dest...)
 		if err != nil {
 			return nil, Metadata{}, err
 		}
+		if search.Q != "" {
+			photo.Highlights = &highlights
+		}
 		//add the Photo to our slice
 		photos = append(photos, &photo)
+		sortKeys = append(sortKeys, sortKey)
 	}
 	//check for errors after looping through the resultset
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err
 	}
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	//drop the extra row
+	more := len(photos) > filters.limit()
+	if more {
+		photos = photos[:filters.limit()]
+		sortKeys = sortKeys[:filters.limit()]
+	}
+	//going backward the rows came back in reverse order
+	if backward {
+		for i, j := 0, len(photos)-1; i < j; i, j = i+1, j-1 {
+			photos[i], photos[j] = photos[j], photos[i]
+			sortKeys[i], sortKeys[j] = sortKeys[j], sortKeys[i]
+		}
+	}
+
+	var metadata Metadata
+	switch {
+	case c == nil && !filters.SkipTotal:
+		metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	case c == nil:
+		metadata = Metadata{CurrentPage: filters.Page, PageSize: filters.PageSize, FirstPage: 1}
+	default:
+		metadata = Metadata{PageSize: filters.PageSize}
+		if !filters.SkipTotal {
+			//rows before the cursor are not in the page query, so count separately
+			err = m.DB.QueryRowContext(ctx, "SELECT COUNT(*) "+from+"\n\t\t"+searchWhere, args[:searchArgs]...).Scan(&metadata.TotalRecords)
+			if err != nil {
+				return nil, Metadata{}, err
+			}
+		}
+	}
+	if len(photos) == 0 {
+		return photos, metadata, nil
+	}
+	//there are rows after this page when we found an extra row, or when we came here backward
+	if more || backward {
+		last := len(photos) - 1
+		metadata.NextCursor = encodeCursor(cursor{Sort: filters.Sort, Key: sortKeys[last], ID: photos[last].ID})
+	}
+	//there are rows before this page unless this is the first page
+	if (c == nil && filters.Page > 1) || (c != nil && !backward) || (backward && more) {
+		metadata.PrevCursor = encodeCursor(cursor{Sort: filters.Sort, Key: sortKeys[0], ID: photos[0].ID, Backward: true})
+	}
 	//Returm the slice  of photos
 	return photos, metadata, nil
 }
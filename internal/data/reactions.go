@@ -0,0 +1,318 @@
+//Filename: internal/data/reactions.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// a Reaction is the number of people who reacted to a photo with an emoji.
+// Reacted says if the user asking is one of them
+type Reaction struct {
+	Emoji   string `json:"emoji"`
+	Count   int    `json:"count"`
+	Reacted bool   `json:"reacted"`
+}
+
+// Reactions are the reactions to a photo, most common first
+type Reactions []Reaction
+
+// Scan() reads the reaction_counts column, a JSON object of emoji to count
+func (rs *Reactions) Scan(src interface{}) error {
+	b, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into Reactions", src)
+	}
+	var counts map[string]int
+	if err := json.Unmarshal(b, &counts); err != nil {
+		return err
+	}
+	*rs = Reactions{}
+	for emoji, count := range counts {
+		*rs = append(*rs, Reaction{Emoji: emoji, Count: count})
+	}
+	sort.Slice(*rs, func(i, j int) bool {
+		a, b := (*rs)[i], (*rs)[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Emoji < b.Emoji
+	})
+	return nil
+}
+
+// extendedPictographic holds the code points with the Extended_Pictographic property
+// (see unicode.org/Public/emoji/latest/emoji-data.txt), which every emoji starts from
+var extendedPictographic = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x00A9, 0x00AE, 5}, {0x203C, 0x2049, 13}, {0x2122, 0x2139, 23}, {0x2194, 0x2199, 1},
+		{0x21A9, 0x21AA, 1}, {0x231A, 0x231B, 1}, {0x2328, 0x2388, 96}, {0x23CF, 0x23CF, 1},
+		{0x23E9, 0x23F3, 1}, {0x23F8, 0x23FA, 1}, {0x24C2, 0x24C2, 1}, {0x25AA, 0x25AB, 1},
+		{0x25B6, 0x25C0, 10}, {0x25FB, 0x25FE, 1}, {0x2600, 0x2605, 1}, {0x2607, 0x2612, 1},
+		{0x2614, 0x2685, 1}, {0x2690, 0x2705, 1}, {0x2708, 0x2712, 1}, {0x2714, 0x2716, 2},
+		{0x271D, 0x2721, 4}, {0x2728, 0x2728, 1}, {0x2733, 0x2734, 1}, {0x2744, 0x2747, 3},
+		{0x274C, 0x274E, 2}, {0x2753, 0x2755, 1}, {0x2757, 0x2757, 1}, {0x2763, 0x2767, 1},
+		{0x2795, 0x2797, 1}, {0x27A1, 0x27B0, 15}, {0x27BF, 0x27BF, 1}, {0x2934, 0x2935, 1},
+		{0x2B05, 0x2B07, 1}, {0x2B1B, 0x2B1C, 1}, {0x2B50, 0x2B55, 5}, {0x3030, 0x303D, 13},
+		{0x3297, 0x3299, 2},
+	},
+	R32: []unicode.Range32{
+		{0x1F000, 0x1F0FF, 1}, {0x1F10D, 0x1F10F, 1}, {0x1F12F, 0x1F12F, 1}, {0x1F16C, 0x1F171, 1},
+		{0x1F17E, 0x1F17F, 1}, {0x1F18E, 0x1F18E, 1}, {0x1F191, 0x1F19A, 1}, {0x1F1AD, 0x1F1E5, 1},
+		{0x1F201, 0x1F20F, 1}, {0x1F21A, 0x1F22F, 21}, {0x1F232, 0x1F23A, 1}, {0x1F23C, 0x1F23F, 1},
+		{0x1F249, 0x1F3FA, 1}, {0x1F400, 0x1F53D, 1}, {0x1F546, 0x1F64F, 1}, {0x1F680, 0x1F6FF, 1},
+		{0x1F774, 0x1F77F, 1}, {0x1F7D5, 0x1F7FF, 1}, {0x1F80C, 0x1F80F, 1}, {0x1F848, 0x1F84F, 1},
+		{0x1F85A, 0x1F85F, 1}, {0x1F888, 0x1F88F, 1}, {0x1F8AE, 0x1F8FF, 1}, {0x1F90C, 0x1F93A, 1},
+		{0x1F93C, 0x1F945, 1}, {0x1F947, 0x1FAFF, 1}, {0x1FC00, 0x1FFFD, 1},
+	},
+	LatinOffset: 1,
+}
+
+// emojiComponents holds the code points that modify or join pictographs: the zero width
+// joiner, variation selectors, the keycap mark, skin tones, regional indicators (which
+// make flags in pairs) and tags (which make the flags of regions such as Scotland)
+var emojiComponents = &unicode.RangeTable{
+	R16: []unicode.Range16{{0x200D, 0x200D, 1}, {0x20E3, 0x20E3, 1}, {0xFE0E, 0xFE0F, 1}},
+	R32: []unicode.Range32{{0x1F1E6, 0x1F1FF, 1}, {0x1F3FB, 0x1F3FF, 1}, {0xE0020, 0xE007F, 1}},
+}
+
+// ValidateEmoji() checks that a reaction is an emoji: pictographs and the code points that
+// join or modify them, a flag, or a keycap such as 1️⃣, whose base is a digit, # or *
+func ValidateEmoji(v *validator.Validator, emoji string) {
+	v.Check(emoji != "", "emoji", "must be provided")
+	v.Check(len(emoji) <= 32, "emoji", "must not be more than 32 bytes long")
+	v.Check(isEmoji(emoji), "emoji", "must be an emoji")
+}
+
+// isEmoji() reports if s is made of emoji code points and has a pictograph, a keycap or a
+// pair of regional indicators among them
+func isEmoji(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	runes := []rune(s)
+	bases, regions := 0, 0
+	for i, r := range runes {
+		switch {
+		case unicode.Is(extendedPictographic, r):
+			bases++
+		case r >= '0' && r <= '9' || r == '#' || r == '*':
+			//a keycap base must be followed by the keycap mark, perhaps after a variation selector
+			next := i + 1
+			if next < len(runes) && runes[next] == 0xFE0F {
+				next++
+			}
+			if next == len(runes) || runes[next] != 0x20E3 {
+				return false
+			}
+			bases++
+		case r >= 0x1F1E6 && r <= 0x1F1FF:
+			regions++
+		case unicode.Is(emojiComponents, r):
+		default:
+			return false
+		}
+	}
+	return bases > 0 || regions >= 2
+}
+
+// define a ReactionModel which wraps a sql.db connection pool
+type ReactionModel struct {
+	DB *sql.DB
+}
+
+// toggle() runs change against a photo in a transaction holding the photo's row lock,
+// so concurrent toggles of the same photo are counted one after the other.
+// change reports if it changed anything, and only then is count run on the photo.
+// toggle() returns what change reported
+func (m ReactionModel) toggle(photoID int64, change func(ctx context.Context, tx *sql.Tx) (bool, error), count string, args ...interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(ctx, `SELECT id FROM photos WHERE id = $1 FOR UPDATE`, photoID).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, ErrRecordNotFound
+		default:
+			return false, err
+		}
+	}
+	changed, err := change(ctx, tx)
+	if err != nil || !changed {
+		return false, err
+	}
+	query := `
+		UPDATE photos
+		SET ` + count + `, reactions_version = reactions_version + 1
+		WHERE id = $1
+		RETURNING user_id, visibility, version
+	`
+	photo := Photo{ID: photoID}
+	err = tx.QueryRowContext(ctx, query, append([]interface{}{photoID}, args...)...).Scan(&photo.UserID, &photo.Visibility, &photo.Version)
+	if err != nil {
+		return false, err
+	}
+	err = addPhotoMessage(ctx, tx, "photo.updated", &photo)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// execChange() returns a change for toggle() running a statement that changes one row or none
+func execChange(query string, args ...interface{}) func(ctx context.Context, tx *sql.Tx) (bool, error) {
+	return func(ctx context.Context, tx *sql.Tx) (bool, error) {
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return false, err
+		}
+		rowsAffected, err := result.RowsAffected()
+		return rowsAffected > 0, err
+	}
+}
+
+// Favorite() adds a photo to the user's favorites and reports if it was not there yet
+func (m ReactionModel) Favorite(photoID int64, userID int64) (bool, error) {
+	change := execChange(`
+		INSERT INTO favorites (user_id, photo_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, userID, photoID)
+	return m.toggle(photoID, change, `favorites = favorites + 1`)
+}
+
+// Unfavorite() removes a photo from the user's favorites and reports if it was there
+func (m ReactionModel) Unfavorite(photoID int64, userID int64) (bool, error) {
+	change := execChange(`
+		DELETE FROM favorites
+		WHERE user_id = $1 AND photo_id = $2
+	`, userID, photoID)
+	return m.toggle(photoID, change, `favorites = favorites - 1`)
+}
+
+// React() adds the user's reaction to a photo and reports if it is new.
+// reacting twice with the same emoji counts once
+func (m ReactionModel) React(photoID int64, userID int64, emoji string) (bool, error) {
+	change := execChange(`
+		INSERT INTO reactions (photo_id, user_id, emoji)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`, photoID, userID, emoji)
+	count := `reaction_counts = jsonb_set(reaction_counts, ARRAY[$2], to_jsonb(COALESCE((reaction_counts->>$2)::integer, 0) + 1))`
+	return m.toggle(photoID, change, count, emoji)
+}
+
+// Unreact() removes the user's reaction to a photo and reports if there was one. an emoji nobody
+// reacts with any more is dropped from the counts
+func (m ReactionModel) Unreact(photoID int64, userID int64, emoji string) (bool, error) {
+	change := execChange(`
+		DELETE FROM reactions
+		WHERE photo_id = $1 AND user_id = $2 AND emoji = $3
+	`, photoID, userID, emoji)
+	count := `reaction_counts = CASE
+			WHEN (reaction_counts->>$2)::integer > 1
+			THEN jsonb_set(reaction_counts, ARRAY[$2], to_jsonb((reaction_counts->>$2)::integer - 1))
+			ELSE reaction_counts - $2
+		END`
+	return m.toggle(photoID, change, count, emoji)
+}
+
+// ForUser() fills in which of the photos the user has favorited and reacted to
+func (m ReactionModel) ForUser(photos []*Photo, userID int64) error {
+	if len(photos) == 0 || userID == 0 {
+		return nil
+	}
+	ids := make([]int64, len(photos))
+	byID := make(map[int64]*Photo, len(photos))
+	for i, photo := range photos {
+		ids[i] = photo.ID
+		byID[photo.ID] = photo
+	}
+	query := `
+		SELECT photo_id, NULL
+		FROM favorites
+		WHERE user_id = $1 AND photo_id = ANY($2)
+		UNION ALL
+		SELECT photo_id, emoji
+		FROM reactions
+		WHERE user_id = $1 AND photo_id = ANY($2)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var photoID int64
+		var emoji *string
+		if err := rows.Scan(&photoID, &emoji); err != nil {
+			return err
+		}
+		photo := byID[photoID]
+		if emoji == nil {
+			photo.Favorited = true
+			continue
+		}
+		for i := range photo.Reactions {
+			if photo.Reactions[i].Emoji == *emoji {
+				photo.Reactions[i].Reacted = true
+			}
+		}
+	}
+	return rows.Err()
+}
+
+// GetFavorites() returns the user's favorite photos they can still see, the most
+// recently favorited first
+func (m ReactionModel) GetFavorites(userID int64, filters Filters) ([]*Photo, Metadata, error) {
+	query := `
+		SELECT COUNT(*) OVER(), ` + photoColumns + `
+		FROM photos
+		INNER JOIN favorites ON favorites.photo_id = photos.id
+		WHERE favorites.user_id = $1
+		AND (photos.visibility = 'public' OR photos.user_id = $1 OR photos.user_id IS NULL)
+		ORDER BY favorites.created_at DESC, photos.id DESC
+		LIMIT $2 OFFSET $3
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	photos := []*Photo{}
+	for rows.Next() {
+		var photo Photo
+		dest := append([]interface{}{&totalRecords}, photo.scanDest()...)
+		if err := rows.Scan(dest...); err != nil {
+			return nil, Metadata{}, err
+		}
+		photos = append(photos, &photo)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return photos, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
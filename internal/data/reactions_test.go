@@ -0,0 +1,48 @@
+//Filename: internal/data/reactions_test.go
+
+package data
+
+import (
+	"testing"
+
+	"photoalbum.joelical.net/internal/validator"
+)
+
+func TestValidateEmoji(t *testing.T) {
+	tests := []struct {
+		emoji string
+		valid bool
+	}{
+		{"👍", true},
+		{"👍🏽", true},
+		{"❤️", true},
+		{"❤", true},
+		{"©️", true},
+		{"👨‍👩‍👧", true},
+		{"🏳️‍🌈", true},
+		{"🇯🇵", true},
+		{"🏴\U000E0067\U000E0062\U000E0073\U000E0063\U000E0074\U000E007F", true},
+		{"1️⃣", true},
+		{"#️⃣", true},
+		{"*⃣", true},
+		{"", false},
+		{"日本語", false},
+		{"é", false},
+		{"a", false},
+		{"1", false},
+		{"#️", false},
+		{"👍a", false},
+		{"‍", false},
+		{"️", false},
+		{"🇯", false},
+		{"🏽", false},
+		{"\xf0\x9f\x91", false},
+		{"👍👍👍👍👍👍👍👍👍", false},
+	}
+	for _, tt := range tests {
+		v := validator.New()
+		if ValidateEmoji(v, tt.emoji); v.Valid() != tt.valid {
+			t.Errorf("ValidateEmoji(%q) valid = %t, want %t", tt.emoji, v.Valid(), tt.valid)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+//Filename: internal/data/renders.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the largest width or height a render may be asked for
+const MaxRenderSide = 4096
+
+// RenderOptions says how an original is turned into a render. Width or Height
+// may be 0 to follow the aspect ratio of the original
+type RenderOptions struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+	// Watermark is drawn over the render when set. it is chosen by the server, not the client
+	Watermark *Watermark
+}
+
+// ContentType() returns the media type of renders in the options' format
+func (o RenderOptions) ContentType() string {
+	return "image/" + o.Format
+}
+
+// Key() returns the storage key of the render of the blob with the given hash.
+// the quality only matters to JPEGs, so PNGs and WebPs, which are lossless, share one key whatever it is.
+// watermarked renders get a new key whenever the watermark changes
+func (o RenderOptions) Key(hash string) string {
+	suffix := ""
+	if o.Format == "jpeg" {
+		suffix = fmt.Sprintf("-q%d", o.Quality)
+	}
+	if o.Watermark != nil {
+		suffix += fmt.Sprintf("-wm%dv%d", o.Watermark.ID, o.Watermark.Version)
+	}
+	return fmt.Sprintf("renders/%s/%s/%dx%d-%s%s.%s", hash[:2], hash, o.Width, o.Height, o.Fit, suffix, o.Format)
+}
+
+// ValidateRenderOptions() checks the options of a render
+func ValidateRenderOptions(v *validator.Validator, o RenderOptions) {
+	v.Check(o.Width > 0 || o.Height > 0, "w", "w or h must be provided")
+	v.Check(o.Width >= 0 && o.Width <= MaxRenderSide, "w", fmt.Sprintf("must be between 0 and %d", MaxRenderSide))
+	v.Check(o.Height >= 0 && o.Height <= MaxRenderSide, "h", fmt.Sprintf("must be between 0 and %d", MaxRenderSide))
+	v.Check(validator.In(o.Fit, "cover", "contain"), "fit", "must be cover or contain")
+	v.Check(validator.In(o.Format, "jpeg", "png", "webp"), "fmt", "must be jpeg, png or webp")
+	v.Check(o.Quality >= 1 && o.Quality <= 100, "q", "must be between 1 and 100")
+}
+
+// a Render is a resized and re-encoded copy of a blob kept in the storage under Key
+type Render struct {
+	Key         string
+	BlobHash    string
+	WatermarkID *int64
+	Size        int64
+	ContentType string
+	CreatedAt   time.Time
+}
+
+// define a RenderModel which wraps a sql.db connection pool
+type RenderModel struct {
+	DB *sql.DB
+}
+
+// Get() returns the render stored under key
+func (m RenderModel) Get(key string) (*Render, error) {
+	query := `
+		SELECT key, blob_hash, watermark_id, size, content_type, created_at
+		FROM renders
+		WHERE key = $1
+	`
+	var render Render
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(&render.Key, &render.BlobHash, &render.WatermarkID, &render.Size, &render.ContentType, &render.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &render, nil
+}
+
+// Insert() records a stored render, replacing an earlier record of the same key.
+// it fails when the blob or the watermark has been removed in the meantime
+func (m RenderModel) Insert(render *Render) error {
+	query := `
+		INSERT INTO renders (key, blob_hash, watermark_id, size, content_type)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (key) DO UPDATE SET size = EXCLUDED.size, created_at = NOW()
+		RETURNING created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, render.Key, render.BlobHash, render.WatermarkID, render.Size, render.ContentType).Scan(&render.CreatedAt)
+}
+
+// Keys() returns the storage keys of every render of a blob
+func (m RenderModel) Keys(hash string) ([]string, error) {
+	query := `
+		SELECT key
+		FROM renders
+		WHERE blob_hash = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// DeleteWatermarked() forgets every render made with a watermark and returns their
+// storage keys so the files can be removed
+func (m RenderModel) DeleteWatermarked(watermarkID int64) ([]string, error) {
+	query := `
+		DELETE FROM renders
+		WHERE watermark_id = $1
+		RETURNING key
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, watermarkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,131 @@
+//Filename: internal/data/revisions.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// a PhotoRevision holds a version of a photo
+// ChangedBy/ChangedAt record who wrote this version and when
+type PhotoRevision struct {
+	PhotoID     int64     `json:"photo_id"`
+	Version     int32     `json:"version"`
+	Title       string    `json:"title"`
+	Photo       string    `json:"photo"`
+	Description string    `json:"description"`
+	ChangedBy   *int64    `json:"changed_by"`
+	ChangedAt   time.Time `json:"changed_at"`
+}
+
+// a FieldChange holds the value of a field in a revision and in the current photo
+type FieldChange struct {
+	Revision string `json:"revision"`
+	Current  string `json:"current"`
+}
+
+// Diff() lists the fields whose value in the revision differs from the current photo
+func (rev *PhotoRevision) Diff(photo *Photo) map[string]FieldChange {
+	changes := make(map[string]FieldChange)
+	if rev.Title != photo.Title {
+		changes["title"] = FieldChange{Revision: rev.Title, Current: photo.Title}
+	}
+	if rev.Photo != photo.Photo {
+		changes["photo"] = FieldChange{Revision: rev.Photo, Current: photo.Photo}
+	}
+	if rev.Description != photo.Description {
+		changes["description"] = FieldChange{Revision: rev.Description, Current: photo.Description}
+	}
+	return changes
+}
+
+// photoAuthorColumns select who wrote the current version of a photo and when. a photo
+// that was never edited was written by its owner when it was created
+const photoAuthorColumns = `CASE WHEN photos.updated_at IS NULL THEN photos.user_id ELSE photos.updated_by END,
+		COALESCE(photos.updated_at, photos.created_at)`
+
+// define a PhotoRevisionModel which wraps a sql.db connection pool
+type PhotoRevisionModel struct {
+	DB *sql.DB
+}
+
+// GetAll() returns every stored revision of a photo, newest first
+func (m PhotoRevisionModel) GetAll(photoID int64) ([]*PhotoRevision, error) {
+	query := `
+		SELECT photo_id, version, title, photo, description, changed_by, changed_at
+		FROM photo_revisions
+		WHERE photo_id = $1
+		ORDER BY version DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, photoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []*PhotoRevision{}
+	for rows.Next() {
+		var rev PhotoRevision
+		err := rows.Scan(
+			&rev.PhotoID,
+			&rev.Version,
+			&rev.Title,
+			&rev.Photo,
+			&rev.Description,
+			&rev.ChangedBy,
+			&rev.ChangedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &rev)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// Get() returns a specific version of a photo, the current one included
+func (m PhotoRevisionModel) Get(photoID int64, version int32) (*PhotoRevision, error) {
+	if photoID < 1 || version < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT photo_id, version, title, photo, description, changed_by, changed_at
+		FROM photo_revisions
+		WHERE photo_id = $1 AND version = $2
+		UNION ALL
+		SELECT photos.id, photos.version, photos.title, photos.photo, photos.description, ` + photoAuthorColumns + `
+		FROM photos
+		WHERE photos.id = $1 AND photos.version = $2
+	`
+	var rev PhotoRevision
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, photoID, version).Scan(
+		&rev.PhotoID,
+		&rev.Version,
+		&rev.Title,
+		&rev.Photo,
+		&rev.Description,
+		&rev.ChangedBy,
+		&rev.ChangedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &rev, nil
+}
@@ -0,0 +1,205 @@
+//Filename: internal/data/search.go
+
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the text search configurations a photo can be indexed and searched with
+var SearchLanguages = []string{"simple", "danish", "dutch", "english", "finnish", "french", "german", "italian", "portuguese", "spanish", "swedish"}
+
+// PhotoSearch holds the search terms accepted by the photo listing
+type PhotoSearch struct {
+	Title       string
+	Photo       string
+	Description string
+	// Q is searched against title, description and tags and can be ranked by relevance
+	Q string
+	// Language is the text search configuration used for Q
+	Language string
+	// the drill-down filters matching the facets
+	Tags        []string
+	Album       string
+	CameraModel string
+	Visibility  string
+	MediaType   string
+	// Taken is a capture year (2006) or month (2006-01)
+	Taken string
+	// BBox and Near limit the listing to photos taken in an area
+	BBox *BoundingBox
+	Near *Circle
+	// Color limits the listing to photos with a similar color in their palette
+	Color *ColorMatch
+	// Viewer is the id of the user listing the photos. private photos of other users are left out
+	Viewer int64
+}
+
+// TakenRX matches the year or year-month accepted by PhotoSearch.Taken
+var TakenRX = regexp.MustCompile(`^[0-9]{4}(-(0[1-9]|1[0-2]))?$`)
+
+// ValidatePhotoSearch() checks the search terms shared by the photo listings
+func ValidatePhotoSearch(v *validator.Validator, s PhotoSearch) {
+	v.Check(s.Q == "" || SearchTerms(s.Q) != "", "q", "must contain at least one word")
+	v.Check(validator.In(s.Language, SearchLanguages...), "lang", "is not a supported language")
+	v.Check(len(s.Tags) <= 20, "tags", "must not contain more than 20 tags")
+	v.Check(s.Visibility == "" || validator.In(s.Visibility, VisibilityPublic, VisibilityPrivate), "visibility", "must be public or private")
+	v.Check(s.MediaType == "" || validator.In(s.MediaType, MediaPhoto, MediaVideo, MediaLive), "media_type", "must be photo, video or live")
+	v.Check(s.Taken == "" || validator.Matches(s.Taken, TakenRX), "taken", "must be a year (2006) or a month (2006-01)")
+	if s.BBox != nil {
+		ValidateBoundingBox(v, "bbox", *s.BBox)
+	}
+	if s.Near != nil {
+		ValidateCircle(v, *s.Near)
+	}
+	if s.Color != nil {
+		ValidateColorMatch(v, *s.Color)
+	}
+}
+
+// PhotoHighlights holds the ts_headline() snippets for a photo matched by Q
+type PhotoHighlights struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+// SearchTerms() turns a search box string into to_tsquery() syntax.
+// all words must match, "quoted words" must appear next to each other,
+// a trailing * matches a prefix (for search-as-you-type) and a leading - excludes a word.
+// anything else is dropped so the result is always a valid tsquery
+func SearchTerms(q string) string {
+	var terms []string
+	for i, part := range strings.Split(q, `"`) {
+		//odd parts were inside quotes
+		if i%2 == 1 {
+			var phrase []string
+			for _, word := range strings.Fields(part) {
+				if lexeme := searchWord(word); lexeme != "" {
+					phrase = append(phrase, lexeme)
+				}
+			}
+			if len(phrase) > 0 {
+				terms = append(terms, "("+strings.Join(phrase, " <-> ")+")")
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			negate := strings.HasPrefix(word, "-")
+			prefix := strings.HasSuffix(word, "*")
+			lexeme := searchWord(word)
+			if lexeme == "" {
+				continue
+			}
+			if prefix {
+				lexeme += ":*"
+			}
+			if negate {
+				lexeme = "!" + lexeme
+			}
+			terms = append(terms, lexeme)
+		}
+	}
+	return strings.Join(terms, " & ")
+}
+
+// searchWord() keeps only the letters and digits of a word
+func searchWord(word string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, word)
+}
+
+// from() returns the FROM clause of a photo listing. with a Q the parsed query
+// is joined as q.query and its rank as r.relevance so both can be used anywhere in the query
+func (s PhotoSearch) from(args *[]interface{}) string {
+	if s.Q == "" {
+		return "FROM photos"
+	}
+	*args = append(*args, SearchTerms(s.Q), s.Language)
+	terms, language := len(*args)-1, len(*args)
+	//the simple configuration also matches words the language dictionary would drop or stem differently
+	return fmt.Sprintf(`FROM photos
+		CROSS JOIN (SELECT to_tsquery('simple', $%d) || to_tsquery($%d::regconfig, $%d) AS query) AS q
+		CROSS JOIN LATERAL (SELECT ts_rank_cd(photos.search, q.query) AS relevance) AS r`, terms, language, terms)
+}
+
+// where() returns the WHERE clause of a photo listing
+func (s PhotoSearch) where(args *[]interface{}) string {
+	conditions := []string{}
+	if s.Title != "" {
+		*args = append(*args, s.Title)
+		conditions = append(conditions, fmt.Sprintf("to_tsvector('simple', title) @@ plainto_tsquery('simple', $%d)", len(*args)))
+	}
+	if s.Photo != "" {
+		*args = append(*args, s.Photo)
+		conditions = append(conditions, fmt.Sprintf("to_tsvector('simple', photo) @@ plainto_tsquery('simple', $%d)", len(*args)))
+	}
+	if s.Description != "" {
+		*args = append(*args, s.Description)
+		conditions = append(conditions, fmt.Sprintf("to_tsvector('simple', description) @@ plainto_tsquery('simple', $%d)", len(*args)))
+	}
+	if s.Q != "" {
+		conditions = append(conditions, "photos.search @@ q.query")
+	}
+	if len(s.Tags) > 0 {
+		*args = append(*args, pq.Array(s.Tags))
+		conditions = append(conditions, fmt.Sprintf("photos.tags @> $%d", len(*args)))
+	}
+	if s.Album != "" {
+		*args = append(*args, s.Album)
+		conditions = append(conditions, fmt.Sprintf("photos.album = $%d", len(*args)))
+	}
+	if s.CameraModel != "" {
+		*args = append(*args, s.CameraModel)
+		conditions = append(conditions, fmt.Sprintf("photos.camera_model = $%d", len(*args)))
+	}
+	if s.Visibility != "" {
+		*args = append(*args, s.Visibility)
+		conditions = append(conditions, fmt.Sprintf("photos.visibility = $%d", len(*args)))
+	}
+	if s.MediaType != "" {
+		*args = append(*args, s.MediaType)
+		conditions = append(conditions, fmt.Sprintf("photos.media_type = $%d", len(*args)))
+	}
+	if s.Taken != "" {
+		//a year or a month both become a half open range so the taken_at index is used
+		format, step := "YYYY", "1 year"
+		if len(s.Taken) > 4 {
+			format, step = "YYYY-MM", "1 month"
+		}
+		*args = append(*args, s.Taken)
+		conditions = append(conditions, fmt.Sprintf("photos.taken_at >= to_date($%d, '%s') AND photos.taken_at < to_date($%d, '%s') + interval '%s'",
+			len(*args), format, len(*args), format, step))
+	}
+	if s.BBox != nil {
+		conditions = append(conditions, s.BBox.condition(args))
+	}
+	if s.Near != nil {
+		conditions = append(conditions, s.Near.condition(args))
+	}
+	if s.Color != nil {
+		conditions = append(conditions, s.Color.condition(args))
+	}
+	//private photos are only listed for their owner
+	*args = append(*args, s.Viewer)
+	conditions = append(conditions, fmt.Sprintf("(photos.visibility = 'public' OR photos.user_id IS NULL OR photos.user_id = $%d)", len(*args)))
+	return "WHERE " + strings.Join(conditions, "\n\t\tAND ")
+}
+
+// highlights() returns the select list for the title and description snippets
+func (s PhotoSearch) highlights() string {
+	if s.Q == "" {
+		return "'', ''"
+	}
+	return `ts_headline(photos.language, title, q.query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true'),
+		ts_headline(photos.language, description, q.query, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=20, MinWords=5')`
+}
@@ -0,0 +1,309 @@
+//Filename: internal/data/similar.go
+
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// thresholds up to this many bits are looked up through the phash band indexes.
+// two 64 bit hashes within 3 bits of each other always share one of the four 16 bit bands
+const bandedThreshold = 3
+
+// the Hamming distance between photos.phash and the hash in t.phash, in SQL
+const phashDistance = `length(replace(((photos.phash # t.phash)::bit(64))::text, '0', ''))`
+
+// ValidateThreshold() checks a Hamming distance threshold between two perceptual hashes
+func ValidateThreshold(v *validator.Validator, threshold int) {
+	v.Check(threshold >= 0, "threshold", "must not be negative")
+	v.Check(threshold <= 32, "threshold", "must be a maximum of 32")
+}
+
+// ValidateDuplicateThreshold() checks the threshold of a duplicate report, which only looks
+// through the band indexes
+func ValidateDuplicateThreshold(v *validator.Validator, threshold int) {
+	v.Check(threshold >= 0, "threshold", "must not be negative")
+	v.Check(threshold <= bandedThreshold, "threshold", fmt.Sprintf("must be a maximum of %d", bandedThreshold))
+}
+
+// a SimilarPhoto is a photo that looks like another one. Distance is the number
+// of bits their perceptual hashes differ by, 0 means they look the same
+type SimilarPhoto struct {
+	*Photo
+	Distance int `json:"distance"`
+}
+
+// Similar() returns the photos the viewer can see that are within threshold bits
+// of the given photo, closest first. photos without a hash have no similar photos
+func (m PhotoModel) Similar(id int64, viewer int64, threshold int, limit int) ([]*SimilarPhoto, error) {
+	args := []interface{}{id, threshold}
+	where := PhotoSearch{Viewer: viewer}.where(&args)
+	bands := ""
+	if threshold <= bandedThreshold {
+		bands = `AND (photos.phash_b0 = t.phash_b0 OR photos.phash_b1 = t.phash_b1
+			OR photos.phash_b2 = t.phash_b2 OR photos.phash_b3 = t.phash_b3)`
+	}
+	args = append(args, limit)
+	query := fmt.Sprintf(`
+		SELECT d.distance, `+photoColumns+`
+		FROM photos
+		CROSS JOIN (
+			SELECT phash, phash_b0, phash_b1, phash_b2, phash_b3
+			FROM photos
+			WHERE id = $1 AND phash IS NOT NULL
+		) AS t
+		CROSS JOIN LATERAL (SELECT %s AS distance) AS d
+		%s
+		AND photos.id <> $1
+		AND photos.phash IS NOT NULL
+		%s
+		AND d.distance <= $2
+		ORDER BY d.distance, photos.id
+		LIMIT $%d`, phashDistance, where, bands, len(args))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	similar := []*SimilarPhoto{}
+	for rows.Next() {
+		s := SimilarPhoto{Photo: &Photo{}}
+		err := rows.Scan(append([]interface{}{&s.Distance}, s.Photo.scanDest()...)...)
+		if err != nil {
+			return nil, err
+		}
+		similar = append(similar, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return similar, nil
+}
+
+// a DuplicateCandidate is a photo in a group of near duplicates
+type DuplicateCandidate struct {
+	ID     int64  `json:"id"`
+	Title  string `json:"title"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// Size is the size of the original in bytes
+	Size int64 `json:"size"`
+}
+
+// better() reports if c is a better copy to keep than other: more pixels,
+// then the bigger file, then the older photo
+func (c *DuplicateCandidate) better(other *DuplicateCandidate) bool {
+	if a, b := c.Width*c.Height, other.Width*other.Height; a != b {
+		return a > b
+	}
+	if c.Size != other.Size {
+		return c.Size > other.Size
+	}
+	return c.ID < other.ID
+}
+
+// a DuplicateGroup is a set of photos that look the same. Keep is the suggested photo to keep
+type DuplicateGroup struct {
+	Keep   int64                 `json:"keep"`
+	Photos []*DuplicateCandidate `json:"photos"`
+}
+
+// BestCandidate() returns the id of the photo worth keeping out of a group
+func BestCandidate(candidates []*DuplicateCandidate) int64 {
+	var best *DuplicateCandidate
+	for _, c := range candidates {
+		if best == nil || c.better(best) {
+			best = c
+		}
+	}
+	if best == nil {
+		return 0
+	}
+	return best.ID
+}
+
+// DuplicateCandidates() returns the hashed photos of a user. ids limits it to those photos
+func (m PhotoModel) DuplicateCandidates(userID int64, ids []int64) ([]*DuplicateCandidate, error) {
+	query := `
+		SELECT photos.id, photos.title, photos.width, photos.height, COALESCE(blobs.size, 0)
+		FROM photos
+		LEFT JOIN blobs ON blobs.hash = photos.blob_hash
+		WHERE photos.user_id = $1
+		AND photos.phash IS NOT NULL
+		AND (photos.id = ANY($2) OR $2 IS NULL)
+		ORDER BY photos.id
+	`
+	var filter interface{}
+	if ids != nil {
+		filter = pq.Array(ids)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []*DuplicateCandidate{}
+	for rows.Next() {
+		var c DuplicateCandidate
+		err := rows.Scan(&c.ID, &c.Title, &c.Width, &c.Height, &c.Size)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, &c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// Duplicates() groups the photos of a user whose hashes are within threshold bits of each
+// other. grouping is transitive, so a group may hold photos further apart than the threshold
+// when they are linked by photos in between. photos without duplicates are left out.
+// the pairs are found through the band indexes, so threshold must be at most bandedThreshold
+func (m PhotoModel) Duplicates(userID int64, threshold int) ([]*DuplicateGroup, error) {
+	//only photos sharing a band can be close enough, see bandedThreshold
+	query := `
+		SELECT a.id, b.id
+		FROM photos AS a
+		JOIN photos AS b ON b.user_id = a.user_id
+			AND b.id > a.id
+			AND b.phash IS NOT NULL
+			AND (b.phash_b0 = a.phash_b0 OR b.phash_b1 = a.phash_b1
+				OR b.phash_b2 = a.phash_b2 OR b.phash_b3 = a.phash_b3)
+		WHERE a.user_id = $1
+		AND a.phash IS NOT NULL
+		AND length(replace(((a.phash # b.phash)::bit(64))::text, '0', '')) <= $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pairs := [][2]int64{}
+	ids := []int64{}
+	seen := map[int64]bool{}
+	for rows.Next() {
+		var pair [2]int64
+		if err := rows.Scan(&pair[0], &pair[1]); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+		for _, id := range pair {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	duplicates := []*DuplicateGroup{}
+	if len(pairs) == 0 {
+		return duplicates, nil
+	}
+	candidates, err := m.DuplicateCandidates(userID, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	//union-find over the pairs
+	index := make(map[int64]int, len(candidates))
+	parent := make([]int, len(candidates))
+	for i, c := range candidates {
+		index[c.ID] = i
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for _, pair := range pairs {
+		i, iok := index[pair[0]]
+		j, jok := index[pair[1]]
+		//a photo deleted since the pairs were read
+		if !iok || !jok {
+			continue
+		}
+		parent[find(j)] = find(i)
+	}
+
+	//groups are listed in the order of their oldest photo
+	byRoot := map[int]*DuplicateGroup{}
+	groups := []*DuplicateGroup{}
+	for i, c := range candidates {
+		root := find(i)
+		group, ok := byRoot[root]
+		if !ok {
+			group = &DuplicateGroup{}
+			byRoot[root] = group
+			groups = append(groups, group)
+		}
+		group.Photos = append(group.Photos, c)
+	}
+	for _, group := range groups {
+		if len(group.Photos) > 1 {
+			group.Keep = BestCandidate(group.Photos)
+			duplicates = append(duplicates, group)
+		}
+	}
+	return duplicates, nil
+}
+
+// DeleteOwned() deletes photos of a user in one transaction. it fails with ErrRecordNotFound,
+// deleting nothing, if any of the photos is missing or belongs to someone else.
+// it returns the hashes of the released blobs, see BlobModel.Collect()
+func (m PhotoModel) DeleteOwned(userID int64, ids []int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	//lock the photos first so the ownership check holds until we commit
+	query := `
+		SELECT COUNT(*)
+		FROM (
+			SELECT id FROM photos
+			WHERE id = ANY($1) AND user_id = $2
+			FOR UPDATE
+		) AS owned
+	`
+	var owned int
+	err = tx.QueryRowContext(ctx, query, pq.Array(ids), userID).Scan(&owned)
+	if err != nil {
+		return nil, err
+	}
+	if owned != len(ids) {
+		return nil, ErrRecordNotFound
+	}
+	hashes := []string{}
+	for _, id := range ids {
+		released, err := m.delete(ctx, tx, id, 0)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, released...)
+	}
+	return hashes, tx.Commit()
+}
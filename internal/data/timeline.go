@@ -0,0 +1,235 @@
+//Filename: internal/data/timeline.go
+
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// the sizes a timeline bucket can have, with the layout of their keys
+var TimelineLayouts = map[string]string{
+	"day":   "2006-01-02",
+	"month": "2006-01",
+	"year":  "2006",
+}
+
+// postgres to_char() formats matching TimelineLayouts
+var timelineFormats = map[string]string{
+	"day":   "YYYY-MM-DD",
+	"month": "YYYY-MM",
+	"year":  "YYYY",
+}
+
+// Timeline holds the options of a timeline listing
+type Timeline struct {
+	Granularity string
+	Location    *time.Location
+	// At is the key of the newest bucket to return, used to jump through the timeline
+	At string
+	// Buckets is the number of buckets to return and Previews the number of photos in each
+	Buckets  int
+	Previews int
+}
+
+// ValidateTimeline() checks the timeline options
+func ValidateTimeline(v *validator.Validator, t Timeline) {
+	layout, ok := TimelineLayouts[t.Granularity]
+	v.Check(ok, "granularity", "must be day, month or year")
+	if ok && t.At != "" {
+		_, err := time.Parse(layout, t.At)
+		v.Check(err == nil, "at", "must be a "+t.Granularity+" formatted as "+layout)
+	}
+	v.Check(t.Buckets > 0, "buckets", "must be greater than zero")
+	v.Check(t.Buckets <= 100, "buckets", "must be a maxinum of 100")
+	v.Check(t.Previews >= 0, "previews", "must not be negative")
+	v.Check(t.Previews <= 20, "previews", "must be a maxinum of 20")
+}
+
+// end() returns the wall time the bucket keyed At ends at, as a postgres timestamp
+func (t Timeline) end() string {
+	start, _ := time.Parse(TimelineLayouts[t.Granularity], t.At)
+	switch t.Granularity {
+	case "day":
+		start = start.AddDate(0, 0, 1)
+	case "month":
+		start = start.AddDate(0, 1, 0)
+	default:
+		start = start.AddDate(1, 0, 0)
+	}
+	return start.Format("2006-01-02 15:04:05")
+}
+
+// timelineZones are the two kinds of photos on a timeline, with the zone their wall time is
+// read in. a capture time from EXIF without an offset is stored as the camera's wall time
+// in UTC, so it lands in the same bucket whichever zone the timeline is in. everything else
+// is an instant, read in the timeline's zone ($2). each kind is walked with the timeline
+// index on its own, so both are kept in the order of their wall time
+var timelineZones = []struct {
+	filter string
+	zone   string
+}{
+	{"photos.taken_at_local", "'UTC'"},
+	{"NOT photos.taken_at_local", "$2"},
+}
+
+// a TimelineBucket is a day, month or year with its photo count and a few of its photos
+type TimelineBucket struct {
+	Key      string   `json:"key"`
+	Count    int      `json:"count"`
+	Previews []*Photo `json:"previews"`
+}
+
+// Timeline() groups the photos matching the search into date buckets by capture time,
+// falling back to created_at, in the requested time zone. photos whose capture time has no
+// zone go by the camera's clock instead. buckets are newest first.
+// the key of the bucket following the last one is returned so the client can continue from it.
+// rather than grouping every matching photo, it walks back through the timeline index a
+// bucket at a time, so only the photos of the buckets returned are read
+func (m PhotoModel) Timeline(search PhotoSearch, timeline Timeline) ([]*TimelineBucket, string, error) {
+	args := []interface{}{timeline.Granularity, timeline.Location.String()}
+	from := search.from(&args)
+	where := search.where(&args)
+	first := ""
+	if timeline.At != "" {
+		args = append(args, timeline.end())
+		first = fmt.Sprintf("$%d::timestamp", len(args))
+	}
+	//one extra bucket tells us where the next page starts
+	args = append(args, timeline.Buckets+1, timeline.Previews)
+	//the wall time a photo was taken at, which puts it in its bucket
+	wall := `CASE WHEN photos.taken_at_local THEN photos.taken_at AT TIME ZONE 'UTC'
+				ELSE COALESCE(photos.taken_at, photos.created_at) AT TIME ZONE $2 END`
+	//compares when a photo was taken with a wall time, op is < or >=
+	taken := func(op, at string) string {
+		conds := []string{}
+		for _, z := range timelineZones {
+			conds = append(conds, fmt.Sprintf("(%s AND COALESCE(photos.taken_at, photos.created_at) %s (%s) AT TIME ZONE %s)", z.filter, op, at, z.zone))
+		}
+		return "(" + strings.Join(conds, " OR ") + ")"
+	}
+	//the bucket of the newest matching photo taken before a wall time, the newest of the
+	//newest photo of each kind
+	newest := func(end string) string {
+		arms := []string{}
+		for _, z := range timelineZones {
+			cond := ""
+			if end != "" {
+				cond = fmt.Sprintf("AND COALESCE(photos.taken_at, photos.created_at) < (%s) AT TIME ZONE %s", end, z.zone)
+			}
+			arms = append(arms, fmt.Sprintf(`(
+				SELECT date_trunc($1, COALESCE(photos.taken_at, photos.created_at) AT TIME ZONE %s)
+				%s
+				%s
+				AND %s
+				%s
+				ORDER BY COALESCE(photos.taken_at, photos.created_at) DESC
+				LIMIT 1
+			)`, z.zone, from, where, z.filter, cond))
+		}
+		return "GREATEST(" + strings.Join(arms, ", ") + ")"
+	}
+	//the matching photos taken during a bucket
+	during := fmt.Sprintf(`%s
+				%s
+				AND %s
+				AND %s`, from, where, taken(">=", "buckets.bucket"), taken("<", "buckets.bucket + ('1 ' || $1)::interval"))
+	query := fmt.Sprintf(`
+		WITH RECURSIVE buckets AS (
+			SELECT %s AS bucket, 1 AS n
+			UNION ALL
+			SELECT %s, buckets.n + 1
+			FROM buckets
+			WHERE buckets.bucket IS NOT NULL
+			AND buckets.n < $%d
+		)
+		SELECT to_char(buckets.bucket, '%s'),
+			(
+				SELECT COUNT(*)
+				%s
+			),
+			ARRAY(
+				SELECT photos.id
+				%s
+				ORDER BY %s DESC, photos.id DESC
+				LIMIT $%d
+			)
+		FROM buckets
+		WHERE buckets.bucket IS NOT NULL
+		ORDER BY buckets.bucket DESC`,
+		newest(first), newest("buckets.bucket"),
+		len(args)-1, timelineFormats[timeline.Granularity], during, during, wall, len(args))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	buckets := []*TimelineBucket{}
+	bucketIDs := [][]int64{}
+	for rows.Next() {
+		var bucket TimelineBucket
+		var ids []int64
+		err := rows.Scan(&bucket.Key, &bucket.Count, pq.Array(&ids))
+		if err != nil {
+			return nil, "", err
+		}
+		bucket.Previews = []*Photo{}
+		buckets = append(buckets, &bucket)
+		bucketIDs = append(bucketIDs, ids)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(buckets) > timeline.Buckets {
+		next = buckets[timeline.Buckets].Key
+		buckets = buckets[:timeline.Buckets]
+	}
+	//remember which bucket each preview belongs to
+	previews := map[int64]*TimelineBucket{}
+	ids := []int64{}
+	for i, bucket := range buckets {
+		for _, id := range bucketIDs[i] {
+			previews[id] = bucket
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return buckets, next, nil
+	}
+
+	//load the preview photos in one go, newest first like the buckets
+	query = `
+		SELECT ` + photoColumns + `
+		FROM photos
+		WHERE photos.id = ANY($1)
+		ORDER BY CASE WHEN photos.taken_at_local THEN photos.taken_at AT TIME ZONE 'UTC'
+			ELSE COALESCE(photos.taken_at, photos.created_at) AT TIME ZONE $2 END DESC, photos.id DESC
+	`
+	rows, err = m.DB.QueryContext(ctx, query, pq.Array(ids), timeline.Location.String())
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var photo Photo
+		err := rows.Scan(photo.scanDest()...)
+		if err != nil {
+			return nil, "", err
+		}
+		previews[photo.ID].Previews = append(previews[photo.ID].Previews, &photo)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return buckets, next, nil
+}
@@ -89,9 +89,23 @@ func (m TokenModel) Insert(token *Token) error {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	//the message never holds the token itself
+	payload := map[string]interface{}{"user_id": token.UserID, "scope": token.Scope, "expiry": token.Expiry}
+	err = addUserMessage(ctx, tx, "token.created", token.UserID, payload)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (m TokenModel) DeleteALlForUsers(scope string, userID int64) error {
@@ -101,8 +115,25 @@ func (m TokenModel) DeleteALlForUsers(scope string, userID int64) error {
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	_, err := m.DB.ExecContext(ctx, query, scope, userID)
-
-	return err
-
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, query, scope, userID)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		payload := map[string]interface{}{"user_id": userID, "scope": scope, "deleted": deleted}
+		err = addUserMessage(ctx, tx, "token.deleted", userID, payload)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
@@ -0,0 +1,238 @@
+//Filename: internal/data/uploads.go
+
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// an Upload is a resumable upload of an original. the bytes received so far are kept
+// in chunks, one for every PATCH, which are joined once all Length bytes have arrived.
+// ChunkKeys are the storage keys of the chunks in order
+type Upload struct {
+	ID        string
+	UserID    int64
+	Length    int64
+	Offset    int64
+	ChunkKeys []string
+	Metadata  map[string]string
+	// PhotoID is set once the upload has become a photo
+	PhotoID   *int64
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// NewUploadID() returns a random upload id
+func NewUploadID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewChunkKey() returns a storage key for a chunk starting at the upload's offset. every
+// request gets its own key, so requests sent at the same offset never share a file
+func (u *Upload) NewChunkKey() (string, error) {
+	token, err := NewUploadID()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("uploads/%s/%020d.%s", u.ID, u.Offset, token), nil
+}
+
+// DataKey() returns the storage key the chunks are joined into
+func (u *Upload) DataKey() string {
+	return "uploads/" + u.ID + "/data"
+}
+
+// Complete() reports if every byte has been received
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// define an UploadModel which wraps a sql.db connection pool
+type UploadModel struct {
+	DB *sql.DB
+}
+
+// Insert() creates an upload that expires after ttl unless more bytes arrive
+func (m UploadModel) Insert(upload *Upload, ttl time.Duration) error {
+	metadata, err := json.Marshal(upload.Metadata)
+	if err != nil {
+		return err
+	}
+	query := `
+		INSERT INTO uploads (id, user_id, length, metadata, expires_at)
+		VALUES ($1, $2, $3, $4, NOW() + $5 * interval '1 second')
+		RETURNING created_at, expires_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, upload.ID, upload.UserID, upload.Length, metadata, ttl.Seconds()).Scan(&upload.CreatedAt, &upload.ExpiresAt)
+}
+
+// uploadColumns is the select list read by scanUpload()
+const uploadColumns = `id, user_id, length, "offset", chunk_keys, metadata, photo_id, created_at, expires_at`
+
+// scanUpload() reads a row of uploadColumns
+func scanUpload(row interface{ Scan(...interface{}) error }) (*Upload, error) {
+	var upload Upload
+	var metadata []byte
+	err := row.Scan(&upload.ID, &upload.UserID, &upload.Length, &upload.Offset, pq.Array(&upload.ChunkKeys),
+		&metadata, &upload.PhotoID, &upload.CreatedAt, &upload.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(metadata, &upload.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// Get() returns an upload. expired uploads are still returned until they are cleaned up
+func (m UploadModel) Get(id string) (*Upload, error) {
+	query := `
+		SELECT ` + uploadColumns + `
+		FROM uploads
+		WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	upload, err := scanUpload(m.DB.QueryRowContext(ctx, query, id))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return upload, nil
+}
+
+// Append() records a chunk of n bytes stored under key at the upload's current offset and
+// pushes the expiry back by ttl. it fails with ErrEditConflict when another request got there first
+func (m UploadModel) Append(upload *Upload, key string, n int64, ttl time.Duration) error {
+	query := `
+		UPDATE uploads
+		SET "offset" = "offset" + $3,
+			chunk_keys = array_append(chunk_keys, $4),
+			expires_at = NOW() + $5 * interval '1 second'
+		WHERE id = $1
+		AND "offset" = $2
+		AND "offset" + $3 <= length
+		RETURNING "offset", chunk_keys, expires_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, upload.ID, upload.Offset, n, key, ttl.Seconds()).Scan(&upload.Offset, pq.Array(&upload.ChunkKeys), &upload.ExpiresAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Finish() records the photo a complete upload became. it fails with ErrEditConflict when
+// the upload already became a photo
+func (m UploadModel) Finish(upload *Upload, photoID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.finish(ctx, m.DB, upload.ID, photoID)
+	if err != nil {
+		return err
+	}
+	upload.PhotoID = &photoID
+	return nil
+}
+
+// finish() sets the photo of an upload that has none yet, see PhotoMedia.UploadID
+func (m UploadModel) finish(ctx context.Context, db DBTX, id string, photoID int64) error {
+	query := `
+		UPDATE uploads
+		SET photo_id = $2
+		WHERE id = $1
+		AND photo_id IS NULL
+	`
+	result, err := db.ExecContext(ctx, query, id, photoID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+	return nil
+}
+
+// Delete() removes an upload. its stored chunks must be removed by the caller
+func (m UploadModel) Delete(id string) error {
+	query := `
+		DELETE FROM uploads
+		WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetExpired() returns up to limit uploads that have expired, oldest first
+func (m UploadModel) GetExpired(limit int) ([]*Upload, error) {
+	query := `
+		SELECT ` + uploadColumns + `
+		FROM uploads
+		WHERE expires_at <= NOW()
+		ORDER BY expires_at
+		LIMIT $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uploads := []*Upload{}
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return uploads, nil
+}
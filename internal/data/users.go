@@ -99,8 +99,8 @@ type UserModel struct {
 	DB *sql.DB
 }
 
-// Insert/create a new user
-func (m UserModel) Insert(user *User) error {
+// InsertTx() creates a new user in the caller's transaction
+func (m UserModel) InsertTx(ctx context.Context, tx DBTX, user *User) error {
 	//create our query
 	query := `
 		INSERT INTO users (name, email, password_hash, activated)
@@ -114,10 +114,7 @@ func (m UserModel) Insert(user *User) error {
 		user.Password.hash,
 		user.Activated,
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err := tx.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
@@ -126,7 +123,12 @@ func (m UserModel) Insert(user *User) error {
 			return err
 		}
 	}
-	return nil
+	return addUserMessage(ctx, tx, "user.created", user.ID, user.message())
+}
+
+// message() is what the outbox messages about the user say. it leaves out the email
+func (user *User) message() map[string]interface{} {
+	return map[string]interface{}{"id": user.ID, "version": user.Version, "activated": user.Activated}
 }
 
 // Get users based on their email
@@ -161,6 +163,37 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+// Get a user by their id
+func (m UserModel) Get(id int64) (*User, error) {
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, version
+		FROM users
+		WHERE id = $1
+	`
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
 // The client can update their information
 func (m UserModel) Update(user *User) error {
 	query := `
@@ -180,16 +213,27 @@ func (m UserModel) Update(user *User) error {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(ctx, query, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
 		default:
 			return err
 		}
 	}
-	return nil
+	err = addUserMessage(ctx, tx, "user.updated", user.ID, user.message())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
@@ -0,0 +1,240 @@
+//Filename: internal/data/watermarks.go
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"photoalbum.joelical.net/internal/imaging"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+var ErrDuplicateWatermark = errors.New("duplicate watermark")
+
+// a Watermark is drawn on renders of a user's photos served to other people. one with an
+// Album applies to that album, one without to every album that has none of its own.
+// the logo, when there is one, is drawn instead of the text
+type Watermark struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"-"`
+	Album     *string   `json:"album"`
+	Text      string    `json:"text"`
+	LogoHash  *string   `json:"logo_hash,omitempty"`
+	Position  string    `json:"position"`
+	Opacity   float64   `json:"opacity"`
+	Scale     float64   `json:"scale"`
+	CreatedAt time.Time `json:"created_at"`
+	Version   int32     `json:"version"`
+}
+
+// ValidateWatermark() checks the settings of a watermark
+func ValidateWatermark(v *validator.Validator, wm *Watermark) {
+	if wm.Album != nil {
+		v.Check(*wm.Album != "", "album", "must not be empty, leave it out to cover every album")
+		v.Check(len(*wm.Album) <= 200, "album", "must not be more than 200 bytes long")
+	}
+	v.Check(len(wm.Text) <= 100, "text", "must not be more than 100 bytes long")
+	v.Check(validator.In(wm.Position, imaging.Positions...), "position", "must be top-left, top-right, bottom-left, bottom-right or center")
+	v.Check(wm.Opacity >= 0 && wm.Opacity <= 1, "opacity", "must be between 0 and 1")
+	v.Check(wm.Scale > 0 && wm.Scale <= 1, "scale", "must be greater than 0 and at most 1")
+}
+
+// define a WatermarkModel which wraps a sql.db connection pool
+type WatermarkModel struct {
+	DB *sql.DB
+}
+
+// watermarkColumns is the select list read by scanWatermark()
+const watermarkColumns = `id, user_id, album, text, logo_blob_hash, position, opacity, scale, created_at, version`
+
+// scanWatermark() reads a row of watermarkColumns
+func scanWatermark(row interface{ Scan(...interface{}) error }) (*Watermark, error) {
+	var wm Watermark
+	err := row.Scan(&wm.ID, &wm.UserID, &wm.Album, &wm.Text, &wm.LogoHash, &wm.Position, &wm.Opacity, &wm.Scale, &wm.CreatedAt, &wm.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &wm, nil
+}
+
+// Insert() creates a watermark. a user has one per album and one for every other album
+func (m WatermarkModel) Insert(wm *Watermark) error {
+	query := `
+		INSERT INTO watermarks (user_id, album, text, position, opacity, scale)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, wm.UserID, wm.Album, wm.Text, wm.Position, wm.Opacity, wm.Scale).Scan(&wm.ID, &wm.CreatedAt, &wm.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "watermarks_user_id_album_idx"`:
+			return ErrDuplicateWatermark
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Get() returns a watermark of the user
+func (m WatermarkModel) Get(id int64, userID int64) (*Watermark, error) {
+	query := `
+		SELECT ` + watermarkColumns + `
+		FROM watermarks
+		WHERE id = $1 AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return scanWatermark(m.DB.QueryRowContext(ctx, query, id, userID))
+}
+
+// GetAll() returns the watermarks of the user, the one for every album first
+func (m WatermarkModel) GetAll(userID int64) ([]*Watermark, error) {
+	query := `
+		SELECT ` + watermarkColumns + `
+		FROM watermarks
+		WHERE user_id = $1
+		ORDER BY album NULLS FIRST
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	watermarks := []*Watermark{}
+	for rows.Next() {
+		wm, err := scanWatermark(rows)
+		if err != nil {
+			return nil, err
+		}
+		watermarks = append(watermarks, wm)
+	}
+	return watermarks, rows.Err()
+}
+
+// ForAlbum() returns the watermark that applies to an album of the user
+func (m WatermarkModel) ForAlbum(userID int64, album string) (*Watermark, error) {
+	query := `
+		SELECT ` + watermarkColumns + `
+		FROM watermarks
+		WHERE user_id = $1 AND (album = $2 OR album IS NULL)
+		ORDER BY album NULLS LAST
+		LIMIT 1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return scanWatermark(m.DB.QueryRowContext(ctx, query, userID, album))
+}
+
+// Update() saves the settings of a watermark. it fails with ErrEditConflict when
+// the watermark changed since it was read
+func (m WatermarkModel) Update(wm *Watermark) error {
+	query := `
+		UPDATE watermarks
+		SET album = $3, text = $4, position = $5, opacity = $6, scale = $7, version = version + 1
+		WHERE id = $1 AND version = $2
+		RETURNING version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, wm.ID, wm.Version, wm.Album, wm.Text, wm.Position, wm.Opacity, wm.Scale).Scan(&wm.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case err.Error() == `pq: duplicate key value violates unique constraint "watermarks_user_id_album_idx"`:
+			return ErrDuplicateWatermark
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// SetLogo() replaces the logo of a watermark and returns the hash of the previous one,
+// which the caller should collect once nothing uses it
+func (m WatermarkModel) SetLogo(wm *Watermark, logo *Blob) (*string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var previous *string
+	query := `
+		SELECT logo_blob_hash
+		FROM watermarks
+		WHERE id = $1 AND version = $2
+		FOR UPDATE
+	`
+	err = tx.QueryRowContext(ctx, query, wm.ID, wm.Version).Scan(&previous)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrEditConflict
+		default:
+			return nil, err
+		}
+	}
+	blobs := BlobModel{DB: m.DB}
+	err = blobs.acquire(ctx, tx, logo)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		err = blobs.release(ctx, tx, *previous)
+		if err != nil {
+			return nil, err
+		}
+	}
+	query = `
+		UPDATE watermarks
+		SET logo_blob_hash = $2, version = version + 1
+		WHERE id = $1
+		RETURNING version
+	`
+	err = tx.QueryRowContext(ctx, query, wm.ID, logo.Hash).Scan(&wm.Version)
+	if err != nil {
+		return nil, err
+	}
+	wm.LogoHash = &logo.Hash
+	return previous, tx.Commit()
+}
+
+// Delete() removes a watermark of the user and returns the hash of its logo, which the
+// caller should collect once nothing uses it. the reference to the logo is dropped by the
+// watermarks_release_logo trigger, which also covers watermarks deleted with their user
+func (m WatermarkModel) Delete(id int64, userID int64) (*string, error) {
+	query := `
+		DELETE FROM watermarks
+		WHERE id = $1 AND user_id = $2
+		RETURNING logo_blob_hash
+	`
+	var logo *string
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(&logo)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return logo, nil
+}
@@ -0,0 +1,441 @@
+//Filename: internal/data/webhooks.go
+
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"photoalbum.joelical.net/internal/validator"
+)
+
+// a Webhook sends the events about a user's photos and notifications to a URL. every
+// request is signed with the secret. a webhook that keeps failing is disabled
+type Webhook struct {
+	ID         int64      `json:"id"`
+	UserID     int64      `json:"-"`
+	URL        string     `json:"url"`
+	Secret     string     `json:"-"`
+	Events     []string   `json:"events"`
+	Failures   int        `json:"failures"`
+	DisabledAt *time.Time `json:"disabled_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Version    int32      `json:"version"`
+}
+
+// GenerateWebhookSecret() returns a random secret for a webhook created without one
+func GenerateWebhookSecret() (string, error) {
+	randomBytes := make([]byte, 20)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// the shared address space carriers put between their customers and the internet
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// PublicIP() reports if ip is an address on the public internet. webhooks are not sent to
+// loopback, private, link-local (which holds the cloud metadata services) or other special
+// addresses, so they can't be used to reach the servers' own network
+func PublicIP(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
+}
+
+// publicHost() reports if every address of a host is public, see PublicIP(). a host
+// that can't be looked up is not
+func publicHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return PublicIP(ip)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return false
+	}
+	for _, addr := range addrs {
+		if !PublicIP(addr.IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateWebhook() checks the settings of a webhook. the host of the URL is looked up, it
+// has to be on the public internet. the addresses are checked again when sending, see PublicIP()
+func ValidateWebhook(v *validator.Validator, wh *Webhook) {
+	u, err := url.Parse(wh.URL)
+	v.Check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "url", "must be an http or https URL")
+	if err == nil && u.Hostname() != "" {
+		v.Check(publicHost(u.Hostname()), "url", "must have a host with public internet addresses")
+	}
+	v.Check(len(wh.URL) <= 2000, "url", "must not be more than 2000 bytes long")
+	v.Check(len(wh.Secret) >= 16, "secret", "must be at least 16 bytes long")
+	v.Check(len(wh.Secret) <= 200, "secret", "must not be more than 200 bytes long")
+	v.Check(len(wh.Events) > 0, "events", "must contain at least 1 event type")
+	v.Check(validator.Unique(wh.Events), "events", "must not contain duplicate values")
+	for _, e := range wh.Events {
+		v.Check(validator.In(e, EventTypes...), "events", "must only contain the types of events")
+	}
+}
+
+// a WebhookDelivery is an event queued for a webhook, and once sent the record of it.
+// EventID is the id of the outbox message it was queued from. ResponseCode and Error
+// describe the last attempt
+type WebhookDelivery struct {
+	ID            int64           `json:"id"`
+	WebhookID     int64           `json:"webhook_id"`
+	EventID       int64           `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	ResponseCode  *int            `json:"response_code"`
+	Error         *string         `json:"error"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+// a DueDelivery is a delivery claimed for sending, with where to send it
+type DueDelivery struct {
+	*WebhookDelivery
+	URL    string
+	Secret string
+}
+
+// define a WebhookModel which wraps a sql.db connection pool
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+// webhookColumns is the select list read by scanWebhook()
+const webhookColumns = `id, user_id, url, secret, events, failures, disabled_at, created_at, version`
+
+// scanWebhook() reads a row of webhookColumns
+func scanWebhook(row interface{ Scan(...interface{}) error }) (*Webhook, error) {
+	var wh Webhook
+	err := row.Scan(&wh.ID, &wh.UserID, &wh.URL, &wh.Secret, pq.Array(&wh.Events), &wh.Failures, &wh.DisabledAt, &wh.CreatedAt, &wh.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &wh, nil
+}
+
+// deliveryColumns is the select list read by scanDelivery()
+const deliveryColumns = `webhook_deliveries.id, webhook_deliveries.webhook_id, webhook_deliveries.event_id,
+	webhook_deliveries.event_type, webhook_deliveries.payload, webhook_deliveries.status,
+	webhook_deliveries.attempts, webhook_deliveries.next_attempt_at, webhook_deliveries.response_code,
+	webhook_deliveries.error, webhook_deliveries.created_at, webhook_deliveries.updated_at`
+
+// scanDelivery() reads a row of deliveryColumns
+func scanDelivery(row interface{ Scan(...interface{}) error }) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := row.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.ResponseCode, &d.Error, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &d, nil
+}
+
+// Insert() creates a webhook
+func (m WebhookModel) Insert(wh *Webhook) error {
+	query := `
+		INSERT INTO webhooks (user_id, url, secret, events)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, wh.UserID, wh.URL, wh.Secret, pq.Array(wh.Events)).Scan(&wh.ID, &wh.CreatedAt, &wh.Version)
+}
+
+// Get() returns a webhook of the user
+func (m WebhookModel) Get(id int64, userID int64) (*Webhook, error) {
+	query := `
+		SELECT ` + webhookColumns + `
+		FROM webhooks
+		WHERE id = $1 AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return scanWebhook(m.DB.QueryRowContext(ctx, query, id, userID))
+}
+
+// GetAll() returns the webhooks of the user, oldest first
+func (m WebhookModel) GetAll(userID int64) ([]*Webhook, error) {
+	query := `
+		SELECT ` + webhookColumns + `
+		FROM webhooks
+		WHERE user_id = $1
+		ORDER BY id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		wh, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return webhooks, rows.Err()
+}
+
+// Update() saves the settings of a webhook, including if it is disabled. it fails
+// with ErrEditConflict when the webhook changed since it was read
+func (m WebhookModel) Update(wh *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $3, secret = $4, events = $5, failures = $6, disabled_at = $7, version = version + 1
+		WHERE id = $1 AND version = $2
+		RETURNING version
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	args := []interface{}{wh.ID, wh.Version, wh.URL, wh.Secret, pq.Array(wh.Events), wh.Failures, wh.DisabledAt}
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&wh.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete() removes a webhook of the user along with its deliveries
+func (m WebhookModel) Delete(id int64, userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetDeliveries() returns a page of the deliveries of a webhook, newest first
+func (m WebhookModel) GetDeliveries(webhookID int64, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := `
+		SELECT COUNT(*) OVER(), ` + deliveryColumns + `
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, webhookID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(scanPrefix{row: rows, dest: []interface{}{&totalRecords}})
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return deliveries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// Redeliver() queues the event of a delivery to be sent again. the old delivery is
+// left in the log as it is
+func (m WebhookModel) Redeliver(deliveryID int64, webhookID int64) (*WebhookDelivery, error) {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+		SELECT webhook_id, event_id, event_type, payload
+		FROM webhook_deliveries
+		WHERE id = $1 AND webhook_id = $2
+		RETURNING ` + deliveryColumns
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return scanDelivery(m.DB.QueryRowContext(ctx, query, deliveryID, webhookID))
+}
+
+// Queue() queues a delivery of an event to every enabled webhook of the owner that
+// subscribes to its type. the payload carries the event's id, the one clients see over
+// SSE. it runs in db, so the deliveries are committed with the caller's transaction
+func (m WebhookModel) Queue(ctx context.Context, db DBTX, e *Event, ownerID int64) error {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+		SELECT id, $1, $2, jsonb_build_object(
+			'id', $1::bigint,
+			'type', $2::text,
+			'photo_id', $3::bigint,
+			'data', $4::jsonb,
+			'created_at', $5::timestamptz
+		)
+		FROM webhooks
+		WHERE user_id = $6
+		AND disabled_at IS NULL
+		AND $2 = ANY (events)
+	`
+	_, err := db.ExecContext(ctx, query, e.ID, e.Type, e.PhotoID, []byte(e.Data), e.CreatedAt, ownerID)
+	return err
+}
+
+// Due() claims up to limit deliveries whose next attempt is due, for webhooks that are
+// enabled. a claimed delivery is not due again until lease has passed, so a server
+// that stops while sending it leaves it to be retried, and other servers skip it
+func (m WebhookModel) Due(limit int, lease time.Duration) ([]*DueDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries
+		SET next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+		FROM webhooks
+		WHERE webhooks.id = webhook_deliveries.webhook_id
+		AND webhook_deliveries.id IN (
+			SELECT webhook_deliveries.id
+			FROM webhook_deliveries
+			INNER JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+			WHERE webhook_deliveries.status = 'pending'
+			AND webhook_deliveries.next_attempt_at <= NOW()
+			AND webhooks.disabled_at IS NULL
+			ORDER BY webhook_deliveries.next_attempt_at
+			LIMIT $1
+			FOR UPDATE OF webhook_deliveries SKIP LOCKED
+		)
+		RETURNING ` + deliveryColumns + `, webhooks.url, webhooks.secret
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	due := []*DueDelivery{}
+	for rows.Next() {
+		var dd DueDelivery
+		dd.WebhookDelivery, err = scanDelivery(scanSuffix{row: rows, dest: []interface{}{&dd.URL, &dd.Secret}})
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, &dd)
+	}
+	return due, rows.Err()
+}
+
+// Delivered() records a successful attempt. the webhook's count of failures in a row
+// starts over
+func (m WebhookModel) Delivered(d *WebhookDelivery, responseCode int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'delivered', attempts = attempts + 1, response_code = $2, error = NULL, updated_at = NOW()
+		WHERE id = $1
+	`
+	_, err = tx.ExecContext(ctx, query, d.ID, responseCode)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE webhooks SET failures = 0 WHERE id = $1`, d.WebhookID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Failed() records a failed attempt. the delivery is tried again at retryAt, or without
+// one it has failed for good. the webhook is disabled when this makes maxFailures
+// failures in a row, in which case disabled is true
+func (m WebhookModel) Failed(d *WebhookDelivery, responseCode *int, message string, retryAt *time.Time, maxFailures int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	query := `
+		UPDATE webhook_deliveries
+		SET status = CASE WHEN $4::timestamptz IS NULL THEN 'failed' ELSE 'pending' END,
+			next_attempt_at = COALESCE($4, next_attempt_at),
+			attempts = attempts + 1, response_code = $2, error = $3, updated_at = NOW()
+		WHERE id = $1
+	`
+	_, err = tx.ExecContext(ctx, query, d.ID, responseCode, message, retryAt)
+	if err != nil {
+		return false, err
+	}
+	query = `
+		UPDATE webhooks
+		SET failures = failures + 1,
+			disabled_at = CASE WHEN failures + 1 >= $2 AND disabled_at IS NULL THEN NOW() ELSE disabled_at END
+		WHERE id = $1
+		RETURNING disabled_at IS NOT NULL
+	`
+	var disabled bool
+	err = tx.QueryRowContext(ctx, query, d.WebhookID, maxFailures).Scan(&disabled)
+	if err != nil {
+		//the webhook was deleted while we sent to it
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return disabled, tx.Commit()
+}
+
+// DeleteOlderThan() trims the log to the deliveries that are pending or were last
+// attempted since the cutoff
+func (m WebhookModel) DeleteOlderThan(cutoff time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE status <> 'pending' AND updated_at < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,148 @@
+//Filename: internal/data/webhooks_test.go
+
+package data
+
+import (
+	"database/sql"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"photoalbum.joelical.net/internal/validator"
+)
+
+func TestPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fd00:ec2::254", false},
+		{"fe80::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := PublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("PublicIP(%s) = %t, want %t", tt.ip, got, tt.want)
+		}
+	}
+	if PublicIP(nil) {
+		t.Error("PublicIP(nil) = true, want false")
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://93.184.216.34/hook", true},
+		{"http://localhost:8080/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://10.0.0.5/hook", false},
+		{"ftp://93.184.216.34/hook", false},
+	}
+	for _, tt := range tests {
+		v := validator.New()
+		ValidateWebhook(v, &Webhook{URL: tt.url, Secret: "a-webhook-secret-0123", Events: []string{"photo.created"}})
+		_, invalid := v.Errors["url"]
+		if invalid == tt.valid {
+			t.Errorf("ValidateWebhook() with url %s: valid = %t, want %t (%v)", tt.url, !invalid, tt.valid, v.Errors)
+		}
+	}
+}
+
+// testDB() opens the migrated database named by PA_TEST_DB_DSN, or skips the test
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("PA_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("PA_TEST_DB_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestWebhookFailedDisables(t *testing.T) {
+	db := testDB(t)
+	m := WebhookModel{DB: db}
+
+	var userID int64
+	err := db.QueryRow(`
+		INSERT INTO users (name, email, password_hash, activated)
+		VALUES ('webhook test', 'webhook-test-' || md5(random()::text) || '@example.com', '\x00', true)
+		RETURNING id`).Scan(&userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM users WHERE id = $1`, userID) })
+
+	wh := &Webhook{UserID: userID, URL: "https://93.184.216.34/hook", Secret: "a-webhook-secret-0123", Events: []string{"photo.created"}}
+	if err = m.Insert(wh); err != nil {
+		t.Fatal(err)
+	}
+	d := &WebhookDelivery{WebhookID: wh.ID}
+	err = db.QueryRow(`
+		INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+		VALUES ($1, 1, 'photo.created', '{}')
+		RETURNING id`, wh.ID).Scan(&d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const maxFailures = 3
+	retryAt := time.Now().Add(time.Minute)
+	code := 500
+	for i := 1; i < maxFailures; i++ {
+		disabled, err := m.Failed(d, &code, "unexpected response status 500", &retryAt, maxFailures)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if disabled {
+			t.Fatalf("disabled after %d failures, want %d", i, maxFailures)
+		}
+	}
+
+	//a success starts the count over
+	if err = m.Delivered(d, 200); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= maxFailures; i++ {
+		disabled, err := m.Failed(d, &code, "unexpected response status 500", &retryAt, maxFailures)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if disabled != (i == maxFailures) {
+			t.Fatalf("after %d failures in a row disabled = %t, want %t", i, disabled, i == maxFailures)
+		}
+	}
+	got, err := m.Get(wh.ID, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DisabledAt == nil || got.Failures != maxFailures {
+		t.Errorf("webhook has failures = %d, disabled_at = %v, want %d failures and disabled", got.Failures, got.DisabledAt, maxFailures)
+	}
+}
@@ -0,0 +1,196 @@
+//Filename: internal/exif/exif.go
+
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var ErrNoExif = errors.New("exif: no exif data found")
+
+// Data holds the EXIF fields we care about. missing fields are left at their zero value.
+// TakenAtLocal is set when the file doesn't say which zone TakenAt is in, it is then the
+// camera's clock read as UTC
+type Data struct {
+	Model        string
+	TakenAt      *time.Time
+	TakenAtLocal bool
+	Latitude     *float64
+	Longitude    *float64
+}
+
+// the tags read from the image file directory (IFD) entries
+const (
+	tagModel            = 0x0110
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagOffsetOriginal   = 0x9011
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+)
+
+// Read() finds the EXIF segment of a JPEG and decodes it
+func Read(r io.Reader) (*Data, error) {
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xFF, 0xD8} {
+		return nil, ErrNoExif
+	}
+	//walk the segments until we find APP1 with an Exif header or reach the image data
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, ErrNoExif
+		}
+		if header[0] != 0xFF || header[1] == 0xDA {
+			return nil, ErrNoExif
+		}
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return nil, ErrNoExif
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, ErrNoExif
+		}
+		if header[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return Parse(segment[6:])
+		}
+	}
+}
+
+// Parse() decodes a TIFF structured EXIF block
+func Parse(tiff []byte) (*Data, error) {
+	if len(tiff) < 8 {
+		return nil, ErrNoExif
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, ErrNoExif
+	}
+	p := parser{tiff: tiff, order: order}
+	data := &Data{}
+
+	ifd0 := p.entries(order.Uint32(tiff[4:]))
+	if e, ok := ifd0[tagModel]; ok {
+		data.Model = p.ascii(e)
+	}
+	if e, ok := ifd0[tagExifIFD]; ok {
+		exifIFD := p.entries(p.long(e))
+		if e, ok := exifIFD[tagDateTimeOriginal]; ok {
+			//the timestamp is local time, the offset tag (when present) says which zone
+			layout, value := "2006:01:02 15:04:05", p.ascii(e)
+			o, zoned := exifIFD[tagOffsetOriginal]
+			if zoned {
+				layout, value = layout+"-07:00", value+p.ascii(o)
+			}
+			if t, err := time.Parse(layout, value); err == nil {
+				data.TakenAt = &t
+				data.TakenAtLocal = !zoned
+			}
+		}
+	}
+	if e, ok := ifd0[tagGPSIFD]; ok {
+		gps := p.entries(p.long(e))
+		data.Latitude = p.coordinate(gps[tagGPSLatitude], gps[tagGPSLatitudeRef], "S", 90)
+		data.Longitude = p.coordinate(gps[tagGPSLongitude], gps[tagGPSLongitudeRef], "W", 180)
+		if data.Latitude == nil || data.Longitude == nil {
+			data.Latitude, data.Longitude = nil, nil
+		}
+	}
+	return data, nil
+}
+
+// an entry is a single IFD entry
+type entry struct {
+	typ    uint16
+	count  uint32
+	offset []byte
+}
+
+// parser reads values out of the TIFF block, ignoring anything out of bounds
+type parser struct {
+	tiff  []byte
+	order binary.ByteOrder
+}
+
+// entries() reads the IFD at offset into a map keyed by tag
+func (p parser) entries(offset uint32) map[uint16]entry {
+	result := map[uint16]entry{}
+	if int(offset)+2 > len(p.tiff) {
+		return result
+	}
+	count := int(p.order.Uint16(p.tiff[offset:]))
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(p.tiff) {
+			break
+		}
+		raw := p.tiff[start : start+12]
+		result[p.order.Uint16(raw)] = entry{typ: p.order.Uint16(raw[2:]), count: p.order.Uint32(raw[4:]), offset: raw[8:12]}
+	}
+	return result
+}
+
+// value() returns the bytes of an entry. values of 4 bytes or less are stored in the entry itself
+func (p parser) value(e entry, size int) []byte {
+	n := int(e.count) * size
+	if n <= 4 {
+		return e.offset[:n]
+	}
+	start := int(p.order.Uint32(e.offset))
+	if n < 0 || start < 0 || start+n > len(p.tiff) {
+		return nil
+	}
+	return p.tiff[start : start+n]
+}
+
+func (p parser) ascii(e entry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(p.value(e, 1)), "\x00"))
+}
+
+func (p parser) long(e entry) uint32 {
+	return p.order.Uint32(e.offset)
+}
+
+// coordinate() turns degrees, minutes and seconds rationals into signed decimal degrees
+func (p parser) coordinate(e entry, ref entry, negative string, limit float64) *float64 {
+	if e.typ != 5 || e.count != 3 {
+		return nil
+	}
+	raw := p.value(e, 8)
+	if raw == nil {
+		return nil
+	}
+	var parts [3]float64
+	for i := range parts {
+		num, den := p.order.Uint32(raw[i*8:]), p.order.Uint32(raw[i*8+4:])
+		if den == 0 {
+			return nil
+		}
+		parts[i] = float64(num) / float64(den)
+	}
+	value := parts[0] + parts[1]/60 + parts[2]/3600
+	if p.ascii(ref) == negative {
+		value = -value
+	}
+	if value < -limit || value > limit {
+		return nil
+	}
+	return &value
+}
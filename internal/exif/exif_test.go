@@ -0,0 +1,309 @@
+//Filename: internal/exif/exif_test.go
+
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// a tiffEntry is an IFD entry written by buildTIFF(). data holds its value, which is
+// stored in the entry when it fits in 4 bytes and after the IFDs otherwise
+type tiffEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+// buildTIFF() lays out IFD0 and, when given, the Exif and GPS IFDs it points to
+func buildTIFF(order binary.ByteOrder, ifd0, exifIFD, gpsIFD []tiffEntry) []byte {
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		order.PutUint32(b, v)
+		return b
+	}
+	ifds := [][]tiffEntry{append([]tiffEntry{}, ifd0...)}
+	for _, sub := range []struct {
+		tag uint16
+		ifd []tiffEntry
+	}{{tagExifIFD, exifIFD}, {tagGPSIFD, gpsIFD}} {
+		if sub.ifd != nil {
+			ifds[0] = append(ifds[0], tiffEntry{tag: sub.tag, typ: 4, count: 1})
+			ifds = append(ifds, sub.ifd)
+		}
+	}
+	offsets := make([]uint32, len(ifds))
+	pos := uint32(8)
+	for i, ifd := range ifds {
+		offsets[i] = pos
+		pos += uint32(2 + 12*len(ifd) + 4)
+	}
+	next := 1
+	for i := range ifds[0] {
+		//pointers written by the caller are left as they are
+		if tag := ifds[0][i].tag; (tag == tagExifIFD || tag == tagGPSIFD) && ifds[0][i].data == nil {
+			ifds[0][i].data = u32(offsets[next])
+			next++
+		}
+	}
+
+	buf := []byte("II\x2A\x00")
+	if order == binary.BigEndian {
+		buf = []byte("MM\x00\x2A")
+	}
+	buf = append(buf, u32(8)...)
+	var values []byte
+	for _, ifd := range ifds {
+		buf = appendUint16(order, buf, uint16(len(ifd)))
+		for _, e := range ifd {
+			buf = appendUint16(order, buf, e.tag)
+			buf = appendUint16(order, buf, e.typ)
+			buf = appendUint32(order, buf, e.count)
+			if len(e.data) <= 4 {
+				buf = append(buf, append(e.data, make([]byte, 4-len(e.data))...)...)
+				continue
+			}
+			buf = append(buf, u32(pos+uint32(len(values)))...)
+			values = append(values, e.data...)
+		}
+		buf = append(buf, u32(0)...)
+	}
+	return append(buf, values...)
+}
+
+func ascii(tag uint16, s string) tiffEntry {
+	return tiffEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), data: append([]byte(s), 0)}
+}
+
+func rationals(order binary.ByteOrder, tag uint16, values ...uint32) tiffEntry {
+	var data []byte
+	for _, v := range values {
+		data = appendUint32(order, data, v)
+	}
+	return tiffEntry{tag: tag, typ: 5, count: uint32(len(values) / 2), data: data}
+}
+
+// sampleTIFF() is a block with every field we read: a Pixel 7 photo taken at 14:30 on
+// 1 June 2023 in UTC+2, at 51°30'N 0°7'30"W
+func sampleTIFF(order binary.ByteOrder) []byte {
+	return buildTIFF(order,
+		[]tiffEntry{ascii(tagModel, "Pixel 7")},
+		[]tiffEntry{ascii(tagDateTimeOriginal, "2023:06:01 14:30:00"), ascii(tagOffsetOriginal, "+02:00")},
+		[]tiffEntry{
+			ascii(tagGPSLatitudeRef, "N"),
+			rationals(order, tagGPSLatitude, 51, 1, 30, 1, 0, 1),
+			ascii(tagGPSLongitudeRef, "W"),
+			rationals(order, tagGPSLongitude, 0, 1, 15, 2, 0, 1),
+		},
+	)
+}
+
+// sampleJPEG() wraps an EXIF block in the segments of a JPEG
+func sampleJPEG(tiff []byte) []byte {
+	jpeg := []byte{0xFF, 0xD8}
+	//a JFIF segment comes first in most files
+	jfif := []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")
+	jpeg = append(jpeg, 0xFF, 0xE0)
+	jpeg = appendUint16(binary.BigEndian, jpeg, uint16(len(jfif)+2))
+	jpeg = append(jpeg, jfif...)
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	jpeg = append(jpeg, 0xFF, 0xE1)
+	jpeg = appendUint16(binary.BigEndian, jpeg, uint16(len(app1)+2))
+	jpeg = append(jpeg, app1...)
+	return append(jpeg, 0xFF, 0xDA, 0x00, 0x02)
+}
+
+func TestParse(t *testing.T) {
+	zoned := time.Date(2023, 6, 1, 12, 30, 0, 0, time.UTC)
+	wall := time.Date(2023, 6, 1, 14, 30, 0, 0, time.UTC)
+	lat, lon := 51.5, -0.125
+	le, be := binary.LittleEndian, binary.BigEndian
+	tests := []struct {
+		name  string
+		tiff  []byte
+		model string
+		taken *time.Time
+		local bool
+		lat   *float64
+		lon   *float64
+	}{
+		{"little endian", sampleTIFF(le), "Pixel 7", &zoned, false, &lat, &lon},
+		{"big endian", sampleTIFF(be), "Pixel 7", &zoned, false, &lat, &lon},
+		{
+			"no offset is the camera's clock",
+			buildTIFF(le, nil, []tiffEntry{ascii(tagDateTimeOriginal, "2023:06:01 14:30:00")}, nil),
+			"", &wall, true, nil, nil,
+		},
+		{
+			"unreadable date",
+			buildTIFF(le, nil, []tiffEntry{ascii(tagDateTimeOriginal, "0000:00:00 00:00:00")}, nil),
+			"", nil, false, nil, nil,
+		},
+		{
+			"latitude out of range",
+			buildTIFF(le, nil, nil, []tiffEntry{
+				rationals(le, tagGPSLatitude, 95, 1, 0, 1, 0, 1),
+				rationals(le, tagGPSLongitude, 10, 1, 0, 1, 0, 1),
+			}),
+			"", nil, false, nil, nil,
+		},
+		{
+			"zero denominator",
+			buildTIFF(le, nil, nil, []tiffEntry{
+				rationals(le, tagGPSLatitude, 10, 0, 0, 1, 0, 1),
+				rationals(le, tagGPSLongitude, 10, 1, 0, 1, 0, 1),
+			}),
+			"", nil, false, nil, nil,
+		},
+		{
+			"latitude without longitude",
+			buildTIFF(le, nil, nil, []tiffEntry{rationals(le, tagGPSLatitude, 10, 1, 0, 1, 0, 1)}),
+			"", nil, false, nil, nil,
+		},
+		{
+			"model of the wrong type",
+			buildTIFF(le, []tiffEntry{{tag: tagModel, typ: 3, count: 1, data: []byte{1, 0}}}, nil, nil),
+			"", nil, false, nil, nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Parse(tt.tiff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data.Model != tt.model {
+				t.Errorf("Model = %q, want %q", data.Model, tt.model)
+			}
+			switch {
+			case (data.TakenAt == nil) != (tt.taken == nil):
+				t.Errorf("TakenAt = %v, want %v", data.TakenAt, tt.taken)
+			case data.TakenAt != nil && !data.TakenAt.Equal(*tt.taken):
+				t.Errorf("TakenAt = %s, want %s", data.TakenAt, tt.taken)
+			}
+			if data.TakenAtLocal != tt.local {
+				t.Errorf("TakenAtLocal = %t, want %t", data.TakenAtLocal, tt.local)
+			}
+			for _, c := range []struct {
+				name      string
+				got, want *float64
+			}{{"Latitude", data.Latitude, tt.lat}, {"Longitude", data.Longitude, tt.lon}} {
+				if (c.got == nil) != (c.want == nil) || (c.got != nil && *c.got != *c.want) {
+					t.Errorf("%s = %v, want %v", c.name, c.got, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseGarbage(t *testing.T) {
+	le := binary.LittleEndian
+	tests := []struct {
+		name string
+		tiff []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte("II\x2A\x00")},
+		{"unknown byte order", []byte("XX\x2A\x00\x08\x00\x00\x00\x00\x00")},
+		{"IFD past the end", []byte("II\x2A\x00\xFF\xFF\xFF\xFF")},
+		{"entry count past the end", []byte("II\x2A\x00\x08\x00\x00\x00\xFF\xFF")},
+		{"pointers past the end", buildTIFF(le, []tiffEntry{
+			{tag: tagExifIFD, typ: 4, count: 1, data: []byte{0xFF, 0xFF, 0xFF, 0x7F}},
+			{tag: tagGPSIFD, typ: 4, count: 1, data: []byte{0xF0, 0xFF, 0xFF, 0xFF}},
+		}, nil, nil)},
+		{"value past the end", buildTIFF(le, []tiffEntry{
+			{tag: tagModel, typ: 2, count: 0xFFFFFFFF, data: []byte{0x10, 0, 0, 0}},
+		}, nil, nil)},
+		{"GPS value past the end", buildTIFF(le, nil, nil, []tiffEntry{
+			{tag: tagGPSLatitude, typ: 5, count: 3, data: []byte{0xF0, 0xFF, 0xFF, 0xFF}},
+			{tag: tagGPSLongitude, typ: 5, count: 3, data: []byte{0xFF, 0xFF, 0xFF, 0x7F}},
+		})},
+		{"IFD pointing at itself", buildTIFF(le, []tiffEntry{
+			{tag: tagExifIFD, typ: 4, count: 1, data: []byte{8, 0, 0, 0}},
+		}, nil, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//malformed blocks are either refused or read for what they hold, never a panic
+			_, err := Parse(tt.tiff)
+			if err != nil && !errors.Is(err, ErrNoExif) {
+				t.Errorf("Parse() err = %v, want nil or %v", err, ErrNoExif)
+			}
+		})
+	}
+
+	//every truncation of a valid block, and random damage to it
+	tiff := sampleTIFF(le)
+	for n := range tiff {
+		_, err := Parse(tiff[:n])
+		if n < 8 && !errors.Is(err, ErrNoExif) {
+			t.Errorf("Parse() of %d bytes: err = %v, want %v", n, err, ErrNoExif)
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		damaged := append([]byte{}, tiff...)
+		for j := 0; j < 4; j++ {
+			damaged[2+rng.Intn(len(damaged)-2)] = byte(rng.Intn(256))
+		}
+		Parse(damaged)
+	}
+}
+
+func TestRead(t *testing.T) {
+	jpeg := sampleJPEG(sampleTIFF(binary.BigEndian))
+	data, err := Read(bytes.NewReader(jpeg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Model != "Pixel 7" {
+		t.Errorf("Model = %q, want Pixel 7", data.Model)
+	}
+
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"empty", nil},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n")},
+		{"no EXIF before the image data", []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02}},
+		{"not a marker", []byte{0xFF, 0xD8, 0x00, 0xE1, 0x00, 0x02}},
+		{"segment length below 2", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01}},
+		{"segment past the end", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 'E', 'x'}},
+		{"APP1 that isn't EXIF", append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x06}, "XMP\x00"...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Read(bytes.NewReader(tt.file))
+			if !errors.Is(err, ErrNoExif) {
+				t.Errorf("Read() err = %v, want %v", err, ErrNoExif)
+			}
+		})
+	}
+
+	//a file cut short anywhere before its EXIF block ends has none
+	end := len(jpeg) - 4
+	for n := 0; n < end; n++ {
+		_, err := Read(bytes.NewReader(jpeg[:n]))
+		if !errors.Is(err, ErrNoExif) {
+			t.Errorf("Read() of %d bytes: err = %v, want %v", n, err, ErrNoExif)
+		}
+	}
+}
+
+func appendUint16(order binary.ByteOrder, b []byte, v uint16) []byte {
+	buf := make([]byte, 2)
+	order.PutUint16(buf, v)
+	return append(b, buf...)
+}
+
+func appendUint32(order binary.ByteOrder, b []byte, v uint32) []byte {
+	buf := make([]byte, 4)
+	order.PutUint32(buf, v)
+	return append(b, buf...)
+}
@@ -0,0 +1,111 @@
+//Filename: internal/imaging/blurhash.go
+
+package imaging
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+// the digits of the base 83 encoding BlurHash uses
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash() encodes a blurred version of an image as a short string (see blurha.sh) that
+// clients decode into a placeholder. landscape images get 4x3 components, portrait ones 3x4
+func BlurHash(img image.Image) string {
+	//a few hundred pixels are plenty for a handful of cosine components
+	small := Fit(img, 32, 32, FitContain)
+	w, h := small.Bounds().Dx(), small.Bounds().Dy()
+	cx, cy := 4, 3
+	if h > w {
+		cx, cy = 3, 4
+	}
+
+	linear := [3][]float64{make([]float64, w*h), make([]float64, w*h), make([]float64, w*h)}
+	for i := 0; i < w*h; i++ {
+		for c := 0; c < 3; c++ {
+			linear[c][i] = sRGBToLinear(small.Pix[i*4+c])
+		}
+	}
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				by := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * by
+					for c := 0; c < 3; c++ {
+						f[c] += basis * linear[c][y*w+x]
+					}
+				}
+			}
+			scale := 2.0
+			if i == 0 && j == 0 {
+				scale = 1
+			}
+			for c := 0; c < 3; c++ {
+				f[c] *= scale / float64(w*h)
+			}
+			factors = append(factors, f)
+		}
+	}
+
+	var hash strings.Builder
+	writeBase83(&hash, (cx-1)+(cy-1)*9, 1)
+	maximum := 1.0
+	if len(factors) > 1 {
+		actual := 0.0
+		for _, f := range factors[1:] {
+			for _, v := range f {
+				actual = math.Max(actual, math.Abs(v))
+			}
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		writeBase83(&hash, quantised, 1)
+	} else {
+		writeBase83(&hash, 0, 1)
+	}
+	dc := factors[0]
+	writeBase83(&hash, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range factors[1:] {
+		value := 0
+		for _, v := range f {
+			q := int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+			value = value*19 + q
+		}
+		writeBase83(&hash, value, 2)
+	}
+	return hash.String()
+}
+
+// writeBase83() writes value as length base 83 digits
+func writeBase83(b *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := value / int(math.Pow(83, float64(length-i))) % 83
+		b.WriteByte(base83[digit])
+	}
+}
+
+func sRGBToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow() raises the magnitude of v to exp, keeping its sign
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,47 @@
+//Filename: internal/imaging/blurhash_test.go
+
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestBlurHash(t *testing.T) {
+	//the images are no bigger than 32x32, so BlurHash() encodes them as they are. the
+	//hashes were worked out independently from the algorithm published at blurha.sh
+	tests := []struct {
+		name          string
+		width, height int
+		pixel         func(x, y int) color.RGBA
+		want          string
+	}{
+		{"solid red", 32, 24, func(x, y int) color.RGBA {
+			return color.RGBA{255, 0, 0, 255}
+		}, "LDTI:j]9fQ]9|co1fQo1fQfQfQfQ"},
+		{"gradient", 32, 24, func(x, y int) color.RGBA {
+			return color.RGBA{uint8(x * 8), uint8(y * 10), 128, 255}
+		}, "LxH27k2swxX8mHWWjtf7gJfjfQfj"},
+		{"portrait blocks", 24, 32, func(x, y int) color.RGBA {
+			switch {
+			case y >= 20:
+				return color.RGBA{0, 0, 0, 255}
+			case x < 12:
+				return color.RGBA{255, 255, 255, 255}
+			}
+			return color.RGBA{20, 60, 200, 255}
+		}, "T~He*4_1t6?d-.oeM_RkayRjWCaz"},
+	}
+	for _, tt := range tests {
+		img := image.NewRGBA(image.Rect(0, 0, tt.width, tt.height))
+		for y := 0; y < tt.height; y++ {
+			for x := 0; x < tt.width; x++ {
+				img.SetRGBA(x, y, tt.pixel(x, y))
+			}
+		}
+		if got := BlurHash(img); got != tt.want {
+			t.Errorf("BlurHash(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+//Filename: internal/imaging/dhash.go
+
+package imaging
+
+import (
+	"image"
+	"math/bits"
+)
+
+// DHash() computes the 64 bit difference hash of an image. the image is shrunk to 9x8
+// grey pixels and every bit says if a pixel is brighter than its right neighbour, so
+// resized, recompressed or slightly edited copies get the same or a very close hash
+func DHash(img image.Image) uint64 {
+	small := Resize(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if luminance(small.RGBAAt(x, y)) > luminance(small.RGBAAt(x+1, y)) {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// Distance() returns the number of bits two hashes differ by
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
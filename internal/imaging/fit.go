@@ -0,0 +1,65 @@
+//Filename: internal/imaging/fit.go
+
+package imaging
+
+import (
+	"image"
+	"math"
+)
+
+// the ways an image can be fitted into a box
+const (
+	// FitCover fills the box exactly, cropping what sticks out on either side
+	FitCover = "cover"
+	// FitContain shrinks the image until all of it is inside the box
+	FitContain = "contain"
+)
+
+// Fit() scales src into a width x height box. either side may be 0 to follow the aspect
+// ratio of the image. images are never enlarged, so the result may be smaller than the box
+func Fit(src image.Image, width, height int, fit string) *image.RGBA {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	if sw == 0 || sh == 0 {
+		return image.NewRGBA(image.Rect(0, 0, 0, 0))
+	}
+	switch {
+	case width <= 0:
+		width = atLeastOne(float64(sw*height) / float64(sh))
+		fit = FitContain
+	case height <= 0:
+		height = atLeastOne(float64(sh*width) / float64(sw))
+		fit = FitContain
+	}
+	sx, sy := float64(width)/float64(sw), float64(height)/float64(sh)
+
+	if fit == FitCover {
+		//the scale that fills the box, with the box shrunk instead when the image is too small
+		scale := math.Max(sx, sy)
+		if scale > 1 {
+			width, height = atLeastOne(float64(width)/scale), atLeastOne(float64(height)/scale)
+			scale = 1
+		}
+		//the middle of the image with the aspect ratio of the box
+		cw, ch := atLeastOne(float64(width)/scale), atLeastOne(float64(height)/scale)
+		if cw > sw {
+			cw = sw
+		}
+		if ch > sh {
+			ch = sh
+		}
+		x0, y0 := bounds.Min.X+(sw-cw)/2, bounds.Min.Y+(sh-ch)/2
+		return resize(src, image.Rect(x0, y0, x0+cw, y0+ch), width, height)
+	}
+
+	scale := math.Min(math.Min(sx, sy), 1)
+	return resize(src, bounds, atLeastOne(float64(sw)*scale), atLeastOne(float64(sh)*scale))
+}
+
+// atLeastOne() rounds a length to whole pixels, keeping at least one
+func atLeastOne(f float64) int {
+	if n := int(math.Round(f)); n > 0 {
+		return n
+	}
+	return 1
+}
@@ -0,0 +1,85 @@
+//Filename: internal/imaging/imaging.go
+
+package imaging
+
+import (
+	"image"
+	"image/color"
+)
+
+// MaxPixels is the largest image (width x height) we are willing to decode
+const MaxPixels = 100_000_000
+
+// pixelReader() returns a function reading the 8 bit RGBA value of a pixel. the common
+// decoded image types are read directly, which is much faster than going through At()
+func pixelReader(src image.Image) func(x, y int) (r, g, b, a uint32) {
+	switch img := src.(type) {
+	case *image.RGBA:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			i := img.PixOffset(x, y)
+			return uint32(img.Pix[i]), uint32(img.Pix[i+1]), uint32(img.Pix[i+2]), uint32(img.Pix[i+3])
+		}
+	case *image.YCbCr:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			yi, ci := img.YOffset(x, y), img.COffset(x, y)
+			r, g, b := color.YCbCrToRGB(img.Y[yi], img.Cb[ci], img.Cr[ci])
+			return uint32(r), uint32(g), uint32(b), 255
+		}
+	case *image.Gray:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			v := uint32(img.Pix[img.PixOffset(x, y)])
+			return v, v, v, 255
+		}
+	default:
+		return func(x, y int) (uint32, uint32, uint32, uint32) {
+			c := color.RGBAModel.Convert(src.At(x, y)).(color.RGBA)
+			return uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A)
+		}
+	}
+}
+
+// Resize() scales an image to exactly width x height by averaging the source pixels
+// covered by each destination pixel. this is cheap and gives good results when shrinking,
+// which is what thumbnails and hashes need
+func Resize(src image.Image, width, height int) *image.RGBA {
+	return resize(src, src.Bounds(), width, height)
+}
+
+// resize() scales the part of src inside bounds to exactly width x height
+func resize(src image.Image, bounds image.Rectangle, width, height int) *image.RGBA {
+	sw, sh := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if sw == 0 || sh == 0 || width <= 0 || height <= 0 {
+		return dst
+	}
+	pixel := pixelReader(src)
+	for y := 0; y < height; y++ {
+		y0 := y * sh / height
+		y1 := (y + 1) * sh / height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := x * sw / width
+			x1 := (x + 1) * sw / width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := pixel(bounds.Min.X+sx, bounds.Min.Y+sy)
+					r, g, b, a = r+pr, g+pg, b+pb, a+pa
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// luminance() returns the perceived brightness of a pixel, 0-255
+func luminance(c color.RGBA) float64 {
+	return 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+}
@@ -0,0 +1,180 @@
+//Filename: internal/imaging/palette.go
+
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// images are shrunk to this size before their colors are counted
+const colorSampleSize = 64
+
+// opaquePixels() returns the colors of the mostly opaque pixels of a shrunk copy of img
+func opaquePixels(img image.Image) []color.RGBA {
+	small := Resize(img, colorSampleSize, colorSampleSize)
+	pixels := make([]color.RGBA, 0, colorSampleSize*colorSampleSize)
+	for i := 0; i < len(small.Pix); i += 4 {
+		a := small.Pix[i+3]
+		if a < 128 {
+			continue
+		}
+		//the pixels are alpha premultiplied
+		pixels = append(pixels, color.RGBA{
+			uint8(uint32(small.Pix[i]) * 255 / uint32(a)),
+			uint8(uint32(small.Pix[i+1]) * 255 / uint32(a)),
+			uint8(uint32(small.Pix[i+2]) * 255 / uint32(a)),
+			255,
+		})
+	}
+	return pixels
+}
+
+// mean() returns the average of some colors
+func mean(pixels []color.RGBA) color.RGBA {
+	var r, g, b int
+	for _, p := range pixels {
+		r, g, b = r+int(p.R), g+int(p.G), b+int(p.B)
+	}
+	n := len(pixels)
+	if n == 0 {
+		return color.RGBA{A: 255}
+	}
+	return color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), 255}
+}
+
+// Average() returns the average color of the opaque parts of an image
+func Average(img image.Image) color.RGBA {
+	return mean(opaquePixels(img))
+}
+
+// Palette() returns up to n dominant colors of an image, most common first. the colors
+// are found by median cut: the pixels are split in two at the median of the channel
+// they vary most in, again and again, and every group becomes its average color
+func Palette(img image.Image, n int) []color.RGBA {
+	boxes := [][]color.RGBA{opaquePixels(img)}
+	if len(boxes[0]) == 0 {
+		return []color.RGBA{}
+	}
+	for len(boxes) < n {
+		//split the box with the widest spread of any channel
+		widest, channel, spread := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if c, s := widestChannel(box); s > spread {
+				widest, channel, spread = i, c, s
+			}
+		}
+		//every box has a single color left
+		if widest < 0 {
+			break
+		}
+		box := boxes[widest]
+		sort.Slice(box, func(i, j int) bool { return channelOf(box[i], channel) < channelOf(box[j], channel) })
+		cut := medianCut(box, channel)
+		boxes[widest] = box[:cut]
+		boxes = append(boxes, box[cut:])
+	}
+	sort.SliceStable(boxes, func(i, j int) bool { return len(boxes[i]) > len(boxes[j]) })
+	palette := make([]color.RGBA, len(boxes))
+	for i, box := range boxes {
+		palette[i] = mean(box)
+	}
+	return palette
+}
+
+// medianCut() returns where to split pixels sorted by a channel: the change of value
+// closest to the middle, so pixels of the same value stay together
+func medianCut(pixels []color.RGBA, channel int) int {
+	half := len(pixels) / 2
+	for d := 0; d < len(pixels); d++ {
+		for _, i := range []int{half - d, half + d} {
+			if i > 0 && i < len(pixels) && channelOf(pixels[i-1], channel) != channelOf(pixels[i], channel) {
+				return i
+			}
+		}
+	}
+	return half
+}
+
+// channelOf() returns the red (0), green (1) or blue (2) channel of a color
+func channelOf(c color.RGBA, channel int) uint8 {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	}
+	return c.B
+}
+
+// widestChannel() returns the channel the colors vary most in and by how much
+func widestChannel(pixels []color.RGBA) (int, int) {
+	best, spread := 0, -1
+	for channel := 0; channel < 3; channel++ {
+		lo, hi := uint8(255), uint8(0)
+		for _, p := range pixels {
+			v := channelOf(p, channel)
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if int(hi)-int(lo) > spread {
+			best, spread = channel, int(hi)-int(lo)
+		}
+	}
+	return best, spread
+}
+
+// Hex() formats a color as #rrggbb
+func Hex(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// ParseHex() reads a color written as #rrggbb or rrggbb
+func ParseHex(s string) (color.RGBA, error) {
+	if len(s) == 7 && s[0] == '#' {
+		s = s[1:]
+	}
+	if len(s) != 6 {
+		return color.RGBA{}, fmt.Errorf("imaging: invalid hex color %q", s)
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("imaging: invalid hex color %q", s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 255}, nil
+}
+
+// Lab() converts a color to CIELAB (D65), where the distance between two colors
+// roughly matches how different they look. a distance of about 2 is just noticeable
+func Lab(c color.RGBA) (l, a, b float64) {
+	linear := func(v uint8) float64 {
+		f := float64(v) / 255
+		if f <= 0.04045 {
+			return f / 12.92
+		}
+		return math.Pow((f+0.055)/1.055, 2.4)
+	}
+	r, g, bl := linear(c.R), linear(c.G), linear(c.B)
+	x := (0.4124*r + 0.3576*g + 0.1805*bl) / 0.95047
+	y := 0.2126*r + 0.7152*g + 0.0722*bl
+	z := (0.0193*r + 0.1192*g + 0.9505*bl) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
@@ -0,0 +1,29 @@
+//Filename: internal/imaging/summary.go
+
+package imaging
+
+import (
+	"image"
+	"image/color"
+)
+
+// a Summary is what is worked out from the pixels of an image once, when it is stored
+type Summary struct {
+	// PHash is the perceptual hash, see DHash()
+	PHash uint64
+	// Palette has up to paletteSize dominant colors, most common first
+	Palette []color.RGBA
+	Average color.RGBA
+	// BlurHash is a placeholder for the image, see BlurHash()
+	BlurHash string
+}
+
+// Summarize() works out the summary of an image
+func Summarize(img image.Image, paletteSize int) Summary {
+	return Summary{
+		PHash:    DHash(img),
+		Palette:  Palette(img, paletteSize),
+		Average:  Average(img),
+		BlurHash: BlurHash(img),
+	}
+}
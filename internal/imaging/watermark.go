@@ -0,0 +1,54 @@
+//Filename: internal/imaging/watermark.go
+
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// the places a watermark can be drawn
+var Positions = []string{"top-left", "top-right", "bottom-left", "bottom-right", "center"}
+
+// Watermark() draws mark over img at position (one of Positions). the mark is scaled to
+// scale times the width of img, keeping its aspect ratio, and drawn at opacity (0-1)
+// a small margin in from the edges
+func Watermark(img *image.RGBA, mark image.Image, position string, opacity, scale float64) {
+	bounds, mb := img.Bounds(), mark.Bounds()
+	if bounds.Empty() || mb.Empty() {
+		return
+	}
+	w := atLeastOne(float64(bounds.Dx()) * scale)
+	h := atLeastOne(float64(mb.Dy()) * float64(w) / float64(mb.Dx()))
+	//tall marks are fitted to the height instead
+	if h > bounds.Dy() {
+		h = bounds.Dy()
+		w = atLeastOne(float64(mb.Dx()) * float64(h) / float64(mb.Dy()))
+	}
+	scaled := Resize(mark, w, h)
+
+	margin := bounds.Dx()
+	if bounds.Dy() < margin {
+		margin = bounds.Dy()
+	}
+	margin = margin / 50
+	left, top := margin, margin
+	right, bottom := bounds.Dx()-w-margin, bounds.Dy()-h-margin
+	var at image.Point
+	switch position {
+	case "top-left":
+		at = image.Pt(left, top)
+	case "top-right":
+		at = image.Pt(right, top)
+	case "bottom-left":
+		at = image.Pt(left, bottom)
+	case "center":
+		at = image.Pt((bounds.Dx()-w)/2, (bounds.Dy()-h)/2)
+	default:
+		at = image.Pt(right, bottom)
+	}
+	r := image.Rect(0, 0, w, h).Add(at).Add(bounds.Min)
+	alpha := image.NewUniform(color.Alpha{A: uint8(opacity*255 + 0.5)})
+	draw.DrawMask(img, r, scaled, image.Point{}, alpha, image.Point{}, draw.Over)
+}
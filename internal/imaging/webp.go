@@ -0,0 +1,408 @@
+//Filename: internal/imaging/webp.go
+
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"sort"
+)
+
+// the largest width or height a WebP image can have
+const maxWebPSide = 1 << 14
+
+// the predictor used for every pixel, ClampAddSubtractFull(L, T, TL) in the spec. it is
+// the gradient predictor of PNG without the branching, and does well on photos
+const webpGradientPredictor = 12
+
+// the order the lengths of the code length code are written in
+var webpCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// EncodeWebP() writes img as a lossless WebP (see developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification).
+// green is subtracted from red and blue, every pixel is predicted from its neighbours and what
+// is left over is Huffman coded. there is no backward referencing, so the files are larger than
+// libwebp's but still well under a PNG of a photo
+func EncodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > maxWebPSide || height > maxWebPSide {
+		return errors.New("imaging: a WebP image must be between 1 and 16384 pixels wide and high")
+	}
+
+	//the pixels as non-premultiplied ARGB, with green already taken from red and blue
+	pixel := pixelReader(img)
+	argb := make([]uint32, width*height)
+	opaque := true
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, a := pixel(bounds.Min.X+x, bounds.Min.Y+y)
+			switch a {
+			case 0:
+				r, g, b = 0, 0, 0
+			case 255:
+			default:
+				r, g, b = unpremultiply(r, a), unpremultiply(g, a), unpremultiply(b, a)
+			}
+			opaque = opaque && a == 255
+			argb[y*width+x] = a<<24 | ((r-g)&0xff)<<16 | g<<8 | (b-g)&0xff
+		}
+	}
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if opaque {
+		bw.write(0, 1)
+	} else {
+		bw.write(1, 1)
+	}
+	bw.write(0, 3)
+
+	//transform: subtract green
+	bw.write(1, 1)
+	bw.write(2, 2)
+	//transform: predictor, one mode for tiles of 512x512 pixels
+	const tileBits = 9
+	bw.write(1, 1)
+	bw.write(0, 2)
+	bw.write(tileBits-2, 3)
+	tiles := make([]uint32, ((width+1<<tileBits-1)>>tileBits)*((height+1<<tileBits-1)>>tileBits))
+	for i := range tiles {
+		tiles[i] = webpGradientPredictor << 8
+	}
+	writeWebPImage(bw, tiles, false)
+	bw.write(0, 1)
+
+	writeWebPImage(bw, predictResiduals(argb, width, height), true)
+
+	vp8l := bw.bytes()
+	header := make([]byte, 20)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(vp8l)+len(vp8l)&1))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(vp8l)))
+	if len(vp8l)&1 == 1 {
+		//chunks are padded to an even length
+		vp8l = append(vp8l, 0)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(vp8l)
+	return err
+}
+
+// unpremultiply() undoes the premultiplication of a color channel by alpha
+func unpremultiply(c, a uint32) uint32 {
+	c = (c*255 + a/2) / a
+	if c > 255 {
+		c = 255
+	}
+	return c
+}
+
+// predictResiduals() returns what is left of each pixel after the predictor. the first
+// pixel is predicted as opaque black, the rest of the top row from the left and the
+// left column from above, as the spec requires
+func predictResiduals(argb []uint32, width, height int) []uint32 {
+	residuals := make([]uint32, len(argb))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			var predicted uint32
+			switch {
+			case x == 0 && y == 0:
+				predicted = 0xff000000
+			case y == 0:
+				predicted = argb[i-1]
+			case x == 0:
+				predicted = argb[i-width]
+			default:
+				predicted = clampAddSubtract(argb[i-1], argb[i-width], argb[i-width-1])
+			}
+			residuals[i] = subPixels(argb[i], predicted)
+		}
+	}
+	return residuals
+}
+
+// clampAddSubtract() returns a + b - c for each channel, clamped to 0..255
+func clampAddSubtract(a, b, c uint32) uint32 {
+	var result uint32
+	for shift := 0; shift < 32; shift += 8 {
+		v := int(a>>shift&0xff) + int(b>>shift&0xff) - int(c>>shift&0xff)
+		if v < 0 {
+			v = 0
+		} else if v > 255 {
+			v = 255
+		}
+		result |= uint32(v) << shift
+	}
+	return result
+}
+
+// subPixels() subtracts b from a for each channel, modulo 256
+func subPixels(a, b uint32) uint32 {
+	var result uint32
+	for shift := 0; shift < 32; shift += 8 {
+		result |= ((a>>shift - b>>shift) & 0xff) << shift
+	}
+	return result
+}
+
+// writeWebPImage() writes an entropy coded image of literal ARGB values. the main image
+// says it uses one set of Huffman codes for every pixel, images within a transform don't
+func writeWebPImage(bw *bitWriter, argb []uint32, main bool) {
+	//no color cache
+	bw.write(0, 1)
+	if main {
+		//no meta Huffman codes
+		bw.write(0, 1)
+	}
+	//green (with the length prefixes we don't use), red, blue, alpha and distance
+	counts := [5][]int{make([]int, 256+24), make([]int, 256), make([]int, 256), make([]int, 256), make([]int, 40)}
+	for _, p := range argb {
+		counts[0][p>>8&0xff]++
+		counts[1][p>>16&0xff]++
+		counts[2][p&0xff]++
+		counts[3][p>>24]++
+	}
+	var codes [5]huffmanCode
+	for i := range codes {
+		codes[i] = newHuffmanCode(counts[i], 15)
+		codes[i].writeTo(bw)
+	}
+	for _, p := range argb {
+		codes[0].writeSymbol(bw, int(p>>8&0xff))
+		codes[1].writeSymbol(bw, int(p>>16&0xff))
+		codes[2].writeSymbol(bw, int(p&0xff))
+		codes[3].writeSymbol(bw, int(p>>24))
+	}
+}
+
+// bitWriter packs values into bytes starting from the least significant bit
+type bitWriter struct {
+	buf  []byte
+	bits uint64
+	n    uint
+}
+
+// write() appends the n low bits of v
+func (bw *bitWriter) write(v uint32, n uint) {
+	bw.bits |= uint64(v) << bw.n
+	bw.n += n
+	for bw.n >= 8 {
+		bw.buf = append(bw.buf, byte(bw.bits))
+		bw.bits >>= 8
+		bw.n -= 8
+	}
+}
+
+// bytes() returns everything written, padding the last byte with zeros
+func (bw *bitWriter) bytes() []byte {
+	if bw.n > 0 {
+		bw.buf = append(bw.buf, byte(bw.bits))
+		bw.bits, bw.n = 0, 0
+	}
+	return bw.buf
+}
+
+// a huffmanCode is a canonical Huffman code. a code with only one symbol takes no bits at all
+type huffmanCode struct {
+	lengths []uint8
+	// codes are bit reversed, ready for bitWriter
+	codes []uint32
+	// symbols is the number of symbols that have a code
+	symbols int
+	// only is the symbol of a code with just one
+	only int
+}
+
+// newHuffmanCode() builds a code for symbols seen counts times, no longer than maxLength
+// bits. when the optimal code is too long the counts are flattened until it fits
+func newHuffmanCode(counts []int, maxLength int) huffmanCode {
+	code := huffmanCode{lengths: make([]uint8, len(counts)), codes: make([]uint32, len(counts))}
+	used := make([]int, 0, len(counts))
+	for symbol, count := range counts {
+		if count > 0 {
+			used = append(used, symbol)
+		}
+	}
+	code.symbols = len(used)
+	if len(used) <= 1 {
+		if len(used) == 1 {
+			code.only = used[0]
+			code.lengths[used[0]] = 1
+		}
+		return code
+	}
+
+	weights := make([]int, len(counts))
+	copy(weights, counts)
+	for !huffmanLengths(weights, used, code.lengths, maxLength) {
+		for _, symbol := range used {
+			weights[symbol] = (weights[symbol] + 1) / 2
+		}
+	}
+
+	//canonical codes: shorter codes first, and in symbol order within a length
+	var lengthCounts, next [16]uint32
+	for _, symbol := range used {
+		lengthCounts[code.lengths[symbol]]++
+	}
+	for length := 1; length < 16; length++ {
+		next[length] = (next[length-1] + lengthCounts[length-1]) << 1
+	}
+	for _, symbol := range used {
+		length := code.lengths[symbol]
+		c := next[length]
+		next[length]++
+		for i := uint8(0); i < length; i++ {
+			code.codes[symbol] |= (c >> i & 1) << (length - 1 - i)
+		}
+	}
+	return code
+}
+
+// huffmanLengths() sets the length of the optimal code of each used symbol and reports
+// if none is longer than maxLength
+func huffmanLengths(weights []int, used []int, lengths []uint8, maxLength int) bool {
+	type node struct {
+		weight      int
+		symbol      int
+		left, right int
+	}
+	nodes := make([]node, 0, 2*len(used))
+	for _, symbol := range used {
+		nodes = append(nodes, node{weight: weights[symbol], symbol: symbol, left: -1, right: -1})
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].weight < nodes[j].weight })
+
+	//two queues: the leaves in weight order, and the joined nodes, which are made in weight order
+	leaf, joined := 0, len(nodes)
+	smallest := func() int {
+		if leaf < len(used) && (joined == len(nodes) || nodes[leaf].weight <= nodes[joined].weight) {
+			leaf++
+			return leaf - 1
+		}
+		joined++
+		return joined - 1
+	}
+	for i := 1; i < len(used); i++ {
+		a := smallest()
+		b := smallest()
+		nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, symbol: -1, left: a, right: b})
+	}
+
+	fits := true
+	var walk func(n, depth int)
+	walk = func(n, depth int) {
+		if nodes[n].symbol >= 0 {
+			lengths[nodes[n].symbol] = uint8(depth)
+			fits = fits && depth <= maxLength
+			return
+		}
+		walk(nodes[n].left, depth+1)
+		walk(nodes[n].right, depth+1)
+	}
+	walk(len(nodes)-1, 0)
+	return fits
+}
+
+// writeSymbol() writes the code of a symbol
+func (code huffmanCode) writeSymbol(bw *bitWriter, symbol int) {
+	if code.symbols > 1 {
+		bw.write(code.codes[symbol], uint(code.lengths[symbol]))
+	}
+}
+
+// writeTo() writes the code lengths the decoder builds the code from
+func (code huffmanCode) writeTo(bw *bitWriter) {
+	if code.symbols <= 1 && code.only < 256 {
+		//a simple code of one symbol
+		bw.write(1, 1)
+		bw.write(0, 1)
+		if code.only < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(code.only), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(code.only), 8)
+		}
+		return
+	}
+	bw.write(0, 1)
+
+	//the lengths are themselves coded: 0 to 15 are lengths, 16 repeats the previous
+	//length 3 to 6 times, 17 and 18 are runs of 3 to 10 and 11 to 138 zeros
+	type token struct {
+		symbol    int
+		extra     uint32
+		extraBits uint
+	}
+	var tokens []token
+	for i := 0; i < len(code.lengths); {
+		length := code.lengths[i]
+		run := 1
+		for i+run < len(code.lengths) && code.lengths[i+run] == length {
+			run++
+		}
+		i += run
+		if length == 0 {
+			for run >= 3 {
+				n := run
+				if n > 138 {
+					n = 138
+				}
+				if n >= 11 {
+					tokens = append(tokens, token{18, uint32(n - 11), 7})
+				} else {
+					tokens = append(tokens, token{17, uint32(n - 3), 3})
+				}
+				run -= n
+			}
+			for ; run > 0; run-- {
+				tokens = append(tokens, token{0, 0, 0})
+			}
+			continue
+		}
+		tokens = append(tokens, token{int(length), 0, 0})
+		run--
+		for run >= 3 {
+			n := run
+			if n > 6 {
+				n = 6
+			}
+			tokens = append(tokens, token{16, uint32(n - 3), 2})
+			run -= n
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, token{int(length), 0, 0})
+		}
+	}
+
+	counts := make([]int, 19)
+	for _, t := range tokens {
+		counts[t.symbol]++
+	}
+	lengthCode := newHuffmanCode(counts, 7)
+	n := 4
+	for i, symbol := range webpCodeLengthOrder {
+		if lengthCode.lengths[symbol] > 0 && i+1 > n {
+			n = i + 1
+		}
+	}
+	bw.write(uint32(n-4), 4)
+	for _, symbol := range webpCodeLengthOrder[:n] {
+		bw.write(uint32(lengthCode.lengths[symbol]), 3)
+	}
+	//every length is written, so there is no need to say how many
+	bw.write(0, 1)
+	for _, t := range tokens {
+		lengthCode.writeSymbol(bw, t.symbol)
+		bw.write(t.extra, t.extraBits)
+	}
+}
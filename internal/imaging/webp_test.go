@@ -0,0 +1,99 @@
+//Filename: internal/imaging/webp_test.go
+
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebP(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name          string
+		width, height int
+		pixel         func(x, y int) color.NRGBA
+	}{
+		{"one pixel", 1, 1, func(x, y int) color.NRGBA { return color.NRGBA{200, 100, 50, 255} }},
+		{"solid", 40, 30, func(x, y int) color.NRGBA { return color.NRGBA{10, 20, 30, 255} }},
+		{"gradient", 300, 200, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x), uint8(y), uint8(x + y), 255}
+		}},
+		{"noise", 64, 48, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 255}
+		}},
+		//wider and taller than a predictor tile
+		{"several tiles", 700, 530, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x * y), uint8(x ^ y), uint8(y), 255}
+		}},
+		{"transparent", 20, 20, func(x, y int) color.NRGBA {
+			if (x+y)%3 == 0 {
+				return color.NRGBA{}
+			}
+			return color.NRGBA{uint8(x * 12), 0, uint8(y * 12), 255}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewRGBA(image.Rect(0, 0, tt.width, tt.height))
+			want := image.NewNRGBA(src.Bounds())
+			for y := 0; y < tt.height; y++ {
+				for x := 0; x < tt.width; x++ {
+					c := tt.pixel(x, y)
+					src.Set(x, y, c)
+					want.SetNRGBA(x, y, c)
+				}
+			}
+			var buf bytes.Buffer
+			if err := EncodeWebP(&buf, src); err != nil {
+				t.Fatal(err)
+			}
+			got, err := webp.Decode(&buf)
+			if err != nil {
+				t.Fatalf("webp.Decode() err = %v", err)
+			}
+			if got.Bounds() != want.Bounds() {
+				t.Fatalf("bounds = %v, want %v", got.Bounds(), want.Bounds())
+			}
+			for y := 0; y < tt.height; y++ {
+				for x := 0; x < tt.width; x++ {
+					if c := color.NRGBAModel.Convert(got.At(x, y)); c != want.NRGBAAt(x, y) {
+						t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, c, want.NRGBAAt(x, y))
+					}
+				}
+			}
+		})
+	}
+
+	if err := EncodeWebP(&bytes.Buffer{}, image.NewRGBA(image.Rect(0, 0, 16385, 1))); err == nil {
+		t.Error("EncodeWebP() of a 16385 pixel wide image succeeded")
+	}
+}
+
+func TestNewHuffmanCode(t *testing.T) {
+	//fibonacci counts make the optimal code as deep as there are symbols
+	counts := make([]int, 40)
+	counts[0], counts[1] = 1, 1
+	for i := 2; i < len(counts); i++ {
+		counts[i] = counts[i-1] + counts[i-2]
+	}
+	for _, maxLength := range []int{15, 7} {
+		code := newHuffmanCode(counts, maxLength)
+		//a complete code has a Kraft sum of exactly one
+		kraft := 0
+		for _, length := range code.lengths {
+			if int(length) > maxLength || length == 0 {
+				t.Fatalf("newHuffmanCode(%d) length %d", maxLength, length)
+			}
+			kraft += 1 << (maxLength - int(length))
+		}
+		if kraft != 1<<maxLength {
+			t.Errorf("newHuffmanCode(%d) Kraft sum = %d/%d, want 1", maxLength, kraft, 1<<maxLength)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+//Filename: internal/mp4/mp4.go
+
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+var ErrNotMP4 = errors.New("mp4: not an MP4 or QuickTime file")
+
+// the longest duration we report, movies claiming to be longer are clamped to it
+const maxDuration = time.Duration(math.MaxInt64)
+
+// Info holds what we read from the movie header and the first video track
+type Info struct {
+	// ContentType is video/mp4 or video/quicktime
+	ContentType string
+	Duration    time.Duration
+	Width       int
+	Height      int
+	// Codec is the video codec, such as h264 or hevc
+	Codec string
+	// Cover is the cover art embedded in the file, if there is any
+	Cover []byte
+}
+
+// the codec names of common sample entry types
+var codecs = map[string]string{
+	"avc1": "h264",
+	"avc3": "h264",
+	"hvc1": "hevc",
+	"hev1": "hevc",
+	"av01": "av1",
+	"vp08": "vp8",
+	"vp09": "vp9",
+	"mp4v": "mpeg4",
+	"apch": "prores",
+	"apcn": "prores",
+	"apcs": "prores",
+	"apco": "prores",
+	"ap4h": "prores",
+	"jpeg": "mjpeg",
+}
+
+// the largest box we read into memory. tables of sample sizes and times are
+// skipped over, so only cover art gets anywhere near this
+const maxBoxBytes = 16 << 20
+
+// Sniff() returns the content type of a file starting with head, or "" when it isn't a movie
+func Sniff(head []byte) string {
+	if len(head) < 12 {
+		return ""
+	}
+	switch string(head[4:8]) {
+	case "ftyp":
+		if string(head[8:12]) == "qt  " {
+			return "video/quicktime"
+		}
+		return "video/mp4"
+	case "moov", "mdat", "wide", "free", "skip":
+		//old QuickTime files have no ftyp box
+		return "video/quicktime"
+	}
+	return ""
+}
+
+// a box is the header of an MP4 box. the content runs from start to end
+type box struct {
+	typ        string
+	start, end int64
+}
+
+// reader walks the boxes of a file
+type reader struct {
+	r io.ReadSeeker
+}
+
+// boxes() reads the headers of the boxes between start and end
+func (rd *reader) boxes(start, end int64) ([]box, error) {
+	var result []box
+	for pos := start; pos+8 <= end; {
+		if _, err := rd.r.Seek(pos, io.SeekStart); err != nil {
+			return nil, err
+		}
+		var header [16]byte
+		if _, err := io.ReadFull(rd.r, header[:8]); err != nil {
+			return nil, ErrNotMP4
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		b := box{typ: string(header[4:8]), start: pos + 8}
+		switch size {
+		case 0:
+			//the box runs to the end of the file
+			size = end - pos
+		case 1:
+			if _, err := io.ReadFull(rd.r, header[8:16]); err != nil {
+				return nil, ErrNotMP4
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			b.start += 8
+		}
+		if size < b.start-pos || pos+size > end {
+			return nil, ErrNotMP4
+		}
+		b.end = pos + size
+		result = append(result, b)
+		pos = b.end
+	}
+	return result, nil
+}
+
+// read() returns the content of a box
+func (rd *reader) read(b box) ([]byte, error) {
+	if b.end-b.start > maxBoxBytes {
+		return nil, ErrNotMP4
+	}
+	if _, err := rd.r.Seek(b.start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data := make([]byte, b.end-b.start)
+	if _, err := io.ReadFull(rd.r, data); err != nil {
+		return nil, ErrNotMP4
+	}
+	return data, nil
+}
+
+// find() returns the first child box of the given type
+func (rd *reader) find(parent box, typ string) (box, bool) {
+	children, err := rd.boxes(parent.start, parent.end)
+	if err != nil {
+		return box{}, false
+	}
+	for _, child := range children {
+		if child.typ == typ {
+			return child, true
+		}
+	}
+	return box{}, false
+}
+
+// path() follows a chain of box types down from parent
+func (rd *reader) path(parent box, types ...string) (box, bool) {
+	b := parent
+	for _, typ := range types {
+		var ok bool
+		if b, ok = rd.find(b, typ); !ok {
+			return box{}, false
+		}
+	}
+	return b, true
+}
+
+// Parse() reads the movie header, the first video track and any cover art of an MP4 or QuickTime file
+func Parse(r io.ReadSeeker) (*Info, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, 12)
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err = io.ReadFull(r, head); err != nil {
+		return nil, ErrNotMP4
+	}
+	info := &Info{ContentType: Sniff(head)}
+	if info.ContentType == "" {
+		return nil, ErrNotMP4
+	}
+
+	rd := &reader{r: r}
+	file := box{typ: "file", start: 0, end: size}
+	moov, ok := rd.find(file, "moov")
+	if !ok {
+		return nil, ErrNotMP4
+	}
+	if mvhd, ok := rd.find(moov, "mvhd"); ok {
+		data, err := rd.read(mvhd)
+		if err != nil {
+			return nil, err
+		}
+		info.Duration = movieDuration(data)
+	}
+
+	traks, err := rd.boxes(moov.start, moov.end)
+	if err != nil {
+		return nil, err
+	}
+	for _, trak := range traks {
+		if trak.typ != "trak" || !rd.isVideo(trak) {
+			continue
+		}
+		if tkhd, ok := rd.find(trak, "tkhd"); ok {
+			if data, err := rd.read(tkhd); err == nil {
+				info.Width, info.Height = trackSize(data)
+			}
+		}
+		if stsd, ok := rd.path(trak, "mdia", "minf", "stbl", "stsd"); ok {
+			//the sample description is small, its tables live in other boxes
+			if data, err := rd.read(stsd); err == nil && len(data) >= 16 {
+				fourcc := string(data[12:16])
+				info.Codec = codecs[fourcc]
+				if info.Codec == "" {
+					info.Codec = strings.TrimSpace(fourcc)
+				}
+				//the visual sample entry has the coded size, used when the track header has none
+				if info.Width == 0 && len(data) >= 44 {
+					info.Width = int(binary.BigEndian.Uint16(data[40:42]))
+					info.Height = int(binary.BigEndian.Uint16(data[42:44]))
+				}
+			}
+		}
+		break
+	}
+	info.Cover = rd.cover(moov)
+	return info, nil
+}
+
+// isVideo() reports if a track holds video
+func (rd *reader) isVideo(trak box) bool {
+	hdlr, ok := rd.path(trak, "mdia", "hdlr")
+	if !ok {
+		return false
+	}
+	data, err := rd.read(hdlr)
+	return err == nil && len(data) >= 12 && string(data[8:12]) == "vide"
+}
+
+// cover() returns the cover art stored in moov/udta/meta/ilst/covr/data
+func (rd *reader) cover(moov box) []byte {
+	meta, ok := rd.path(moov, "udta", "meta")
+	if !ok {
+		return nil
+	}
+	//in MP4 files meta has a version and flags before its children, in QuickTime files it doesn't
+	if _, err := rd.r.Seek(meta.start, io.SeekStart); err == nil {
+		var prefix [4]byte
+		if _, err := io.ReadFull(rd.r, prefix[:]); err == nil && prefix == [4]byte{} {
+			meta.start += 4
+		}
+	}
+	data, ok := rd.path(meta, "ilst", "covr", "data")
+	if !ok {
+		return nil
+	}
+	content, err := rd.read(data)
+	//the image follows a type indicator and a locale
+	if err != nil || len(content) <= 8 {
+		return nil
+	}
+	return content[8:]
+}
+
+// movieDuration() reads the duration out of an mvhd box
+func movieDuration(data []byte) time.Duration {
+	var timescale, duration uint64
+	switch {
+	case len(data) >= 32 && data[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(data[20:24]))
+		duration = binary.BigEndian.Uint64(data[24:32])
+	case len(data) >= 20:
+		timescale = uint64(binary.BigEndian.Uint32(data[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+	}
+	if timescale == 0 {
+		return 0
+	}
+	//compare in seconds before multiplying, a hostile header could make the product overflow
+	//into a short or negative duration. the longest time.Duration is over any upload limit
+	if duration/timescale >= uint64(maxDuration/time.Second) {
+		return maxDuration
+	}
+	return time.Duration(duration/timescale*uint64(time.Second)) +
+		time.Duration(duration%timescale*uint64(time.Second)/timescale)
+}
+
+// trackSize() reads the display width and height out of a tkhd box. they are 16.16 fixed point
+func trackSize(data []byte) (int, int) {
+	offset := 76
+	if len(data) > 0 && data[0] == 1 {
+		offset = 88
+	}
+	if len(data) < offset+8 {
+		return 0, 0
+	}
+	return int(binary.BigEndian.Uint32(data[offset:]) >> 16), int(binary.BigEndian.Uint32(data[offset+4:]) >> 16)
+}
@@ -0,0 +1,185 @@
+//Filename: internal/mp4/mp4_test.go
+
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// mkbox() returns a box with a 32 bit size holding the given content
+func mkbox(typ string, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+	b := appendUint32(nil, uint32(8+len(body)))
+	return append(append(b, typ...), body...)
+}
+
+// mvhd() returns the content of a movie header of the given version
+func mvhd(version byte, timescale uint32, duration uint64) []byte {
+	if version == 1 {
+		data := make([]byte, 32)
+		data[0] = 1
+		binary.BigEndian.PutUint32(data[20:], timescale)
+		binary.BigEndian.PutUint64(data[24:], duration)
+		return data
+	}
+	data := make([]byte, 20)
+	binary.BigEndian.PutUint32(data[12:], timescale)
+	binary.BigEndian.PutUint32(data[16:], uint32(duration))
+	return data
+}
+
+// movie() returns a file with one 1920x1080 h264 track lasting 90.5 seconds and cover art.
+// versioned says if the meta box starts with a version and flags, as it does in MP4 files
+func movie(brand string, versioned bool) []byte {
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 1920<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 1080<<16)
+	hdlr := append(make([]byte, 8), "vide"...)
+	stsd := append(make([]byte, 12), "avc1"...)
+	var prefix []byte
+	if versioned {
+		prefix = make([]byte, 4)
+	}
+	cover := append(make([]byte, 8), "cover"...)
+	return bytes.Join([][]byte{
+		mkbox("ftyp", []byte(brand), make([]byte, 4)),
+		mkbox("moov",
+			mkbox("mvhd", mvhd(0, 1000, 90500)),
+			mkbox("trak",
+				mkbox("tkhd", tkhd),
+				mkbox("mdia",
+					mkbox("hdlr", hdlr),
+					mkbox("minf", mkbox("stbl", mkbox("stsd", stsd))),
+				),
+			),
+			mkbox("udta", mkbox("meta", prefix, mkbox("ilst", mkbox("covr", mkbox("data", cover))))),
+		),
+		mkbox("mdat", make([]byte, 16)),
+	}, nil)
+}
+
+func TestMovieDuration(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want time.Duration
+	}{
+		{"version 0", mvhd(0, 1000, 90500), 90500 * time.Millisecond},
+		{"version 1", mvhd(1, 90000, 1<<33), time.Duration(1<<33) * time.Second / 90000},
+		{"fractional seconds", mvhd(0, 3, 4), time.Second + time.Second/3},
+		{"zero timescale", mvhd(1, 0, 1000), 0},
+		{"huge duration", mvhd(1, 1, math.MaxUint64), maxDuration},
+		{"just under the limit", mvhd(1, 1, uint64(maxDuration/time.Second)-1), (maxDuration/time.Second - 1) * time.Second},
+		{"truncated", mvhd(0, 1000, 90500)[:19], 0},
+		{"empty", nil, 0},
+	}
+	for _, tt := range tests {
+		if got := movieDuration(tt.data); got != tt.want {
+			t.Errorf("movieDuration(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBoxes(t *testing.T) {
+	large := appendUint32(nil, 1)
+	large = append(large, "mdat"...)
+	large = appendUint64(large, 20)
+	large = append(large, "abcd"...)
+
+	tests := []struct {
+		name string
+		file []byte
+		want []box
+		err  error
+	}{
+		{"two boxes", append(mkbox("free", []byte("ab")), mkbox("skip")...),
+			[]box{{"free", 8, 10}, {"skip", 18, 18}}, nil},
+		{"64 bit size", large, []box{{"mdat", 16, 20}}, nil},
+		{"64 bit size cut short", large[:12], nil, ErrNotMP4},
+		{"64 bit size past the end", large[:18], nil, ErrNotMP4},
+		{"64 bit size below its header", append(append([]byte{}, large[:8]...), 0, 0, 0, 0, 0, 0, 0, 15), nil, ErrNotMP4},
+		{"size 0 runs to the end", append([]byte{0, 0, 0, 0}, "mdat1234"...), []box{{"mdat", 8, 12}}, nil},
+		{"size past the end", append([]byte{0, 0, 0, 100}, "mdat1234"...), nil, ErrNotMP4},
+		{"size below its header", append([]byte{0, 0, 0, 4}, "mdat1234"...), nil, ErrNotMP4},
+		{"size past the end in a later box", append(mkbox("free"), 0xFF, 0xFF, 0xFF, 0xFF, 'm', 'd', 'a', 't'), nil, ErrNotMP4},
+		//a trailing fragment too short for a header is not a box
+		{"trailing bytes", append(mkbox("free"), 0, 0, 0), []box{{"free", 8, 8}}, nil},
+	}
+	for _, tt := range tests {
+		rd := &reader{r: bytes.NewReader(tt.file)}
+		got, err := rd.boxes(0, int64(len(tt.file)))
+		if !errors.Is(err, tt.err) {
+			t.Errorf("boxes(%s) err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("boxes(%s) = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("boxes(%s) = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        []byte
+		contentType string
+	}{
+		{"mp4", movie("isom", true), "video/mp4"},
+		{"quicktime meta without a version", movie("qt  ", false), "video/quicktime"},
+	}
+	for _, tt := range tests {
+		info, err := Parse(bytes.NewReader(tt.file))
+		if err != nil {
+			t.Errorf("Parse(%s) err = %v", tt.name, err)
+			continue
+		}
+		if info.ContentType != tt.contentType || info.Duration != 90500*time.Millisecond ||
+			info.Width != 1920 || info.Height != 1080 || info.Codec != "h264" || string(info.Cover) != "cover" {
+			t.Errorf("Parse(%s) = %+v, want a %s 1920x1080 h264 movie of 1m30.5s with a cover", tt.name, *info, tt.contentType)
+		}
+	}
+
+	broken := []struct {
+		name string
+		file []byte
+	}{
+		{"empty", nil},
+		{"not a movie", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")},
+		{"no moov", append(mkbox("ftyp", []byte("isom"), make([]byte, 4)), mkbox("mdat", make([]byte, 8))...)},
+		{"moov past the end", append(mkbox("ftyp", []byte("isom"), make([]byte, 4)), 0, 0, 1, 0, 'm', 'o', 'o', 'v')},
+	}
+	for _, tt := range broken {
+		if _, err := Parse(bytes.NewReader(tt.file)); !errors.Is(err, ErrNotMP4) {
+			t.Errorf("Parse(%s) err = %v, want %v", tt.name, err, ErrNotMP4)
+		}
+	}
+
+	//a file cut short anywhere is refused or read for what it holds, never a panic
+	file := movie("isom", true)
+	for n := range file {
+		info, err := Parse(bytes.NewReader(file[:n]))
+		if err == nil && info.Duration != 0 && info.Duration != 90500*time.Millisecond {
+			t.Errorf("Parse() of %d bytes: Duration = %s", n, info.Duration)
+		}
+	}
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,133 @@
+//Filename: internal/storage/storage.go
+
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("storage: object not found")
+	ErrInvalidKey = errors.New("storage: invalid key")
+)
+
+// Info describes a stored object
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is where uploaded files are kept. keys are slash separated paths
+type Storage interface {
+	// Put() stores everything read from r under key, replacing any existing object
+	Put(key string, r io.Reader) (int64, error)
+	// Open() returns the object for reading. the caller must close it
+	Open(key string) (io.ReadSeekCloser, Info, error)
+	// Stat() returns information about the object
+	Stat(key string) (Info, error)
+	// Delete() removes the object. removing a missing object is not an error
+	Delete(key string) error
+}
+
+// FileSystem keeps objects as files below a root directory
+type FileSystem struct {
+	root string
+}
+
+// NewFileSystem() creates a FileSystem storage rooted at dir, creating the directory if needed
+func NewFileSystem(dir string) (*FileSystem, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSystem{root: dir}, nil
+}
+
+// path() maps a key to a file below the root
+func (fs *FileSystem) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "..") || strings.Contains(key, `\`) {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(fs.root, filepath.FromSlash(key)), nil
+}
+
+// Put() writes to a temporary file first so readers never see a partial object
+func (fs *FileSystem) Put(key string, r io.Reader) (int64, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return 0, err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return 0, err
+	}
+	//the temporary file is gone once it has been renamed
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return 0, err
+	}
+	return n, os.Rename(tmp.Name(), path)
+}
+
+func (fs *FileSystem) Open(key string) (io.ReadSeekCloser, Info, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, Info{}, ErrNotFound
+		}
+		return nil, Info{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, Info{}, err
+	}
+	return f, Info{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (fs *FileSystem) Stat(key string) (Info, error) {
+	path, err := fs.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Info{}, ErrNotFound
+		}
+		return Info{}, err
+	}
+	return Info{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (fs *FileSystem) Delete(key string) error {
+	path, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,5 @@
+-- Filename: migrations/000006_create_photo_revisions_table.down.sql
+
+ALTER TABLE photos DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE photos DROP COLUMN IF EXISTS updated_by;
+DROP TABLE IF EXISTS photo_revisions;
@@ -0,0 +1,19 @@
+-- Filename: migrations/000006_create_photo_revisions_table.up.sql
+
+--every time a photo is updated the version being replaced is copied here
+CREATE TABLE IF NOT EXISTS photo_revisions (
+    photo_id bigint NOT NULL REFERENCES photos (id) ON DELETE CASCADE,
+    version integer NOT NULL,
+    title text NOT NULL,
+    photo text NOT NULL,
+    description text NOT NULL,
+    changed_by bigint REFERENCES users (id) ON DELETE SET NULL,
+    changed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (photo_id, version)
+);
+
+--who wrote the current version of a photo and when, so a revision can be credited to its
+--author when it is archived. a photo that was never edited was written by its owner when
+--it was created, so both are left NULL
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS updated_by bigint REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS updated_at timestamp(0) with time zone;
@@ -0,0 +1,8 @@
+-- Filename: migrations/000007_add_photos_search.down.sql
+
+DROP INDEX IF EXISTS photos_tags_idx;
+DROP INDEX IF EXISTS photos_search_idx;
+ALTER TABLE photos DROP COLUMN IF EXISTS search;
+DROP FUNCTION IF EXISTS photos_tags_to_text(text[]);
+ALTER TABLE photos DROP COLUMN IF EXISTS language;
+ALTER TABLE photos DROP COLUMN IF EXISTS tags;
@@ -0,0 +1,21 @@
+-- Filename: migrations/000007_add_photos_search.up.sql
+
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS tags text[] NOT NULL DEFAULT '{}';
+--the text search configuration used to index the photo (simple, english, spanish ...)
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS language regconfig NOT NULL DEFAULT 'simple';
+
+--array_to_string() is only STABLE so it cannot be used in a generated column directly.
+--for a text[] the result never changes so it is safe to mark the wrapper IMMUTABLE
+CREATE OR REPLACE FUNCTION photos_tags_to_text(text[]) RETURNS text
+    LANGUAGE sql IMMUTABLE PARALLEL SAFE
+    AS $$ SELECT array_to_string($1, ' ') $$;
+
+--title ranks above description which ranks above tags
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector(language, title), 'A') ||
+    setweight(to_tsvector(language, description), 'B') ||
+    setweight(to_tsvector(language, photos_tags_to_text(tags)), 'C')
+) STORED;
+
+CREATE INDEX IF NOT EXISTS photos_search_idx ON photos USING GIN(search);
+CREATE INDEX IF NOT EXISTS photos_tags_idx ON photos USING GIN(tags);
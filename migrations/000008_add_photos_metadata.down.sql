@@ -0,0 +1,10 @@
+-- Filename: migrations/000008_add_photos_metadata.down.sql
+
+DROP INDEX IF EXISTS photos_album_idx;
+DROP INDEX IF EXISTS photos_taken_at_idx;
+DROP INDEX IF EXISTS photos_user_id_idx;
+ALTER TABLE photos DROP COLUMN IF EXISTS visibility;
+ALTER TABLE photos DROP COLUMN IF EXISTS album;
+ALTER TABLE photos DROP COLUMN IF EXISTS camera_model;
+ALTER TABLE photos DROP COLUMN IF EXISTS taken_at;
+ALTER TABLE photos DROP COLUMN IF EXISTS user_id;
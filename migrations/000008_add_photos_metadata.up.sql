@@ -0,0 +1,12 @@
+-- Filename: migrations/000008_add_photos_metadata.up.sql
+
+--photos created before owners were recorded have no owner and stay public
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS user_id bigint REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS taken_at timestamp(0) with time zone;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS camera_model text NOT NULL DEFAULT '';
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS album text NOT NULL DEFAULT '';
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS visibility text NOT NULL DEFAULT 'public';
+
+CREATE INDEX IF NOT EXISTS photos_user_id_idx ON photos (user_id);
+CREATE INDEX IF NOT EXISTS photos_taken_at_idx ON photos (taken_at);
+CREATE INDEX IF NOT EXISTS photos_album_idx ON photos (album);
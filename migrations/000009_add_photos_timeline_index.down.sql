@@ -0,0 +1,3 @@
+-- Filename: migrations/000009_add_photos_timeline_index.down.sql
+
+DROP INDEX IF EXISTS photos_timeline_idx;
@@ -0,0 +1,4 @@
+-- Filename: migrations/000009_add_photos_timeline_index.up.sql
+
+--the timeline orders photos by capture time, falling back to when they were added
+CREATE INDEX IF NOT EXISTS photos_timeline_idx ON photos ((COALESCE(taken_at, created_at)) DESC, id DESC);
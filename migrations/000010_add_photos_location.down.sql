@@ -0,0 +1,8 @@
+-- Filename: migrations/000010_add_photos_location.down.sql
+
+DROP INDEX IF EXISTS photos_geohash_idx;
+DROP INDEX IF EXISTS photos_location_idx;
+ALTER TABLE photos DROP CONSTRAINT IF EXISTS photos_location_check;
+ALTER TABLE photos DROP COLUMN IF EXISTS geohash;
+ALTER TABLE photos DROP COLUMN IF EXISTS longitude;
+ALTER TABLE photos DROP COLUMN IF EXISTS latitude;
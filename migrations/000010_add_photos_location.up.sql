@@ -0,0 +1,17 @@
+-- Filename: migrations/000010_add_photos_location.up.sql
+
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS latitude double precision;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS longitude double precision;
+--the geohash is computed by the application whenever the location changes.
+--nearby photos share a prefix which is what the map clusters on
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS geohash text COLLATE "C";
+
+ALTER TABLE photos ADD CONSTRAINT photos_location_check CHECK (
+    (latitude IS NULL) = (longitude IS NULL)
+    AND latitude BETWEEN -90 AND 90
+    AND longitude BETWEEN -180 AND 180
+);
+
+--bounding box and radius searches range over latitude then longitude
+CREATE INDEX IF NOT EXISTS photos_location_idx ON photos (latitude, longitude) WHERE latitude IS NOT NULL;
+CREATE INDEX IF NOT EXISTS photos_geohash_idx ON photos (geohash) WHERE geohash IS NOT NULL;
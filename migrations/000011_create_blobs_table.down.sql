@@ -0,0 +1,12 @@
+-- Filename: migrations/000011_create_blobs_table.down.sql
+
+ALTER TABLE photos DROP COLUMN IF EXISTS taken_at_local;
+DROP INDEX IF EXISTS photos_user_id_blob_hash_unique_idx;
+ALTER TABLE photos DROP COLUMN IF EXISTS unique_content;
+DROP TRIGGER IF EXISTS photos_release_blobs ON photos;
+DROP FUNCTION IF EXISTS photos_release_blobs();
+DROP INDEX IF EXISTS photos_user_id_blob_hash_idx;
+ALTER TABLE photos DROP COLUMN IF EXISTS height;
+ALTER TABLE photos DROP COLUMN IF EXISTS width;
+ALTER TABLE photos DROP COLUMN IF EXISTS blob_hash;
+DROP TABLE IF EXISTS blobs;
@@ -0,0 +1,40 @@
+-- Filename: migrations/000011_create_blobs_table.up.sql
+
+--uploaded originals are stored once per content hash and shared by every photo using them
+CREATE TABLE IF NOT EXISTS blobs (
+    hash text PRIMARY KEY,
+    size bigint NOT NULL,
+    content_type text NOT NULL,
+    ref_count integer NOT NULL DEFAULT 0 CHECK (ref_count >= 0),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS blob_hash text REFERENCES blobs (hash);
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS width integer NOT NULL DEFAULT 0;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS height integer NOT NULL DEFAULT 0;
+
+--finds an owner's earlier upload of the same bytes
+CREATE INDEX IF NOT EXISTS photos_user_id_blob_hash_idx ON photos (user_id, blob_hash) WHERE blob_hash IS NOT NULL;
+
+--a photo's reference to its original is dropped whenever the photo goes, including when its
+--owner is deleted and the photos go with them. the blob is then collected by the server
+CREATE OR REPLACE FUNCTION photos_release_blobs() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = OLD.blob_hash;
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER photos_release_blobs AFTER DELETE ON photos
+    FOR EACH ROW EXECUTE FUNCTION photos_release_blobs();
+
+--photos uploaded without on_duplicate=allow are the only photo of their original for their
+--owner, so concurrent uploads of the same bytes can't both create one
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS unique_content boolean NOT NULL DEFAULT false;
+CREATE UNIQUE INDEX IF NOT EXISTS photos_user_id_blob_hash_unique_idx ON photos (user_id, blob_hash)
+    WHERE unique_content;
+
+--the capture time read from EXIF without an offset is the camera's clock, not UTC
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS taken_at_local boolean NOT NULL DEFAULT false;
@@ -0,0 +1,7 @@
+-- Filename: migrations/000012_add_photos_phash.down.sql
+
+ALTER TABLE photos DROP COLUMN IF EXISTS phash_b3;
+ALTER TABLE photos DROP COLUMN IF EXISTS phash_b2;
+ALTER TABLE photos DROP COLUMN IF EXISTS phash_b1;
+ALTER TABLE photos DROP COLUMN IF EXISTS phash_b0;
+ALTER TABLE photos DROP COLUMN IF EXISTS phash;
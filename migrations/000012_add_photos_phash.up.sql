@@ -0,0 +1,16 @@
+-- Filename: migrations/000012_add_photos_phash.up.sql
+
+--the perceptual (difference) hash of the original, stored as a signed 64 bit integer
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS phash bigint;
+
+--the hash split into four 16 bit bands. two hashes within 3 bits of each other
+--must have at least one identical band, so close matches are found through these indexes
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS phash_b0 integer GENERATED ALWAYS AS ((phash >> 48) & 65535) STORED;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS phash_b1 integer GENERATED ALWAYS AS ((phash >> 32) & 65535) STORED;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS phash_b2 integer GENERATED ALWAYS AS ((phash >> 16) & 65535) STORED;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS phash_b3 integer GENERATED ALWAYS AS (phash & 65535) STORED;
+
+CREATE INDEX IF NOT EXISTS photos_phash_b0_idx ON photos (phash_b0) WHERE phash IS NOT NULL;
+CREATE INDEX IF NOT EXISTS photos_phash_b1_idx ON photos (phash_b1) WHERE phash IS NOT NULL;
+CREATE INDEX IF NOT EXISTS photos_phash_b2_idx ON photos (phash_b2) WHERE phash IS NOT NULL;
+CREATE INDEX IF NOT EXISTS photos_phash_b3_idx ON photos (phash_b3) WHERE phash IS NOT NULL;
@@ -0,0 +1,22 @@
+-- Filename: migrations/000013_create_idempotency_keys_table.up.sql
+
+--the responses to requests sent with an Idempotency-Key header, replayed when the request is retried.
+--status is NULL while the first request is still running. a request claims its key by writing
+--lock_token and keeps it locked by moving locked_until forward while it runs, instead of holding
+--a transaction open. a key whose request stopped without finishing is taken over once
+--locked_until has passed
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    key text NOT NULL,
+    fingerprint bytea NOT NULL,
+    status integer,
+    lock_token bytea,
+    locked_until timestamp(0) with time zone,
+    headers jsonb NOT NULL DEFAULT '{}',
+    body bytea NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expires_at timestamp(0) with time zone NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
@@ -0,0 +1,3 @@
+-- Filename: migrations/000014_create_uploads_table.down.sql
+
+DROP TABLE IF EXISTS uploads;
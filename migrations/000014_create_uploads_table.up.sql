@@ -0,0 +1,17 @@
+-- Filename: migrations/000014_create_uploads_table.up.sql
+
+--resumable (tus) uploads. the bytes received so far are kept as one stored chunk per PATCH,
+--chunk_keys lists their storage keys in order. photo_id is set once the upload became a photo
+CREATE TABLE IF NOT EXISTS uploads (
+    id text PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    length bigint NOT NULL CHECK (length >= 0),
+    "offset" bigint NOT NULL DEFAULT 0 CHECK ("offset" >= 0 AND "offset" <= length),
+    chunk_keys text[] NOT NULL DEFAULT '{}',
+    metadata jsonb NOT NULL DEFAULT '{}',
+    photo_id bigint REFERENCES photos ON DELETE SET NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expires_at timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS uploads_expires_at_idx ON uploads (expires_at);
@@ -0,0 +1,18 @@
+-- Filename: migrations/000015_add_photos_media.down.sql
+
+--only the original is released again
+CREATE OR REPLACE FUNCTION photos_release_blobs() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = OLD.blob_hash;
+    RETURN NULL;
+END
+$$;
+
+DROP INDEX IF EXISTS photos_media_type_idx;
+ALTER TABLE photos DROP COLUMN IF EXISTS poster_blob_hash;
+ALTER TABLE photos DROP COLUMN IF EXISTS motion_blob_hash;
+ALTER TABLE photos DROP COLUMN IF EXISTS codec;
+ALTER TABLE photos DROP COLUMN IF EXISTS duration_ms;
+ALTER TABLE photos DROP COLUMN IF EXISTS media_type;
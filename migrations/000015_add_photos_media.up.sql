@@ -0,0 +1,25 @@
+-- Filename: migrations/000015_add_photos_media.up.sql
+
+--a photo is a still image, a short video or a live photo (a still with a short motion clip)
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS media_type text NOT NULL DEFAULT 'photo'
+    CHECK (media_type IN ('photo', 'video', 'live'));
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS duration_ms bigint NOT NULL DEFAULT 0;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS codec text NOT NULL DEFAULT '';
+--the motion clip of a live photo and the poster frame of a video
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS motion_blob_hash text REFERENCES blobs (hash);
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS poster_blob_hash text REFERENCES blobs (hash);
+
+CREATE INDEX IF NOT EXISTS photos_media_type_idx ON photos (media_type);
+
+--deleting a photo releases its motion clip and poster as well as its original
+CREATE OR REPLACE FUNCTION photos_release_blobs() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    --one update each, a photo holds a reference per file even when two are the same bytes
+    UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = OLD.blob_hash;
+    UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = OLD.motion_blob_hash;
+    UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = OLD.poster_blob_hash;
+    RETURN NULL;
+END
+$$;
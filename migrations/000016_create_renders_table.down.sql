@@ -0,0 +1,4 @@
+-- Filename: migrations/000016_create_renders_table.down.sql
+
+DROP INDEX IF EXISTS renders_blob_hash_idx;
+DROP TABLE IF EXISTS renders;
@@ -0,0 +1,13 @@
+-- Filename: migrations/000016_create_renders_table.up.sql
+
+--resized and re-encoded copies of originals, cached in the storage under key.
+--they are removed along with the original they were made from
+CREATE TABLE IF NOT EXISTS renders (
+    key text PRIMARY KEY,
+    blob_hash text NOT NULL REFERENCES blobs (hash) ON DELETE CASCADE,
+    size bigint NOT NULL,
+    content_type text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS renders_blob_hash_idx ON renders (blob_hash);
@@ -0,0 +1,8 @@
+-- Filename: migrations/000017_create_watermarks_table.down.sql
+
+DROP INDEX IF EXISTS renders_watermark_id_idx;
+ALTER TABLE renders DROP COLUMN IF EXISTS watermark_id;
+DROP TRIGGER IF EXISTS watermarks_release_logo ON watermarks;
+DROP FUNCTION IF EXISTS watermarks_release_logo();
+DROP INDEX IF EXISTS watermarks_user_id_album_idx;
+DROP TABLE IF EXISTS watermarks;
@@ -0,0 +1,37 @@
+-- Filename: migrations/000017_create_watermarks_table.up.sql
+
+--how a user's photos are watermarked when others see them. a row with an album applies
+--to that album, the row without one to every other album
+CREATE TABLE IF NOT EXISTS watermarks (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    album text,
+    text text NOT NULL DEFAULT '',
+    logo_blob_hash text REFERENCES blobs (hash),
+    position text NOT NULL DEFAULT 'bottom-right'
+        CHECK (position IN ('top-left', 'top-right', 'bottom-left', 'bottom-right', 'center')),
+    opacity real NOT NULL DEFAULT 0.5 CHECK (opacity >= 0 AND opacity <= 1),
+    scale real NOT NULL DEFAULT 0.2 CHECK (scale > 0 AND scale <= 1),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS watermarks_user_id_album_idx ON watermarks (user_id, COALESCE(album, ''));
+
+--a watermark's reference to its logo is dropped whenever the watermark goes, including when
+--its user is deleted and the watermarks go with them. the blob is then collected by the server
+CREATE OR REPLACE FUNCTION watermarks_release_logo() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = OLD.logo_blob_hash;
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER watermarks_release_logo AFTER DELETE ON watermarks
+    FOR EACH ROW WHEN (OLD.logo_blob_hash IS NOT NULL) EXECUTE FUNCTION watermarks_release_logo();
+
+--renders made with a watermark are thrown away when it changes
+ALTER TABLE renders ADD COLUMN IF NOT EXISTS watermark_id bigint REFERENCES watermarks (id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS renders_watermark_id_idx ON renders (watermark_id) WHERE watermark_id IS NOT NULL;
@@ -0,0 +1,7 @@
+-- Filename: migrations/000018_add_photos_colors.down.sql
+
+ALTER TABLE photos DROP COLUMN IF EXISTS palette_b;
+ALTER TABLE photos DROP COLUMN IF EXISTS palette_a;
+ALTER TABLE photos DROP COLUMN IF EXISTS palette_l;
+ALTER TABLE photos DROP COLUMN IF EXISTS average_color;
+ALTER TABLE photos DROP COLUMN IF EXISTS palette;
@@ -0,0 +1,9 @@
+-- Filename: migrations/000018_add_photos_colors.up.sql
+
+--the dominant colors of a photo as #rrggbb, most common first, and its average color.
+--the palette is also kept in CIELAB, one array per component, for color search
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS palette text[] NOT NULL DEFAULT '{}';
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS average_color text;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS palette_l real[] NOT NULL DEFAULT '{}';
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS palette_a real[] NOT NULL DEFAULT '{}';
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS palette_b real[] NOT NULL DEFAULT '{}';
@@ -0,0 +1,3 @@
+-- Filename: migrations/000019_add_photos_blurhash.down.sql
+
+ALTER TABLE photos DROP COLUMN IF EXISTS blurhash;
@@ -0,0 +1,4 @@
+-- Filename: migrations/000019_add_photos_blurhash.up.sql
+
+--a placeholder clients show while the image loads, see blurha.sh
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS blurhash text;
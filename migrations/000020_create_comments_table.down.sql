@@ -0,0 +1,6 @@
+-- Filename: migrations/000020_create_comments_table.down.sql
+
+DELETE FROM permissions WHERE code = 'comment:write';
+ALTER TABLE photos DROP COLUMN IF EXISTS comments_disabled;
+DROP INDEX IF EXISTS comments_photo_id_idx;
+DROP TABLE IF EXISTS comments;
@@ -0,0 +1,32 @@
+-- Filename: migrations/000020_create_comments_table.up.sql
+
+--comments on photos. a reply points at a top level comment, replies are not nested further.
+--deleted comments keep their row (deleted_at is set) so their replies still have a parent
+CREATE TABLE IF NOT EXISTS comments (
+    id bigserial PRIMARY KEY,
+    photo_id bigint NOT NULL REFERENCES photos ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    parent_id bigint REFERENCES comments ON DELETE CASCADE,
+    body text NOT NULL,
+    hidden boolean NOT NULL DEFAULT false,
+    deleted_at timestamp(0) with time zone,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS comments_photo_id_idx ON comments (photo_id, created_at);
+
+--the owner of a photo can turn its comments off
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS comments_disabled boolean NOT NULL DEFAULT false;
+
+--everyone who can read photos could already see them, now they can comment too
+INSERT INTO permissions (code)
+VALUES ('comment:write');
+
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT users_permissions.user_id, (SELECT id FROM permissions WHERE code = 'comment:write')
+FROM users_permissions
+INNER JOIN permissions ON permissions.id = users_permissions.permission_id
+WHERE permissions.code = 'photo:read'
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,8 @@
+-- Filename: migrations/000021_create_favorites_and_reactions.down.sql
+
+ALTER TABLE photos DROP COLUMN IF EXISTS reactions_version;
+ALTER TABLE photos DROP COLUMN IF EXISTS reaction_counts;
+ALTER TABLE photos DROP COLUMN IF EXISTS favorites;
+DROP TABLE IF EXISTS reactions;
+DROP INDEX IF EXISTS favorites_photo_id_idx;
+DROP TABLE IF EXISTS favorites;
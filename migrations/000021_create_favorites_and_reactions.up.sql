@@ -0,0 +1,24 @@
+-- Filename: migrations/000021_create_favorites_and_reactions.up.sql
+
+CREATE TABLE IF NOT EXISTS favorites (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    photo_id bigint NOT NULL REFERENCES photos ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, photo_id)
+);
+
+CREATE INDEX IF NOT EXISTS favorites_photo_id_idx ON favorites (photo_id);
+
+CREATE TABLE IF NOT EXISTS reactions (
+    photo_id bigint NOT NULL REFERENCES photos ON DELETE CASCADE,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    emoji text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (photo_id, user_id, emoji)
+);
+
+--the counts are kept on the photo so listings can show and sort by them without a join.
+--reactions_version is bumped by every favorite and reaction so ETags change with the counts
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS favorites integer NOT NULL DEFAULT 0;
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS reaction_counts jsonb NOT NULL DEFAULT '{}';
+ALTER TABLE photos ADD COLUMN IF NOT EXISTS reactions_version integer NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+-- Filename: migrations/000022_create_notifications_table.down.sql
+
+DROP TABLE IF EXISTS notification_digests;
+DROP TABLE IF EXISTS notification_preferences;
+DROP INDEX IF EXISTS notifications_unread_idx;
+DROP INDEX IF EXISTS notifications_user_id_idx;
+DROP TABLE IF EXISTS notifications;
@@ -0,0 +1,34 @@
+-- Filename: migrations/000022_create_notifications_table.up.sql
+
+--something another user did that concerns user_id. comment_id and emoji are set
+--for the types that have them
+CREATE TABLE IF NOT EXISTS notifications (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    actor_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    type text NOT NULL CHECK (type IN ('comment', 'reply', 'reaction', 'favorite')),
+    photo_id bigint NOT NULL REFERENCES photos ON DELETE CASCADE,
+    comment_id bigint REFERENCES comments ON DELETE CASCADE,
+    emoji text,
+    read_at timestamp(0) with time zone,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, id);
+CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications (user_id, id) WHERE read_at IS NULL;
+
+--a type without a row is shown in the feed and emailed in the digest
+CREATE TABLE IF NOT EXISTS notification_preferences (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    type text NOT NULL,
+    in_app boolean NOT NULL DEFAULT true,
+    email boolean NOT NULL DEFAULT true,
+    PRIMARY KEY (user_id, type)
+);
+
+--how often unread notifications are emailed. a user without a row gets a weekly digest
+CREATE TABLE IF NOT EXISTS notification_digests (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    frequency text NOT NULL DEFAULT 'weekly' CHECK (frequency IN ('off', 'daily', 'weekly')),
+    last_sent_at timestamp(0) with time zone
+);
@@ -0,0 +1,13 @@
+-- Filename: migrations/000023_create_events_table.down.sql
+
+DROP TRIGGER IF EXISTS notifications_events ON notifications;
+DROP FUNCTION IF EXISTS notifications_events();
+DROP TRIGGER IF EXISTS comments_events ON comments;
+DROP FUNCTION IF EXISTS comments_events();
+DROP TRIGGER IF EXISTS photos_events_update ON photos;
+DROP TRIGGER IF EXISTS photos_events ON photos;
+DROP FUNCTION IF EXISTS photos_events();
+DROP TRIGGER IF EXISTS events_notify ON events;
+DROP FUNCTION IF EXISTS events_notify();
+DROP INDEX IF EXISTS events_created_at_idx;
+DROP TABLE IF EXISTS events;
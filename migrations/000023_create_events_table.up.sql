@@ -0,0 +1,101 @@
+-- Filename: migrations/000023_create_events_table.up.sql
+
+--a log of changes streamed to clients by GET /v1/events. user_id, when set, is the only
+--user who may see the event, otherwise everyone may. old events are deleted by the server.
+--there are no foreign keys, events outlive the rows they are about.
+--clients resume after the last id they saw, so ids must be handed out in commit order: every
+--writer takes the events advisory lock before inserting and holds it until it commits
+CREATE TABLE IF NOT EXISTS events (
+    id bigserial PRIMARY KEY,
+    type text NOT NULL,
+    user_id bigint,
+    photo_id bigint NOT NULL,
+    data jsonb NOT NULL DEFAULT '{}',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS events_created_at_idx ON events (created_at);
+
+--every API instance LISTENs on the events channel. the payload is the id of the new event,
+--which is only delivered once the transaction that wrote it commits
+CREATE OR REPLACE FUNCTION events_notify() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    PERFORM pg_notify('events', NEW.id::text);
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER events_notify AFTER INSERT ON events
+    FOR EACH ROW EXECUTE FUNCTION events_notify();
+
+--the events are written by triggers so every way of changing a row is covered
+CREATE OR REPLACE FUNCTION photos_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    p photos;
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    IF TG_OP = 'DELETE' THEN
+        p := OLD;
+    ELSE
+        p := NEW;
+    END IF;
+    INSERT INTO events (type, user_id, photo_id, data)
+    VALUES (
+        CASE TG_OP WHEN 'INSERT' THEN 'photo.created' WHEN 'UPDATE' THEN 'photo.updated' ELSE 'photo.deleted' END,
+        CASE WHEN p.visibility = 'private' THEN p.user_id END,
+        p.id,
+        jsonb_build_object('id', p.id, 'version', p.version)
+    );
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER photos_events AFTER INSERT OR DELETE ON photos
+    FOR EACH ROW EXECUTE FUNCTION photos_events();
+CREATE TRIGGER photos_events_update AFTER UPDATE ON photos
+    FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION photos_events();
+
+--comments are seen by whoever sees their photo
+CREATE OR REPLACE FUNCTION comments_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    INSERT INTO events (type, user_id, photo_id, data)
+    SELECT
+        CASE
+            WHEN TG_OP = 'INSERT' THEN 'comment.created'
+            WHEN NEW.deleted_at IS NOT NULL AND OLD.deleted_at IS NULL THEN 'comment.deleted'
+            ELSE 'comment.updated'
+        END,
+        CASE WHEN photos.visibility = 'private' THEN photos.user_id END,
+        NEW.photo_id,
+        jsonb_build_object('id', NEW.id, 'photo_id', NEW.photo_id, 'parent_id', NEW.parent_id)
+    FROM photos
+    WHERE photos.id = NEW.photo_id;
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER comments_events AFTER INSERT OR UPDATE ON comments
+    FOR EACH ROW EXECUTE FUNCTION comments_events();
+
+--a notification is only seen by the user it is for
+CREATE OR REPLACE FUNCTION notifications_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    INSERT INTO events (type, user_id, photo_id, data)
+    VALUES ('notification.created', NEW.user_id, NEW.photo_id,
+        jsonb_build_object('id', NEW.id, 'type', NEW.type, 'photo_id', NEW.photo_id));
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER notifications_events AFTER INSERT ON notifications
+    FOR EACH ROW EXECUTE FUNCTION notifications_events();
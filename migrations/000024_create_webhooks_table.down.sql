@@ -0,0 +1,69 @@
+-- Filename: migrations/000024_create_webhooks_table.down.sql
+
+DROP TRIGGER IF EXISTS events_webhooks ON events;
+DROP FUNCTION IF EXISTS events_webhooks();
+
+--the event triggers as migration 000023 created them
+CREATE OR REPLACE FUNCTION photos_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    p photos;
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    IF TG_OP = 'DELETE' THEN
+        p := OLD;
+    ELSE
+        p := NEW;
+    END IF;
+    INSERT INTO events (type, user_id, photo_id, data)
+    VALUES (
+        CASE TG_OP WHEN 'INSERT' THEN 'photo.created' WHEN 'UPDATE' THEN 'photo.updated' ELSE 'photo.deleted' END,
+        CASE WHEN p.visibility = 'private' THEN p.user_id END,
+        p.id,
+        jsonb_build_object('id', p.id, 'version', p.version)
+    );
+    RETURN NULL;
+END
+$$;
+
+CREATE OR REPLACE FUNCTION comments_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    INSERT INTO events (type, user_id, photo_id, data)
+    SELECT
+        CASE
+            WHEN TG_OP = 'INSERT' THEN 'comment.created'
+            WHEN NEW.deleted_at IS NOT NULL AND OLD.deleted_at IS NULL THEN 'comment.deleted'
+            ELSE 'comment.updated'
+        END,
+        CASE WHEN photos.visibility = 'private' THEN photos.user_id END,
+        NEW.photo_id,
+        jsonb_build_object('id', NEW.id, 'photo_id', NEW.photo_id, 'parent_id', NEW.parent_id)
+    FROM photos
+    WHERE photos.id = NEW.photo_id;
+    RETURN NULL;
+END
+$$;
+
+CREATE OR REPLACE FUNCTION notifications_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    INSERT INTO events (type, user_id, photo_id, data)
+    VALUES ('notification.created', NEW.user_id, NEW.photo_id,
+        jsonb_build_object('id', NEW.id, 'type', NEW.type, 'photo_id', NEW.photo_id));
+    RETURN NULL;
+END
+$$;
+
+ALTER TABLE events DROP COLUMN IF EXISTS owner_id;
+
+DROP INDEX IF EXISTS webhook_deliveries_due_idx;
+DROP INDEX IF EXISTS webhook_deliveries_webhook_id_idx;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP INDEX IF EXISTS webhooks_user_id_idx;
+DROP TABLE IF EXISTS webhooks;
@@ -0,0 +1,124 @@
+-- Filename: migrations/000024_create_webhooks_table.up.sql
+
+--a user's subscription to the events about their photos and notifications. failures
+--counts the attempts that failed in a row, the server disables the webhook when it
+--gets too high
+CREATE TABLE IF NOT EXISTS webhooks (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    url text NOT NULL,
+    secret text NOT NULL,
+    events text[] NOT NULL,
+    failures integer NOT NULL DEFAULT 0,
+    disabled_at timestamp(0) with time zone,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    version integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_user_id_idx ON webhooks (user_id);
+
+--the queue of events to send to webhooks, kept afterwards as the log of what was sent.
+--payload is copied from the event so a delivery outlives it
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id bigserial PRIMARY KEY,
+    webhook_id bigint NOT NULL REFERENCES webhooks ON DELETE CASCADE,
+    event_id bigint NOT NULL,
+    event_type text NOT NULL,
+    payload jsonb NOT NULL,
+    status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'failed')),
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    response_code integer,
+    error text,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+--owner_id is the user an event is about: the owner of the photo, or whoever the
+--notification is for. it decides which webhooks the event goes to
+ALTER TABLE events ADD COLUMN IF NOT EXISTS owner_id bigint;
+
+CREATE OR REPLACE FUNCTION photos_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    p photos;
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    IF TG_OP = 'DELETE' THEN
+        p := OLD;
+    ELSE
+        p := NEW;
+    END IF;
+    INSERT INTO events (type, user_id, owner_id, photo_id, data)
+    VALUES (
+        CASE TG_OP WHEN 'INSERT' THEN 'photo.created' WHEN 'UPDATE' THEN 'photo.updated' ELSE 'photo.deleted' END,
+        CASE WHEN p.visibility = 'private' THEN p.user_id END,
+        p.user_id,
+        p.id,
+        jsonb_build_object('id', p.id, 'version', p.version)
+    );
+    RETURN NULL;
+END
+$$;
+
+CREATE OR REPLACE FUNCTION comments_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    INSERT INTO events (type, user_id, owner_id, photo_id, data)
+    SELECT
+        CASE
+            WHEN TG_OP = 'INSERT' THEN 'comment.created'
+            WHEN NEW.deleted_at IS NOT NULL AND OLD.deleted_at IS NULL THEN 'comment.deleted'
+            ELSE 'comment.updated'
+        END,
+        CASE WHEN photos.visibility = 'private' THEN photos.user_id END,
+        photos.user_id,
+        NEW.photo_id,
+        jsonb_build_object('id', NEW.id, 'photo_id', NEW.photo_id, 'parent_id', NEW.parent_id)
+    FROM photos
+    WHERE photos.id = NEW.photo_id;
+    RETURN NULL;
+END
+$$;
+
+CREATE OR REPLACE FUNCTION notifications_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    INSERT INTO events (type, user_id, owner_id, photo_id, data)
+    VALUES ('notification.created', NEW.user_id, NEW.user_id, NEW.photo_id,
+        jsonb_build_object('id', NEW.id, 'type', NEW.type, 'photo_id', NEW.photo_id));
+    RETURN NULL;
+END
+$$;
+
+--queue a delivery to every enabled webhook of the owner that subscribes to the event
+CREATE OR REPLACE FUNCTION events_webhooks() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+    SELECT webhooks.id, NEW.id, NEW.type, jsonb_build_object(
+        'id', NEW.id,
+        'type', NEW.type,
+        'photo_id', NEW.photo_id,
+        'data', NEW.data,
+        'created_at', NEW.created_at
+    )
+    FROM webhooks
+    WHERE webhooks.user_id = NEW.owner_id
+    AND webhooks.disabled_at IS NULL
+    AND NEW.type = ANY (webhooks.events);
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER events_webhooks AFTER INSERT ON events
+    FOR EACH ROW WHEN (NEW.owner_id IS NOT NULL) EXECUTE FUNCTION events_webhooks();
@@ -0,0 +1,5 @@
+-- Filename: migrations/000025_create_jobs_table.down.sql
+
+DROP INDEX IF EXISTS jobs_running_idx;
+DROP INDEX IF EXISTS jobs_pending_idx;
+DROP TABLE IF EXISTS jobs;
@@ -0,0 +1,99 @@
+-- Filename: migrations/000026_create_outbox_table.down.sql
+
+DROP TRIGGER IF EXISTS outbox_notify ON outbox;
+DROP FUNCTION IF EXISTS outbox_notify();
+DROP TRIGGER IF EXISTS photos_cascade_events ON photos;
+DROP FUNCTION IF EXISTS photos_cascade_events();
+
+--the event triggers as migration 000024 left them
+ALTER TABLE events ADD COLUMN IF NOT EXISTS owner_id bigint;
+
+CREATE OR REPLACE FUNCTION photos_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    p photos;
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    IF TG_OP = 'DELETE' THEN
+        p := OLD;
+    ELSE
+        p := NEW;
+    END IF;
+    INSERT INTO events (type, user_id, owner_id, photo_id, data)
+    VALUES (
+        CASE TG_OP WHEN 'INSERT' THEN 'photo.created' WHEN 'UPDATE' THEN 'photo.updated' ELSE 'photo.deleted' END,
+        CASE WHEN p.visibility = 'private' THEN p.user_id END,
+        p.user_id,
+        p.id,
+        jsonb_build_object('id', p.id, 'version', p.version)
+    );
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER photos_events AFTER INSERT OR DELETE ON photos
+    FOR EACH ROW EXECUTE FUNCTION photos_events();
+CREATE TRIGGER photos_events_update AFTER UPDATE ON photos
+    FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION photos_events();
+
+CREATE OR REPLACE FUNCTION comments_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    INSERT INTO events (type, user_id, owner_id, photo_id, data)
+    SELECT
+        CASE
+            WHEN TG_OP = 'INSERT' THEN 'comment.created'
+            WHEN NEW.deleted_at IS NOT NULL AND OLD.deleted_at IS NULL THEN 'comment.deleted'
+            ELSE 'comment.updated'
+        END,
+        CASE WHEN photos.visibility = 'private' THEN photos.user_id END,
+        photos.user_id,
+        NEW.photo_id,
+        jsonb_build_object('id', NEW.id, 'photo_id', NEW.photo_id, 'parent_id', NEW.parent_id)
+    FROM photos
+    WHERE photos.id = NEW.photo_id;
+    RETURN NULL;
+END
+$$;
+
+CREATE OR REPLACE FUNCTION notifications_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('events'));
+    INSERT INTO events (type, user_id, owner_id, photo_id, data)
+    VALUES ('notification.created', NEW.user_id, NEW.user_id, NEW.photo_id,
+        jsonb_build_object('id', NEW.id, 'type', NEW.type, 'photo_id', NEW.photo_id));
+    RETURN NULL;
+END
+$$;
+
+CREATE OR REPLACE FUNCTION events_webhooks() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload)
+    SELECT webhooks.id, NEW.id, NEW.type, jsonb_build_object(
+        'id', NEW.id,
+        'type', NEW.type,
+        'photo_id', NEW.photo_id,
+        'data', NEW.data,
+        'created_at', NEW.created_at
+    )
+    FROM webhooks
+    WHERE webhooks.user_id = NEW.owner_id
+    AND webhooks.disabled_at IS NULL
+    AND NEW.type = ANY (webhooks.events);
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER events_webhooks AFTER INSERT ON events
+    FOR EACH ROW WHEN (NEW.owner_id IS NOT NULL) EXECUTE FUNCTION events_webhooks();
+
+DROP INDEX IF EXISTS outbox_published_at_idx;
+DROP INDEX IF EXISTS outbox_unpublished_idx;
+DROP TABLE IF EXISTS outbox;
@@ -0,0 +1,97 @@
+-- Filename: migrations/000026_create_outbox_table.up.sql
+
+--changes waiting to be published, written in the transaction that makes them. the server
+--relays them to its sinks (the event log streamed over SSE, webhooks, the log) and marks
+--them published. user_id, when set, is the only user who may see the change, owner_id is
+--the user it is about. there are no foreign keys, messages outlive the rows they are about
+CREATE TABLE IF NOT EXISTS outbox (
+    id bigserial PRIMARY KEY,
+    topic text NOT NULL,
+    aggregate_id bigint NOT NULL,
+    photo_id bigint,
+    user_id bigint,
+    owner_id bigint,
+    payload jsonb NOT NULL DEFAULT '{}',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    published_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS outbox_unpublished_idx ON outbox (id) WHERE published_at IS NULL;
+CREATE INDEX IF NOT EXISTS outbox_published_at_idx ON outbox (published_at) WHERE published_at IS NOT NULL;
+
+--wake the outbox relays as soon as a transaction that wrote messages commits. one
+--notification is enough however many messages were written, the relay reads them all
+CREATE OR REPLACE FUNCTION outbox_notify() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    PERFORM pg_notify('outbox', '');
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER outbox_notify AFTER INSERT ON outbox
+    FOR EACH STATEMENT EXECUTE FUNCTION outbox_notify();
+
+--photo changes are written to the outbox by the photo model, the relay writes them to the
+--event log and queues their webhooks
+DROP TRIGGER IF EXISTS photos_events_update ON photos;
+DROP TRIGGER IF EXISTS photos_events ON photos;
+DROP FUNCTION IF EXISTS photos_events();
+DROP TRIGGER IF EXISTS events_webhooks ON events;
+DROP FUNCTION IF EXISTS events_webhooks();
+ALTER TABLE events DROP COLUMN IF EXISTS owner_id;
+
+--photos deleted by a cascade, when their owner is deleted, never go through the photo model.
+--a cascade runs inside the foreign key's own trigger, which tells those deletes apart
+CREATE OR REPLACE FUNCTION photos_cascade_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    IF pg_trigger_depth() > 1 THEN
+        INSERT INTO outbox (topic, aggregate_id, photo_id, user_id, owner_id, payload)
+        VALUES ('photo.deleted', OLD.id, OLD.id,
+            CASE WHEN OLD.visibility = 'private' THEN OLD.user_id END,
+            OLD.user_id,
+            jsonb_build_object('id', OLD.id, 'version', OLD.version));
+    END IF;
+    RETURN NULL;
+END
+$$;
+
+CREATE TRIGGER photos_cascade_events AFTER DELETE ON photos
+    FOR EACH ROW EXECUTE FUNCTION photos_cascade_events();
+
+--comments and notifications are still written by triggers, now to the outbox
+CREATE OR REPLACE FUNCTION comments_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    INSERT INTO outbox (topic, aggregate_id, photo_id, user_id, owner_id, payload)
+    SELECT
+        CASE
+            WHEN TG_OP = 'INSERT' THEN 'comment.created'
+            WHEN NEW.deleted_at IS NOT NULL AND OLD.deleted_at IS NULL THEN 'comment.deleted'
+            ELSE 'comment.updated'
+        END,
+        NEW.id,
+        NEW.photo_id,
+        CASE WHEN photos.visibility = 'private' THEN photos.user_id END,
+        photos.user_id,
+        jsonb_build_object('id', NEW.id, 'photo_id', NEW.photo_id, 'parent_id', NEW.parent_id)
+    FROM photos
+    WHERE photos.id = NEW.photo_id;
+    RETURN NULL;
+END
+$$;
+
+CREATE OR REPLACE FUNCTION notifications_events() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    INSERT INTO outbox (topic, aggregate_id, photo_id, user_id, owner_id, payload)
+    VALUES ('notification.created', NEW.id, NEW.photo_id, NEW.user_id, NEW.user_id,
+        jsonb_build_object('id', NEW.id, 'type', NEW.type, 'photo_id', NEW.photo_id));
+    RETURN NULL;
+END
+$$;